@@ -0,0 +1,31 @@
+const express = require('express');
+
+const routeMethods = ['use', 'get', 'post', 'put', 'patch', 'delete']
+
+// Express 4 ignores the promise an async handler returns, so a throw inside
+// one leaves the request hanging and, as an unhandled rejection, takes the
+// whole process down. This forwards the rejection to the error handler.
+function forwardRejections(handler) {
+  // error handlers are told apart by their arity, so leave them as they are
+  if (handler.length === 4) {
+    return handler
+  }
+  return (req, res, next) => {
+    const result = handler(req, res, next)
+    if (result && typeof result.catch === 'function') {
+      result.catch(next)
+    }
+  }
+}
+
+// A Router whose async handlers report failures like synchronous ones do.
+function asyncRouter() {
+  const router = express.Router()
+  for (const method of routeMethods) {
+    const register = router[method].bind(router)
+    router[method] = (...args) => register(...args.map(arg => typeof arg === 'function' ? forwardRejections(arg) : arg))
+  }
+  return router
+}
+
+module.exports = { asyncRouter };
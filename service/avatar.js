@@ -0,0 +1,81 @@
+const crypto = require('crypto');
+
+const identiconGrid = 5
+const identiconCellSize = 16
+const identiconPadding = 8
+
+// A GitHub style identicon: a grid mirrored left to right, in one colour,
+// both picked from a hash of the seed so the same seed always looks the same.
+function identiconSvg(seed) {
+  const hash = crypto.createHash('sha256').update(String(seed)).digest()
+  const hue = Math.round(hash.readUInt16BE(0) / 0xffff * 360)
+  const colour = `hsl(${hue}, 55%, 50%)`
+  const half = Math.ceil(identiconGrid / 2)
+  const size = identiconGrid * identiconCellSize + identiconPadding * 2
+
+  const cells = []
+  for (let row = 0; row < identiconGrid; row++) {
+    for (let col = 0; col < half; col++) {
+      // one bit of the hash per cell on the left half, past the colour bytes
+      const bit = row * half + col
+      if ((hash[2 + (bit >> 3)] >> (bit & 7)) & 1) {
+        const columns = new Set([col, identiconGrid - 1 - col])
+        columns.forEach(c => cells.push(
+          `<rect x="${identiconPadding + c * identiconCellSize}" y="${identiconPadding + row * identiconCellSize}" ` +
+          `width="${identiconCellSize}" height="${identiconCellSize}"/>`
+        ))
+      }
+    }
+  }
+  return `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 ${size} ${size}" width="${size}" height="${size}">` +
+    `<rect width="${size}" height="${size}" fill="#f0f0f0"/><g fill="${colour}">${cells.join('')}</g></svg>`
+}
+
+const maxCachedAvatars = 500
+
+class AvatarTimeoutError extends Error {
+  constructor(ms) {
+    super(`avatar service did not answer within ${ms}ms`)
+    this.name = 'AvatarTimeoutError'
+  }
+}
+
+// Icons fetched from the avatar service, by URL. Seeds are room codes, so a
+// few hundred covers every room that's open; the oldest go first.
+const avatarCache = new Map()
+
+// The SVG the avatar service draws for seed, fetched once and then served
+// from memory. Resolves to null if the service doesn't answer with one, and
+// rejects with an AvatarTimeoutError if it takes longer than timeoutMs.
+async function fetchAvatar(serviceUrl, seed, timeoutMs) {
+  const url = new URL(serviceUrl)
+  url.searchParams.set('seed', seed)
+  const key = url.toString()
+  if (avatarCache.has(key)) {
+    return avatarCache.get(key)
+  }
+
+  // the body is covered too, so a service that stalls halfway can't hold on
+  const signal = AbortSignal.timeout(timeoutMs)
+  const timedOut = err => {
+    if (err.name === 'TimeoutError') {
+      throw new AvatarTimeoutError(timeoutMs)
+    }
+    return null
+  }
+  const response = await fetch(url, { signal }).catch(timedOut)
+  if (!response?.ok || !response.headers.get('content-type')?.startsWith('image/svg+xml')) {
+    return null
+  }
+  const svg = await response.text().catch(timedOut)
+  if (svg === null) {
+    return null
+  }
+  if (avatarCache.size >= maxCachedAvatars) {
+    avatarCache.delete(avatarCache.keys().next().value)
+  }
+  avatarCache.set(key, svg)
+  return svg
+}
+
+module.exports = { identiconSvg, fetchAvatar, AvatarTimeoutError };
@@ -0,0 +1,26 @@
+// Each ballot awards n-1 points to its highest scored option, n-2 to the
+// next and so on down to 0. Options a ballot scores equally share the points
+// for the places they span, so a two-way tie for first in a three option
+// room gives each (2 + 1) / 2 = 1.5 points. Missing scores count as 0, and
+// a weighted ballot's points are multiplied by its weight.
+function bordaPoints(votes, options) {
+  const points = new Map(options.map(opt => [opt, 0]))
+  votes.forEach(v => {
+    const ranked = [...options].sort((a, b) => (v.votes[b] ?? 0) - (v.votes[a] ?? 0))
+    let place = 0
+    while (place < ranked.length) {
+      const score = v.votes[ranked[place]] ?? 0
+      let end = place
+      while (end < ranked.length && (v.votes[ranked[end]] ?? 0) === score) {
+        end++
+      }
+      // places place..end-1 are worth n-1-place down to n-end
+      const shared = ((options.length - 1 - place) + (options.length - end)) / 2
+      ranked.slice(place, end).forEach(opt => points.set(opt, points.get(opt) + shared * (v.weight ?? 1)))
+      place = end
+    }
+  })
+  return points
+}
+
+module.exports = { bordaPoints };
@@ -1,14 +1,126 @@
-function calculateVoteResult(votes) {
-  const totals = new Map()
+const { instantRunoff } = require('./instantRunoff.js')
+const { pairwiseMatrix, rankedPairs } = require('./condorcet.js')
+const { bordaPoints } = require('./borda.js')
+const { tieBreakComparator, findTies } = require('./tieBreak.js')
+
+const votingMethods = ['score', 'instant-runoff', 'approval', 'condorcet', 'borda']
+
+// A ballot counts `weight` times, which defaults to once. The owner can give
+// some participants more say than others.
+function weightedVotes(room) {
+  return (room.votes ?? []).map(v => ({ ...v, weight: room.weights?.[v.username] ?? 1 }))
+}
+
+function sumScores(votes, options) {
+  // seed every option so unscored options still show up
+  const totals = new Map(options.map(opt => [opt, 0]))
   votes.forEach(element => {
     Object.keys(element.votes).forEach(key => {
-      totals.set(key, (totals.get(key) ?? 0) + element.votes[key])
+      totals.set(key, (totals.get(key) ?? 0) + element.votes[key] * (element.weight ?? 1))
     })
   });
-  const sortedOptions = Array.from(totals)
-    .sort((a, b) => b[1] - a[1])
+  return totals
+}
+
+function scoreTotals(votes, options, compareTies) {
+  return Array.from(sumScores(votes, options))
+    .sort((a, b) => b[1] - a[1] || compareTies(a[0], b[0]))
     .map(([key]) => key)
-  return sortedOptions
 }
 
-module.exports = { calculateVoteResult };
+// Ballots are seeded with zeros on join, so only ones that were saved or
+// locked in say anything about how people scored the options.
+function castBallots(room) {
+  const lockedIn = room.lockedIn ?? []
+  return weightedVotes(room).filter(v => v.updatedAt || lockedIn.includes(v.username))
+}
+
+// Per option: total, how many cast ballots scored it, the mean and standard
+// deviation of those scores, and how often each score was given. These
+// describe the ballots as cast, so weights don't come into them.
+function scoreBreakdown(room) {
+  const ballots = castBallots(room)
+  return (room.options ?? []).map(option => {
+    const scores = ballots
+      .map(v => v.votes[option])
+      .filter(score => score !== undefined)
+    const total = scores.reduce((sum, score) => sum + score, 0)
+    const mean = scores.length > 0 ? total / scores.length : 0
+    const variance = scores.length > 0
+      ? scores.reduce((sum, score) => sum + (score - mean) ** 2, 0) / scores.length
+      : 0
+    const counts = new Map()
+    scores.forEach(score => counts.set(score, (counts.get(score) ?? 0) + 1))
+    return {
+      option,
+      total,
+      voters: scores.length,
+      mean,
+      stdDev: Math.sqrt(variance),
+      histogram: Array.from(counts, ([score, count]) => ({ score, count }))
+        .sort((a, b) => a.score - b.score)
+    }
+  })
+}
+
+// seed is only used by rooms that break ties randomly
+function calculateVoteResult(room, seed) {
+  const votes = weightedVotes(room)
+  const options = room.options ?? []
+  const compareTies = tieBreakComparator(room, seed)
+  if (room.votingMethod === 'instant-runoff') {
+    return instantRunoff(votes, options, compareTies)
+  }
+  if (room.votingMethod === 'condorcet') {
+    return rankedPairs(pairwiseMatrix(votes, options), compareTies)
+  }
+  if (room.votingMethod === 'borda') {
+    const points = bordaPoints(castBallots(room), options)
+    return options.slice().sort((a, b) => points.get(b) - points.get(a) || compareTies(a, b))
+  }
+  // approval ballots are 0/1, so summing them counts approvals
+  return scoreTotals(votes, options, compareTies)
+}
+
+// The first winnerCount options in the sorted result win. Options tied on
+// score with the last of them win too, rather than the tie break deciding,
+// and overflow counts the extra winners that adds. Rankings without scores
+// (instant runoff, condorcet) have already broken their ties, so they're
+// simply cut at winnerCount.
+function pickWinners(sortedOptions, winnerCount, scores) {
+  const cut = Math.min(winnerCount, sortedOptions.length)
+  let end = cut
+  if (scores && cut > 0) {
+    const lastScore = scores.get(sortedOptions[cut - 1])
+    while (end < sortedOptions.length && scores.get(sortedOptions[end]) === lastScore) {
+      end += 1
+    }
+  }
+  return { winners: sortedOptions.slice(0, end), overflow: end - cut }
+}
+
+// The standings so far in an open room, for the owner's preview. The seed
+// for a random tie break is only drawn at close, so provisional ties are
+// broken with a fixed one.
+function provisionalTally(room) {
+  const results = calculateVoteResult(room, 0)
+  const totals = sumScores(weightedVotes(room), room.options)
+  return {
+    results,
+    totals: results.map(option => ({ option, total: totals.get(option) ?? 0 })),
+    ties: findTies(totals),
+    lockedInCount: room.lockedIn?.length ?? 0,
+    participantCount: room.participants.length
+  }
+}
+
+module.exports = {
+  calculateVoteResult,
+  provisionalTally,
+  pickWinners,
+  weightedVotes,
+  sumScores,
+  scoreBreakdown,
+  castBallots,
+  votingMethods
+};
@@ -0,0 +1,111 @@
+const DB = require('./database.js');
+const { calculateVoteResult, pickWinners, weightedVotes, sumScores, scoreBreakdown, castBallots } = require('./calculateVoteResult.js')
+const { bordaPoints } = require('./borda.js')
+const { broadcastToRoom, endRoom } = require('./roomHub.js')
+const { randomSeed, findTies } = require('./tieBreak.js')
+const { pairwiseMatrix, condorcetWinner } = require('./condorcet.js')
+const { toResultResponse } = require('./resultResponse.js')
+const { sendWebhook } = require('./webhooks.js')
+
+// How many more participants must lock in before the room can close.
+function lockInsNeeded(room) {
+  return Math.max(0, (room.minParticipants ?? 0) - (room.lockedIn?.length ?? 0))
+}
+
+// Works out a room's result from its ballots: the ranking, each option's
+// total, and the details the result keeps for its voting method. Nothing is
+// saved, so it serves hypothetical ballots as well as real rooms.
+function tallyRoom(room, tieBreakSeed) {
+  const sortedOptions = calculateVoteResult(room, tieBreakSeed)
+  const votes = weightedVotes(room)
+  const totals = sumScores(votes, room.options)
+  // condorcet results keep the head to head counts so they can be audited
+  const pairwise = room.votingMethod === 'condorcet' ? pairwiseMatrix(votes, room.options) : undefined
+  const borda = room.votingMethod === 'borda' ? bordaPoints(castBallots(room), room.options) : undefined
+  const rankedByScore = room.votingMethod !== 'instant-runoff' && room.votingMethod !== 'condorcet'
+  const winnerCount = room.winnerCount ?? 1
+  const { winners, overflow } = pickWinners(sortedOptions, winnerCount, rankedByScore ? borda ?? totals : undefined)
+  return {
+    sortedOptions,
+    totals,
+    details: {
+      winnerCount,
+      winners,
+      winnerOverflow: overflow,
+      tieBreak: room.tieBreak ?? 'earliest-added',
+      tieBreakSeed,
+      ties: findTies(totals),
+      breakdown: scoreBreakdown(room),
+      pairwise,
+      condorcetWinner: pairwise && condorcetWinner(pairwise),
+      bordaTotals: borda && sortedOptions.map(option => ({ option, points: borda.get(option) }))
+    }
+  }
+}
+
+// The notes voters left, grouped by option, without names in anonymous rooms.
+function collectComments(room) {
+  return room.options
+    .map(option => ({
+      option,
+      comments: room.votes.filter(v => v.comments?.[option]).map(v => ({
+        username: room.anonymous ? undefined : v.username,
+        text: v.comments[option]
+      }))
+    }))
+    .filter(c => c.comments.length > 0)
+}
+
+// Returns null if the room changed since it was read, so the caller can
+// refetch rather than publish a result that misses the latest changes.
+async function closeRoomWithResult(room) {
+  const closedAt = new Date()
+  if (!await DB.closeRoom(room._id, closedAt, room.version ?? 0)) {
+    return null
+  }
+
+  // keep the seed with the result so a random tie break can be reproduced
+  const tieBreakSeed = room.tieBreak === 'random-seeded' ? randomSeed() : undefined
+  const { sortedOptions, totals, details } = tallyRoom(room, tieBreakSeed)
+  const result = await DB.createResult(room, sortedOptions, totals, {
+    ...details,
+    // hidden results stay owner-only until the owner reveals them
+    visible: room.resultsVisible ?? true,
+    closedAt,
+    comments: collectComments(room),
+    commentsPublic: room.commentsPublic ?? false,
+    // when each ballot was last changed, without names in anonymous rooms
+    voteTimes: room.votes.filter(v => v.updatedAt).map(v => ({
+      username: room.anonymous ? undefined : v.username,
+      updatedAt: v.updatedAt
+    }))
+  })
+
+  broadcastToRoom(room._id, { type: 'results-available', id: result._id, visible: result.visible })
+  endRoom(room._id)
+  // sent in the background, so a slow receiver doesn't hold up the close
+  if (room.webhookUrl) {
+    sendWebhook(room.webhookUrl, {
+      event: 'room.closed',
+      roomId: room._id,
+      code: room.code,
+      result: toResultResponse(result, room.owner)
+    })
+  }
+  return result
+}
+
+// Closes the room once every participant has locked in, unless the owner
+// turned auto-close off. Returns the new result, or null if still open.
+async function maybeAutoClose(roomId) {
+  const room = await DB.getRoomById(roomId)
+  if (!room || room.state !== 'open' || room.autoClose === false) {
+    return null
+  }
+  if ((room.lockedIn?.length ?? 0) < room.participants.length || lockInsNeeded(room) > 0) {
+    return null
+  }
+  return await closeRoomWithResult(room)
+}
+
+module.exports = { closeRoomWithResult, maybeAutoClose, lockInsNeeded, tallyRoom };
@@ -0,0 +1,36 @@
+const { sameOption } = require('./validateOption.js')
+
+// Lines up several results option by option. Options match regardless of
+// case, keeping the name from the first result that has them, and count as
+// zero in results that don't have them. The combined ranking orders options
+// by their total across every result, ties going to the option seen first.
+function compareResults(results) {
+  const rows = []
+  results.forEach(result => {
+    (result.totals ?? []).forEach(({ option, total }) => {
+      let row = rows.find(r => sameOption(r.option, option))
+      if (!row) {
+        row = { option, scores: {}, combined: 0 }
+        rows.push(row)
+      }
+      row.scores[result._id] = (row.scores[result._id] ?? 0) + total
+      row.combined += total
+    })
+  })
+  rows.forEach(row => {
+    row.scores = Object.fromEntries(results.map(result => [result._id, row.scores[result._id] ?? 0]))
+  })
+
+  const ranking = rows
+    .map((row, i) => ({ row, i }))
+    .sort((a, b) => b.row.combined - a.row.combined || a.i - b.i)
+    .map(({ row }, i) => ({ option: row.option, combined: row.combined, rank: i + 1 }))
+
+  return {
+    results: results.map(result => ({ id: result._id, roomId: result.roomId, closedAt: result.closedAt })),
+    table: rows,
+    ranking
+  }
+}
+
+module.exports = { compareResults };
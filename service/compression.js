@@ -0,0 +1,94 @@
+const zlib = require('zlib');
+
+// text and the structured formats we serve; event streams are left alone so
+// each event reaches the client as soon as it's written
+const compressibleType = /^(text\/(?!event-stream)|application\/(json|javascript|xml)|image\/svg\+xml)/
+
+const encoders = {
+  gzip: () => zlib.createGzip(),
+  deflate: () => zlib.createDeflate()
+}
+
+// The first encoding we support that the client accepts, or undefined.
+function negotiate(acceptEncoding = '') {
+  const accepted = new Map(acceptEncoding.split(',').map(part => {
+    const [name, ...params] = part.trim().toLowerCase().split(';')
+    const q = params.map(p => p.trim()).find(p => p.startsWith('q='))
+    return [name.trim(), q ? Number(q.slice(2)) : 1]
+  }))
+  return Object.keys(encoders).find(name => (accepted.get(name) ?? accepted.get('*') ?? 0) > 0)
+}
+
+// Compresses responses of at least `threshold` bytes for clients that accept
+// gzip or deflate. Whether to compress is decided on the first write, from
+// the Content-Length when there is one and the whole body when it arrives in
+// a single end(). Responses that have already sent their headers, like event
+// streams, go out untouched.
+function compression({ threshold }) {
+  return (req, res, next) => {
+    res.vary('Accept-Encoding')
+    const encoding = negotiate(req.get('Accept-Encoding'))
+    if (!encoding || req.method === 'HEAD') {
+      next()
+      return
+    }
+
+    const write = res.write.bind(res)
+    const end = res.end.bind(res)
+
+    function shouldCompress(body) {
+      if (res.headersSent || res.getHeader('Content-Encoding')) {
+        return false
+      }
+      if (res.statusCode === 204 || res.statusCode === 304) {
+        return false
+      }
+      if (!compressibleType.test(res.getHeader('Content-Type') ?? '')) {
+        return false
+      }
+      const contentLength = res.getHeader('Content-Length')
+      const size = contentLength !== undefined
+        ? Number(contentLength)
+        : body !== undefined ? Buffer.byteLength(body) : Infinity
+      return size >= threshold
+    }
+
+    // swaps write and end for versions that feed the encoder, or puts the
+    // originals back if this response isn't worth compressing
+    function start(body) {
+      if (!shouldCompress(body)) {
+        res.write = write
+        res.end = end
+        return
+      }
+      const encoder = encoders[encoding]()
+      res.removeHeader('Content-Length')
+      res.set('Content-Encoding', encoding)
+      encoder.on('data', chunk => write(chunk))
+      encoder.on('end', () => end())
+      res.write = (chunk, chunkEncoding) => {
+        encoder.write(chunk, chunkEncoding)
+        return true
+      }
+      res.end = (chunk, chunkEncoding) => {
+        if (chunk !== undefined && typeof chunk !== 'function') {
+          encoder.write(chunk, chunkEncoding)
+        }
+        encoder.end()
+        return res
+      }
+    }
+
+    res.write = (chunk, chunkEncoding) => {
+      start(undefined)
+      return res.write(chunk, chunkEncoding)
+    }
+    res.end = (chunk, chunkEncoding) => {
+      start(chunk === undefined || typeof chunk === 'function' ? '' : chunk)
+      return res.end(chunk, chunkEncoding)
+    }
+    next()
+  }
+}
+
+module.exports = { compression };
@@ -0,0 +1,64 @@
+// wins[i][j] counts the ballots, by weight, that score options[i] above
+// options[j]. A missing score counts as 0, so equal scores express no
+// preference.
+function pairwiseMatrix(votes, options) {
+  const wins = options.map(() => options.map(() => 0))
+  votes.forEach(v => {
+    options.forEach((a, i) => {
+      options.forEach((b, j) => {
+        if ((v.votes[a] ?? 0) > (v.votes[b] ?? 0)) {
+          wins[i][j] += v.weight ?? 1
+        }
+      })
+    })
+  })
+  return { options, wins }
+}
+
+// The option that beats every other option head to head, or null.
+function condorcetWinner({ options, wins }) {
+  const index = options.findIndex((_, i) =>
+    options.every((_, j) => i === j || wins[i][j] > wins[j][i]))
+  return index === -1 ? null : options[index]
+}
+
+// Ranked pairs (Tideman). Head to head wins are locked in from the largest
+// margin down, skipping any that would create a cycle, and the options are
+// then ordered by the locked wins. When there is a Condorcet winner it always
+// comes first, so this only changes the outcome when there's a cycle.
+function rankedPairs({ options, wins }, compareTies) {
+  const pairs = []
+  options.forEach((_, i) => {
+    options.forEach((_, j) => {
+      if (wins[i][j] > wins[j][i]) {
+        pairs.push({ winner: i, loser: j, support: wins[i][j], opposition: wins[j][i] })
+      }
+    })
+  })
+  pairs.sort((a, b) =>
+    b.support - a.support ||
+    a.opposition - b.opposition ||
+    compareTies(options[a.winner], options[b.winner]) ||
+    compareTies(options[b.loser], options[a.loser]))
+
+  const beats = options.map(() => new Set())
+  const reaches = (from, to) => from === to || [...beats[from]].some(next => reaches(next, to))
+  pairs.forEach(({ winner, loser }) => {
+    if (!reaches(loser, winner)) {
+      beats[winner].add(loser)
+    }
+  })
+
+  // repeatedly take the options nobody remaining has beaten
+  const ranking = []
+  let remaining = options.map((_, i) => i)
+  while (remaining.length > 0) {
+    const unbeaten = remaining.filter(i => remaining.every(j => !beats[j].has(i)))
+    const next = unbeaten.reduce((best, i) => compareTies(options[i], options[best]) < 0 ? i : best)
+    ranking.push(options[next])
+    remaining = remaining.filter(i => i !== next)
+  }
+  return ranking
+}
+
+module.exports = { pairwiseMatrix, condorcetWinner, rankedPairs };
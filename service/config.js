@@ -0,0 +1,122 @@
+const fs = require('fs');
+const path = require('path');
+const { MIN_CODE_LENGTH, MAX_CODE_LENGTH, defaultAlphabet } = require('./roomCode.js')
+
+// Older deployments keep the mongo url in a dbconfig.json next to the service
+// rather than in MONGO_URL.
+function mongoUrlFromFile(dir) {
+  const file = path.join(dir, 'dbconfig.json')
+  if (!fs.existsSync(file)) {
+    return undefined
+  }
+  return JSON.parse(fs.readFileSync(file, 'utf8')).url
+}
+
+// "name=ms,name=ms" into a Map of per-operation database timeouts.
+function parseOperationTimeouts(value, problems) {
+  return new Map(value.split(',').map(part => part.trim()).filter(Boolean).flatMap(part => {
+    const [name, ms] = part.split('=').map(s => s.trim())
+    if (!name || !/^[1-9]\d*$/.test(ms ?? '')) {
+      problems.push(`DB_OPERATION_TIMEOUTS entry "${part}" must look like name=milliseconds`)
+      return []
+    }
+    return [[name, Number(ms)]]
+  }))
+}
+
+// Everything the service can be configured with, read from the environment
+// once at startup. Every problem is reported together, so a bad deploy fails
+// straight away with the whole list instead of one setting at a time.
+function loadConfig(env = process.env, argv = process.argv) {
+  const problems = []
+
+  function integer(name, fallback, min, given = env[name]) {
+    const value = Number(given ?? fallback)
+    if (!Number.isInteger(value) || value < min) {
+      problems.push(`${name} must be an integer of at least ${min}`)
+    }
+    return value
+  }
+
+  function url(name, fallback) {
+    const value = env[name] ?? fallback
+    if (value === undefined) {
+      return undefined
+    }
+    try {
+      new URL(value)
+    } catch {
+      problems.push(`${name} must be a URL`)
+    }
+    return value
+  }
+
+  const mongoUrl = env.MONGO_URL ?? mongoUrlFromFile(__dirname)
+  if (!mongoUrl) {
+    problems.push('MONGO_URL must be set, or dbconfig.json must give a url')
+  }
+
+  const codeLength = integer('ROOM_CODE_LENGTH', 4, MIN_CODE_LENGTH)
+  if (codeLength > MAX_CODE_LENGTH) {
+    problems.push(`ROOM_CODE_LENGTH must be at most ${MAX_CODE_LENGTH}`)
+  }
+  const codeAlphabet = (env.ROOM_CODE_ALPHABET ?? defaultAlphabet).toUpperCase()
+  if (!/^[A-Z0-9]{2,}$/.test(codeAlphabet) || new Set(codeAlphabet).size !== codeAlphabet.length) {
+    problems.push('ROOM_CODE_ALPHABET must be at least two distinct letters or digits')
+  }
+
+  const config = {
+    // a port given as the first argument wins, as pm2 passes it that way
+    port: integer('PORT', env.PORT ?? 4000, 1, argv[2]),
+    // the built front end; deployments copy it next to this file
+    publicDir: env.PUBLIC_DIR ?? path.join(__dirname, 'public'),
+    // set while working on the front end to pick up rebuilt pages without a restart
+    reloadPages: env.RELOAD_PAGES === 'true',
+    // responses smaller than this many bytes aren't worth compressing
+    compressionThreshold: integer('COMPRESSION_THRESHOLD', 1024, 0),
+    // where people reach the app, e.g. https://quikvote.click, for links that
+    // leave the server such as QR codes. Defaults to the host the request came in on.
+    publicBaseUrl: url('PUBLIC_BASE_URL')?.replace(/\/+$/, ''),
+    // comma separated origins of front ends hosted elsewhere, e.g.
+    // CORS_ORIGINS=https://app.example.com,http://localhost:5173
+    corsOrigins: (env.CORS_ORIGINS ?? '').split(',').map(o => o.trim()).filter(Boolean),
+    // whether those front ends can make requests as the logged in user
+    corsCredentials: env.CORS_CREDENTIALS === 'true',
+    avatar: {
+      // where room icons come from; anything that takes a seed parameter and
+      // answers with an SVG, like a self-hosted DiceBear
+      serviceUrl: url('AVATAR_SERVICE_URL', 'https://api.dicebear.com/9.x/icons/svg'),
+      // whether icons are fetched and served by us, so browsers never send
+      // room codes to the service, or the browser is sent to the service
+      proxy: env.AVATAR_PROXY !== 'false',
+      // how long to wait for the service before giving up on an icon
+      timeoutMs: integer('AVATAR_TIMEOUT_MS', 3000, 1)
+    },
+    webhooks: {
+      // signs the results posted to rooms' webhooks, so receivers can check
+      // they came from us; rooms can't set a webhook without it
+      secret: env.WEBHOOK_SECRET || undefined
+    },
+    // how often to look for rooms whose deadline has passed
+    deadlineSweepMs: integer('DEADLINE_SWEEP_MS', 5000, 1),
+    // how long in-flight requests get to finish on shutdown
+    shutdownGraceMs: integer('SHUTDOWN_GRACE_MS', 10000, 0),
+    database: {
+      url: mongoUrl,
+      // how long any one operation may take before the request gives up on it,
+      // with overrides for named operations as "getAuditLog=15000,getHistory=10000"
+      timeoutMs: integer('DB_TIMEOUT_MS', 5000, 1),
+      operationTimeouts: parseOperationTimeouts(env.DB_OPERATION_TIMEOUTS ?? '', problems)
+    },
+    // longer codes, or a bigger alphabet, make collisions rarer as more rooms
+    // are open at once
+    roomCode: { length: codeLength, alphabet: codeAlphabet }
+  }
+
+  if (problems.length > 0) {
+    throw new Error(`Invalid configuration:\n  ${problems.join('\n  ')}`)
+  }
+  return Object.freeze(config)
+}
+
+module.exports = { loadConfig };
@@ -0,0 +1,57 @@
+const { sendError } = require('./errors.js')
+
+const allowedMethods = ['GET', 'POST', 'PUT', 'PATCH', 'DELETE']
+const allowedHeaders = ['Content-Type', 'HX-Request', 'Idempotency-Key']
+const exposedHeaders = ['X-Request-ID']
+const preflightMaxAgeSeconds = 600
+
+// Lets front ends served from the listed origins call the API. Requests from
+// any other origin are refused outright rather than answered without CORS
+// headers. Requests from the API's own origin, and ones with no Origin at
+// all, pass straight through. With credentials on, browsers send the auth
+// cookie along with cross origin requests.
+function cors({ origins, credentials }) {
+  return (req, res, next) => {
+    const origin = req.get('Origin')
+    if (!origin || isSameOrigin(origin, req.get('host'))) {
+      next()
+      return
+    }
+    if (!isAllowedOrigin(origin, req.get('host'), origins)) {
+      sendError(res, 403, 'ORIGIN_NOT_ALLOWED', `Origin ${origin} is not allowed`)
+      return
+    }
+
+    res.vary('Origin')
+    res.set('Access-Control-Allow-Origin', origin)
+    res.set('Access-Control-Expose-Headers', exposedHeaders.join(', '))
+    if (credentials) {
+      res.set('Access-Control-Allow-Credentials', 'true')
+    }
+
+    if (req.method === 'OPTIONS') {
+      res.set('Access-Control-Allow-Methods', allowedMethods.join(', '))
+      res.set('Access-Control-Allow-Headers', allowedHeaders.join(', '))
+      res.set('Access-Control-Max-Age', String(preflightMaxAgeSeconds))
+      res.status(204).end()
+      return
+    }
+    next()
+  }
+}
+
+function isSameOrigin(origin, host) {
+  try {
+    return new URL(origin).host === host
+  } catch {
+    return false
+  }
+}
+
+// Whether a request from origin to host may act as the logged in user: it
+// comes from the API's own origin or one of the listed front ends.
+function isAllowedOrigin(origin, host, origins) {
+  return isSameOrigin(origin, host) || origins.includes(origin)
+}
+
+module.exports = { cors, isAllowedOrigin };
@@ -0,0 +1,20 @@
+function escapeCsvField(value) {
+  let field = String(value ?? '')
+  // stop spreadsheets from treating user text as a formula; numbers are
+  // left alone so negative scores stay numeric
+  if (typeof value !== 'number' && /^[=+\-@]/.test(field)) {
+    field = `'${field}`
+  }
+  if (/[",\r\n]/.test(field)) {
+    field = `"${field.replace(/"/g, '""')}"`
+  }
+  return field
+}
+
+function toCsv(header, rows) {
+  return [header, ...rows]
+    .map(row => row.map(escapeCsvField).join(','))
+    .join('\r\n') + '\r\n'
+}
+
+module.exports = { toCsv };
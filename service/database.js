@@ -1,135 +1,1081 @@
 const { MongoClient, ObjectId } = require('mongodb');
 const uuid = require('uuid');
 const bcrypt = require('bcrypt');
-const dbconfig = require('./dbconfig.json')
+const { generateRoomCode } = require('./roomCode.js')
+const { getRegistry } = require('./metrics.js')
+const { DEFAULT_MIN_SCORE, DEFAULT_MAX_SCORE } = require('./validateVotes.js')
+const { DEFAULT_MAX_OPTIONS, DEFAULT_MAX_OPTION_LENGTH } = require('./validateOption.js')
 
-const dbUrl = dbconfig.url
+// Set by connect from the service's config before anything is read or
+// written.
+let client
+let db
+let userCollection
+let roomsCollection
+let historyCollection
+let messagesCollection
+let auditCollection
+let timeouts = { timeoutMs: 5000, operationTimeouts: new Map() }
 
-const client = new MongoClient(dbUrl)
-const db = client.db('quikvote')
-const userCollection = db.collection('user')
-const roomsCollection = db.collection('room')
-const historyCollection = db.collection('history')
+// Points the module at the database in options ({ url, timeoutMs,
+// operationTimeouts }) and resolves once it's reachable and indexed.
+// Operations can be called as soon as it has been called, without waiting.
+async function connect(options) {
+  timeouts = options
+  // finding a server counts against the same budget as the operation itself
+  client = new MongoClient(options.url, { serverSelectionTimeoutMS: options.timeoutMs })
+  db = client.db('quikvote')
+  userCollection = db.collection('user')
+  roomsCollection = db.collection('room')
+  historyCollection = db.collection('history')
+  messagesCollection = db.collection('message')
+  auditCollection = db.collection('audit')
+  await testConnection()
+}
 
 async function testConnection() {
   await client.connect()
   await db.command({ ping: 1 })
+  await ensureIndexes()
+}
+
+// Every index the queries here rely on, by collection.
+function indexSpecs() {
+  return [
+    // codes only need to be unique among open rooms; closed rooms can share them
+    [roomsCollection, { code: 1 }, { unique: true, partialFilterExpression: { state: 'open' } }],
+    // looking a code up in any state, newest room first
+    [roomsCollection, { code: 1, _id: -1 }],
+    [roomsCollection, { owner: 1 }],
+    [roomsCollection, { participants: 1 }],
+    [roomsCollection, { closeAt: 1 }, { partialFilterExpression: { state: 'open' } }],
+    // mongo removes rooms shortly after their expiresAt passes
+    [roomsCollection, { expiresAt: 1 }, { expireAfterSeconds: 0 }],
+    // an idempotency key names one room per owner for as long as the room lasts
+    [
+      roomsCollection,
+      { owner: 1, idempotencyKey: 1 },
+      { unique: true, partialFilterExpression: { idempotencyKey: { $exists: true } } }
+    ],
+    // one user per name, whatever its case. Named apart from the non-unique
+    // index that used to be on the same key, since mongo won't change an
+    // index's options in place.
+    [userCollection, { username: 1 }, { unique: true, collation: usernameCollation, name: 'username_1_unique' }],
+    [userCollection, { token: 1 }],
+    [historyCollection, { owner: 1, timestamp: -1 }],
+    [messagesCollection, { roomId: 1, at: 1 }],
+    // the log is read newest first, optionally only one action, from a cursor
+    [auditCollection, { roomId: 1, at: -1, _id: -1 }],
+    [auditCollection, { roomId: 1, action: 1, at: -1, _id: -1 }]
+  ]
+}
+
+// Creates any index that's missing and logs the ones it made. Indexes that
+// already exist are left as they are, so this is safe on every startup. An
+// index that can't be built, e.g. a unique one over duplicate data, throws,
+// which stops the service starting.
+async function ensureIndexes() {
+  for (const [collection, keys, options = {}] of indexSpecs()) {
+    const existing = await collection.indexExists(options.name ?? indexName(keys)).catch(() => false)
+    const name = await collection.createIndex(keys, options)
+    if (!existing) {
+      console.log(`created index ${collection.collectionName}.${name}`)
+    }
+  }
+}
+
+// mongo's default name for an index on keys, e.g. "owner_1_idempotencyKey_1"
+function indexName(keys) {
+  return Object.entries(keys).map(([field, direction]) => `${field}_${direction}`).join('_')
+}
+
+const pingTimeoutMs = 2000
+
+// Thrown when a database operation takes longer than it's allowed to.
+class DatabaseTimeoutError extends Error {
+  constructor(operation, ms) {
+    super(`database ${operation} timed out after ${ms}ms`)
+    this.name = 'DatabaseTimeoutError'
+    this.operation = operation
+  }
+}
+
+// Settles like promise, or rejects with a DatabaseTimeoutError once ms pass.
+// Mongo may still finish the operation; we just stop waiting for it.
+async function withTimeout(promise, operation, ms) {
+  let timeout
+  try {
+    return await Promise.race([
+      promise,
+      new Promise((_resolve, reject) => {
+        timeout = setTimeout(() => reject(new DatabaseTimeoutError(operation, ms)), ms)
+      })
+    ])
+  } finally {
+    clearTimeout(timeout)
+  }
+}
+
+// Resolves with the round trip time in ms, or rejects if mongo doesn't answer
+// within pingTimeoutMs.
+async function ping() {
+  const start = Date.now()
+  await withTimeout(db.command({ ping: 1 }), 'ping', pingTimeoutMs)
+  return Date.now() - start
+}
+
+function isClass(value) {
+  return /^class\b/.test(Function.prototype.toString.call(value))
+}
+
+// Wraps every operation in exports with its timeout, whether it's declared
+// async or just hands back mongo's promise; anything that returns a plain
+// value is left alone. ping has its own timeout, and connect and close
+// shouldn't be cut short.
+function withTimeouts(exports) {
+  return Object.fromEntries(Object.entries(exports).map(([name, value]) => {
+    if (typeof value !== 'function' || isClass(value) || ['ping', 'connect', 'close'].includes(name)) {
+      return [name, value]
+    }
+    return [name, (...args) => {
+      const result = value(...args)
+      if (typeof result?.then !== 'function') {
+        return result
+      }
+      const ms = timeouts.operationTimeouts.get(name) ?? timeouts.timeoutMs
+      return withTimeout(result, name, ms)
+    }]
+  }))
+}
+
+// usernames are matched case-insensitively so "Bob" and "bob " are one user
+const usernameCollation = { locale: 'en', strength: 2 }
+
+// the database's side of sameOption in validateOption.js, so duplicate checks
+// can be part of an update's filter
+const optionCollation = { locale: 'en', strength: 2 }
+
+function normalizeUsername(username) {
+  return String(username).trim()
 }
-testConnection()
-  .then(() => console.log('db connected'))
-  .catch(ex => {
-    console.log(`Unable to connect to database with ${dbUrl} because ${ex.message}`);
-    process.exit(1)
-  })
 
 function getUser(username) {
-  return userCollection.findOne({ username });
+  return userCollection.findOne(
+    { username: normalizeUsername(username) },
+    { collation: usernameCollation }
+  );
 }
 
 function getUserByToken(token) {
   return userCollection.findOne({ token });
 }
 
+// Returns null if the name is taken, in any case, even by someone
+// registering at the same moment.
 async function createUser(username, password) {
   const passwordHash = await bcrypt.hash(password, 10);
 
   const user = {
-    username,
+    username: normalizeUsername(username),
     password: passwordHash,
     token: uuid.v4(),
   };
-  await userCollection.insertOne(user);
+  try {
+    await userCollection.insertOne(user);
+  } catch (ex) {
+    if (ex.code === duplicateKeyErrorCode) {
+      return null
+    }
+    throw ex
+  }
 
   return user;
 }
 
-function generateRandomRoomCode() {
-  const alpha = ['A', 'B', 'C', 'D', 'E', 'F', 'G', 'H', 'J', 'K', 'M', 'N', 'P', 'Q', 'R', 'S', 'T', 'U', 'V', 'W', 'X', 'Y', 'Z']
-  const numeric = ['2', '3', '4', '5', '6', '7', '8', '9']
-  const alphanumeric = alpha.concat(numeric)
+const roomTtlMs = 24 * 60 * 60 * 1000
+// how long an owner has to restore a room they deleted
+const roomRestoreWindowMs = 24 * 60 * 60 * 1000
+const duplicateKeyErrorCode = 11000
 
-  let code = ''
-  let numChars = 4
+// A draft room's owner can set up its options and settings before anyone can
+// join, so those updates accept draft rooms as well as open ones.
+const editableStates = { $in: ['draft', 'open'] }
+const maxCodeAttempts = 10
 
-  for (let i = 0; i < numChars; i++) {
-    const rand = Math.floor(Math.random() * alphanumeric.length)
-    code += alphanumeric[rand]
+// Returns null if a custom code is already in use by an open room. Random
+// codes are regenerated on collision instead. A repeated idempotency key
+// returns the room it created the first time.
+async function createRoom(creatorUsername, settings = {}) {
+  if (settings.idempotencyKey) {
+    const existing = await findRoomByIdempotencyKey(creatorUsername, settings.idempotencyKey)
+    if (existing) {
+      return existing
+    }
+  }
+  // only the hash of a room's password is ever stored
+  const passwordHash = settings.password ? await bcrypt.hash(settings.password, 10) : settings.passwordHash ?? null
+  for (let attempt = 0; attempt < maxCodeAttempts; attempt++) {
+    const newRoom = buildRoom(creatorUsername, { ...settings, passwordHash })
+    try {
+      const result = await roomsCollection.insertOne(newRoom)
+      countEvent('quikvote_rooms_created_total', 'Rooms created')
+      return {
+        ...newRoom,
+        id: result.insertedId
+      }
+    } catch (ex) {
+      if (ex.code !== duplicateKeyErrorCode) {
+        throw ex
+      }
+      // a concurrent request with the same key got there first
+      if (ex.keyPattern?.idempotencyKey) {
+        return await findRoomByIdempotencyKey(creatorUsername, settings.idempotencyKey)
+      }
+      if (settings.code) {
+        return null
+      }
+    }
   }
-  return code
+  throw new Error('Unable to generate a unique room code')
+}
+
+async function findRoomByIdempotencyKey(owner, idempotencyKey) {
+  const room = await roomsCollection.findOne({ owner, idempotencyKey })
+  return room && { ...room, id: room._id }
+}
+
+// Settings a cloned room carries over from the original.
+const clonedSettings = [
+  'votingMethod',
+  'maxParticipants',
+  'minParticipants',
+  'quorum',
+  'autoClose',
+  'minScore',
+  'maxScore',
+  'totalBudget',
+  'anonymous',
+  'tieBreak',
+  'winnerCount',
+  'maxOptionsPerUser',
+  'maxOptions',
+  'tallyPreview',
+  'shuffleOptions',
+  'resultsVisible',
+  'announceParticipants',
+  'requireComplete',
+  'avatarStyle',
+  'commentsPublic',
+  'webhookUrl',
+  'maxOptionLength',
+  'weights',
+  'passwordHash',
+  'options',
+  'optionDetails',
+  'pinnedOptions'
+]
+
+// A fresh open room for username with the same options and settings as room,
+// but no other participants or votes, and a new code.
+async function cloneRoom(room, username) {
+  const settings = Object.fromEntries(
+    clonedSettings
+      .filter(key => room[key] !== undefined)
+      .map(key => [key, room[key]])
+  )
+  return await createRoom(username, settings)
 }
 
-async function createRoom(creatorUsername) {
-  const newRoom = {
-    code: generateRandomRoomCode(),
+function buildRoom(creatorUsername, settings) {
+  const options = settings.options ?? []
+  return {
+    ...(settings.idempotencyKey && { idempotencyKey: settings.idempotencyKey }),
+    code: settings.code ?? generateRoomCode(),
     owner: creatorUsername,
+    // the owner is always a participant (ownership can only pass to another
+    // participant, and the owner can't leave or be kicked), so participant
+    // checks never need to special-case them
     participants: [creatorUsername],
-    options: [],
-    votes: [],
-    state: 'open'
+    // spectators watch the room but have no ballot, so they don't count
+    // towards maxParticipants or auto-close
+    spectators: [],
+    options,
+    optionAuthors: Object.fromEntries(options.map(opt => [opt, creatorUsername])),
+    optionDetails: settings.optionDetails ?? {},
+    // options the owner keeps at the top of everyone's list, in pin order
+    pinnedOptions: settings.pinnedOptions ?? [],
+    votes: [{ username: creatorUsername, votes: Object.fromEntries(options.map(opt => [opt, 0])) }],
+    lockedIn: [],
+    lockIns: [],
+    reactions: [],
+    state: settings.draft ? 'draft' : 'open',
+    version: 0,
+    votingMethod: settings.votingMethod ?? 'score',
+    maxParticipants: settings.maxParticipants ?? 0,
+    minParticipants: settings.minParticipants ?? 0,
+    quorum: settings.quorum ?? 0,
+    autoClose: settings.autoClose ?? true,
+    closeAt: settings.closeAt ?? null,
+    minScore: settings.minScore ?? DEFAULT_MIN_SCORE,
+    maxScore: settings.maxScore ?? DEFAULT_MAX_SCORE,
+    totalBudget: settings.totalBudget ?? 0,
+    anonymous: settings.anonymous ?? false,
+    tieBreak: settings.tieBreak ?? 'earliest-added',
+    winnerCount: settings.winnerCount ?? 1,
+    maxOptionsPerUser: settings.maxOptionsPerUser ?? 0,
+    maxOptions: settings.maxOptions ?? DEFAULT_MAX_OPTIONS,
+    tallyPreview: settings.tallyPreview ?? true,
+    shuffleOptions: settings.shuffleOptions ?? false,
+    resultsVisible: settings.resultsVisible ?? true,
+    announceParticipants: settings.announceParticipants ?? false,
+    requireComplete: settings.requireComplete ?? false,
+    avatarStyle: settings.avatarStyle ?? 'icon',
+    commentsPublic: settings.commentsPublic ?? false,
+    webhookUrl: settings.webhookUrl ?? null,
+    maxOptionLength: settings.maxOptionLength ?? DEFAULT_MAX_OPTION_LENGTH,
+    weights: settings.weights ?? {},
+    passwordHash: settings.passwordHash ?? null,
+    expiresAt: new Date(Date.now() + roomTtlMs)
   }
-  const result = await roomsCollection.insertOne(newRoom)
+}
 
-  return {
-    ...newRoom,
-    id: result.insertedId
+// lockIns records when each user in lockedIn locked in. Rooms from before it
+// existed get one built from lockedIn, with the times unknown.
+function withLockIns(room) {
+  if (room && !room.lockIns) {
+    room.lockIns = (room.lockedIn ?? []).map(username => ({ username, at: null }))
   }
+  return room
 }
 
+// Deleted rooms stay in the collection until they can no longer be restored,
+// but everything else treats them as gone.
+const notDeleted = { deletedAt: { $exists: false } }
+
+// Codes are only unique among open rooms, so a draft or a closed room can
+// share one with an open room. The open room is the one anybody typing the
+// code means; failing that, the newest room that had it.
 async function getRoomByCode(roomCode) {
-  return await roomsCollection.findOne({ code: roomCode })
+  const open = await roomsCollection.findOne({ code: roomCode, state: 'open', ...notDeleted })
+  return withLockIns(open ?? await roomsCollection.findOne({ code: roomCode, ...notDeleted }, { sort: { _id: -1 } }))
+}
+
+function isValidId(id) {
+  return ObjectId.isValid(id)
 }
 
+// A malformed id can't name any room, so it's reported as missing rather
+// than thrown as if the database had failed.
 async function getRoomById(roomId) {
-  return await roomsCollection.findOne(new ObjectId(roomId))
+  if (!isValidId(roomId)) {
+    return null
+  }
+  return withLockIns(await roomsCollection.findOne({ _id: new ObjectId(roomId), ...notDeleted }))
+}
+
+async function getDeletedRoom(roomId) {
+  if (!isValidId(roomId)) {
+    return null
+  }
+  return await roomsCollection.findOne({ _id: new ObjectId(roomId), deletedAt: { $exists: true } })
+}
+
+const roomSorts = {
+  created: { _id: -1 },
+  // rooms nobody has voted in yet sort last
+  activity: { lastVoteAt: -1, _id: -1 }
+}
+
+async function listRoomsForUser(username, limit, offset, sort = 'created') {
+  const filter = { $or: [{ owner: username }, { participants: username }], ...notDeleted }
+  const cursor = roomsCollection.aggregate([
+    { $match: filter },
+    { $sort: roomSorts[sort] },
+    { $skip: offset },
+    { $limit: limit },
+    {
+      $project: {
+        code: 1,
+        owner: 1,
+        state: 1,
+        expiresAt: 1,
+        lastVoteAt: 1,
+        closedAt: 1,
+        participantCount: { $size: '$participants' }
+      }
+    }
+  ])
+  const rooms = await cursor.toArray()
+  const total = await roomsCollection.countDocuments(filter)
+  return { rooms, total }
+}
+
+function countEvent(name, help, amount = 1) {
+  getRegistry().counter(name, help).inc({}, amount)
 }
 
-async function addParticipantToRoom(roomCode, username) {
+// The audit log is append only: entries are written alongside the updates
+// they describe and nothing ever changes or removes them.
+async function appendAudit(roomId, action, username, change = {}) {
+  await auditCollection.insertOne({
+    roomId: new ObjectId(roomId),
+    action,
+    username,
+    ...change,
+    at: new Date()
+  })
+}
+
+// Returns whether an update matched its room, recording it in the audit log
+// if so.
+async function auditIfMatched(result, roomId, action, username, change) {
+  const matched = result.acknowledged && result.matchedCount === 1
+  if (matched) {
+    await appendAudit(roomId, action, username, change)
+  }
+  return matched
+}
+
+// Entries newest first, up to limit of them. before is the { at, id } of the
+// last entry of the previous page, and action limits the log to one kind of
+// change.
+async function getAuditLog(roomId, limit, { before, action } = {}) {
+  const filter = { roomId: new ObjectId(roomId) }
+  if (action) {
+    filter.action = action
+  }
+  if (before) {
+    filter.$or = [
+      { at: { $lt: before.at } },
+      { at: before.at, _id: { $lt: new ObjectId(before.id) } }
+    ]
+  }
+  return await auditCollection
+    .find(filter)
+    .sort({ at: -1, _id: -1 })
+    .limit(limit)
+    .toArray()
+}
+
+// Rooms count their changes in `version` so a handler can make its write
+// conditional on the room it read. Rooms from before versioning have no
+// field, which counts as 0. Leaving expectedVersion out skips the check.
+function atVersion(expectedVersion) {
+  if (expectedVersion === undefined) {
+    return {}
+  }
+  return { version: expectedVersion === 0 ? { $in: [0, null] } : expectedVersion }
+}
+
+const bumpVersion = { $inc: { version: 1 } }
+const bumpVersionExpr = { version: { $add: [{ $ifNull: ['$version', 0] }, 1] } }
+
+// Joining only bumps the version; the filter already guards the capacity
+// check, and concurrent joins shouldn't fail each other. Whatever case or
+// spacing the name comes in, the user joins under the name they registered
+// with, so they only ever have one entry and one ballot.
+async function addParticipantToRoom(roomCode, name) {
+  const username = (await getUser(name))?.username ?? normalizeUsername(name)
   const result = await roomsCollection.updateOne(
-    { code: roomCode, state: 'open' },
     {
-      $addToSet: {
-        participants: username
+      code: roomCode,
+      state: 'open',
+      // a maxParticipants of 0 (or unset) means unlimited
+      $or: [
+        { participants: username },
+        { maxParticipants: { $in: [0, null] } },
+        { $expr: { $lt: [{ $size: '$participants' }, '$maxParticipants'] } }
+      ]
+    },
+    [
+      {
+        $set: {
+          participants: {
+            $cond: [
+              { $in: [{ $literal: username }, '$participants'] },
+              '$participants',
+              { $concatArrays: ['$participants', [{ $literal: username }]] }
+            ]
+          },
+          // a spectator who joins stops being one
+          spectators: { $setDifference: [{ $ifNull: ['$spectators', []] }, [{ $literal: username }]] },
+          // start the new participant with every current option scored 0
+          votes: {
+            $cond: [
+              { $in: [{ $literal: username }, '$votes.username'] },
+              '$votes',
+              {
+                $concatArrays: ['$votes', [{
+                  username: { $literal: username },
+                  votes: { $arrayToObject: { $map: { input: '$options', in: { k: '$$this', v: 0 } } } }
+                }]]
+              }
+            ]
+          },
+          ...bumpVersionExpr
+        }
+      }
+    ]
+  )
+  return result.acknowledged && result.matchedCount === 1
+}
+
+function renameKey(objectExpr, oldName, newName) {
+  return {
+    $arrayToObject: {
+      $map: {
+        input: { $objectToArray: { $ifNull: [objectExpr, {}] } },
+        as: 'entry',
+        in: {
+          k: { $cond: [{ $eq: ['$$entry.k', { $literal: oldName }] }, { $literal: newName }, '$$entry.k'] },
+          v: '$$entry.v'
+        }
       }
     }
+  }
+}
+
+// Renames the option everywhere it's used, including every ballot, in a
+// single update so concurrent vote changes aren't lost.
+async function renameOption(roomId, oldName, newName, username, expectedVersion) {
+  const result = await roomsCollection.updateOne(
+    {
+      _id: new ObjectId(roomId),
+      state: editableStates,
+      ...atVersion(expectedVersion),
+      $and: [{ options: oldName }, { options: { $ne: newName } }]
+    },
+    [
+      {
+        $set: {
+          options: {
+            $map: {
+              input: '$options',
+              in: { $cond: [{ $eq: ['$$this', { $literal: oldName }] }, { $literal: newName }, '$$this'] }
+            }
+          },
+          optionAuthors: renameKey('$optionAuthors', oldName, newName),
+          optionDetails: renameKey('$optionDetails', oldName, newName),
+          pinnedOptions: {
+            $map: {
+              input: { $ifNull: ['$pinnedOptions', []] },
+              in: { $cond: [{ $eq: ['$$this', { $literal: oldName }] }, { $literal: newName }, '$$this'] }
+            }
+          },
+          reactions: {
+            $map: {
+              input: { $ifNull: ['$reactions', []] },
+              as: 'reaction',
+              in: {
+                $cond: [
+                  { $eq: ['$$reaction.option', { $literal: oldName }] },
+                  { $mergeObjects: ['$$reaction', { option: { $literal: newName } }] },
+                  '$$reaction'
+                ]
+              }
+            }
+          },
+          votes: {
+            $map: {
+              input: '$votes',
+              as: 'vote',
+              in: {
+                $mergeObjects: ['$$vote', {
+                  votes: renameKey('$$vote.votes', oldName, newName),
+                  comments: renameKey('$$vote.comments', oldName, newName)
+                }]
+              }
+            }
+          },
+          ...bumpVersionExpr
+        }
+      }
+    ]
+  )
+  return await auditIfMatched(result, roomId, 'option-renamed', username, { before: oldName, after: newName })
+}
+
+// Participants already see everything a spectator would, so they're left as
+// they are.
+async function addSpectatorToRoom(roomCode, username) {
+  const result = await roomsCollection.updateOne(
+    { code: roomCode, state: 'open', participants: { $ne: username } },
+    { $addToSet: { spectators: username }, ...bumpVersion }
+  )
+  return result.acknowledged && result.matchedCount === 1
+}
+
+async function removeParticipantFromRoom(roomId, username, expectedVersion) {
+  const result = await roomsCollection.updateOne(
+    { _id: new ObjectId(roomId), state: 'open', participants: username, ...atVersion(expectedVersion) },
+    {
+      $pull: {
+        participants: username,
+        votes: { username },
+        lockedIn: username,
+        lockIns: { username },
+        reactions: { username }
+      },
+      ...bumpVersion
+    }
   )
   return result.acknowledged && result.matchedCount === 1
 }
 
-async function addOptionToRoom(roomId, option) {
+// details holds an optional description and imageUrl, kept alongside the
+// option the same way its author is.
+async function addOptionToRoom(roomId, option, username, details = {}, expectedVersion) {
+  const detailFields = Object.fromEntries(
+    Object.entries(details)
+      .filter(([, value]) => value !== undefined)
+      .map(([key, value]) => [`optionDetails.${option}.${key}`, value])
+  )
   const result = await roomsCollection.updateOne(
-    { _id: new ObjectId(roomId), state: 'open' },
+    {
+      _id: new ObjectId(roomId),
+      state: editableStates,
+      options: { $ne: option },
+      ...atVersion(expectedVersion),
+      // a maxOptions of 0 (or unset) means unlimited
+      $or: [
+        { maxOptions: { $in: [0, null] } },
+        { $expr: { $lt: [{ $size: '$options' }, '$maxOptions'] } }
+      ]
+    },
     {
       $addToSet: {
         options: option
+      },
+      $set: {
+        [`optionAuthors.${option}`]: username,
+        ...detailFields,
+        // everyone starts out scoring a new option 0
+        [`votes.$[].votes.${option}`]: 0
+      },
+      ...bumpVersion
+    },
+    { collation: optionCollation }
+  )
+  const added = await auditIfMatched(result, roomId, 'option-added', username, { after: { option, ...details } })
+  if (added) {
+    countEvent('quikvote_options_added_total', 'Options added to rooms')
+  }
+  return added
+}
+
+// Adds several options in one update. The room's option cap has to fit the
+// whole batch, so either all of them are added or none are.
+async function addOptionsToRoom(roomId, options, username, expectedVersion) {
+  const result = await roomsCollection.updateOne(
+    {
+      _id: new ObjectId(roomId),
+      state: editableStates,
+      options: { $nin: options },
+      ...atVersion(expectedVersion),
+      $or: [
+        { maxOptions: { $in: [0, null] } },
+        { $expr: { $lte: [{ $add: [{ $size: '$options' }, options.length] }, '$maxOptions'] } }
+      ]
+    },
+    {
+      $push: {
+        options: { $each: options }
+      },
+      $set: Object.fromEntries(options.flatMap(option => [
+        [`optionAuthors.${option}`, username],
+        [`votes.$[].votes.${option}`, 0]
+      ])),
+      ...bumpVersion
+    },
+    { collation: optionCollation }
+  )
+  const added = await auditIfMatched(result, roomId, 'options-added', username, { after: options })
+  if (added) {
+    countEvent('quikvote_options_added_total', 'Options added to rooms', options.length)
+  }
+  return added
+}
+
+// Matches rooms where every ballot is still all zeros.
+const noVotesCast = {
+  $expr: {
+    $not: {
+      $anyElementTrue: {
+        $map: {
+          input: '$votes',
+          as: 'vote',
+          in: {
+            $anyElementTrue: {
+              $map: { input: { $objectToArray: '$$vote.votes' }, in: { $ne: ['$$this.v', 0] } }
+            }
+          }
+        }
       }
     }
+  }
+}
+
+// The cap can only change before anyone has scored an option.
+async function setMaxOptions(roomId, maxOptions, expectedVersion) {
+  const result = await roomsCollection.updateOne(
+    { _id: new ObjectId(roomId), state: editableStates, ...atVersion(expectedVersion), ...noVotesCast },
+    {
+      $set: {
+        maxOptions
+      },
+      ...bumpVersion
+    }
+  )
+  return result.acknowledged && result.matchedCount === 1
+}
+
+// Like the option cap, the method can only change before anyone has scored
+// an option, since ballots mean different things under different methods.
+async function setVotingMethod(roomId, votingMethod, expectedVersion) {
+  const result = await roomsCollection.updateOne(
+    { _id: new ObjectId(roomId), state: editableStates, ...atVersion(expectedVersion), ...noVotesCast },
+    {
+      $set: {
+        votingMethod
+      },
+      ...bumpVersion
+    }
+  )
+  return result.acknowledged && result.matchedCount === 1
+}
+
+// Applies several settings at once. Settings that are frozen once voting
+// starts only change if nobody has scored an option yet.
+async function updateRoomSettings(roomId, changes, changesFrozen, expectedVersion) {
+  const result = await roomsCollection.updateOne(
+    {
+      _id: new ObjectId(roomId),
+      state: editableStates,
+      ...atVersion(expectedVersion),
+      ...(changesFrozen && noVotesCast)
+    },
+    {
+      $set: changes,
+      ...bumpVersion
+    }
+  )
+  return result.acknowledged && result.matchedCount === 1
+}
+
+async function pinOption(roomId, option, expectedVersion) {
+  const result = await roomsCollection.updateOne(
+    { _id: new ObjectId(roomId), state: editableStates, options: option, ...atVersion(expectedVersion) },
+    { $addToSet: { pinnedOptions: option }, ...bumpVersion }
+  )
+  return result.acknowledged && result.matchedCount === 1
+}
+
+async function unpinOption(roomId, option, expectedVersion) {
+  const result = await roomsCollection.updateOne(
+    { _id: new ObjectId(roomId), state: editableStates, ...atVersion(expectedVersion) },
+    { $pull: { pinnedOptions: option }, ...bumpVersion }
+  )
+  return result.acknowledged && result.matchedCount === 1
+}
+
+// Each user holds at most one reaction per option, so reacting again
+// replaces their earlier one.
+async function setReaction(roomId, username, option, emoji) {
+  const result = await roomsCollection.updateOne(
+    { _id: new ObjectId(roomId), state: 'open', options: option, participants: username },
+    [
+      {
+        $set: {
+          reactions: {
+            $concatArrays: [
+              {
+                $filter: {
+                  input: { $ifNull: ['$reactions', []] },
+                  cond: {
+                    $not: {
+                      $and: [
+                        { $eq: ['$$this.username', { $literal: username }] },
+                        { $eq: ['$$this.option', { $literal: option }] }
+                      ]
+                    }
+                  }
+                }
+              },
+              [{ username: { $literal: username }, option: { $literal: option }, emoji: { $literal: emoji } }]
+            ]
+          },
+          ...bumpVersionExpr
+        }
+      }
+    ]
   )
   return result.acknowledged && result.matchedCount === 1
 }
 
-async function submitUserVotes(roomId, username, votes) {
+async function removeOptionFromRoom(roomId, option, username, expectedVersion) {
   const result = await roomsCollection.updateOne(
-    { _id: new ObjectId(roomId), "votes.username": { $ne: username } },
+    { _id: new ObjectId(roomId), state: editableStates, options: option, ...atVersion(expectedVersion) },
+    {
+      $pull: {
+        options: option,
+        pinnedOptions: option,
+        reactions: { option }
+      },
+      $unset: {
+        [`optionAuthors.${option}`]: '',
+        [`optionDetails.${option}`]: '',
+        [`votes.$[].votes.${option}`]: '',
+        [`votes.$[].comments.${option}`]: ''
+      },
+      ...bumpVersion
+    }
+  )
+  return await auditIfMatched(result, roomId, 'option-removed', username, { before: option })
+}
+
+// comments, if given, replaces the notes the user left on options; left out,
+// the notes they already have stay.
+async function updateUserVotes(roomId, username, votes, expectedVersion, comments) {
+  // locked in ballots are final, so only touch users who haven't locked in
+  const filter = {
+    _id: new ObjectId(roomId),
+    state: 'open',
+    lockedIn: { $ne: username },
+    ...atVersion(expectedVersion)
+  }
+  const now = new Date()
+
+  // fetch the ballot as it was so the audit log can show the change
+  const updated = await roomsCollection.findOneAndUpdate(
+    { ...filter, 'votes.username': username },
+    {
+      $set: {
+        'votes.$.votes': votes,
+        ...(comments !== undefined && { 'votes.$.comments': comments }),
+        'votes.$.updatedAt': now,
+        lastVoteAt: now
+      },
+      ...bumpVersion
+    },
+    { projection: { votes: { $elemMatch: { username } } }, returnDocument: 'before' }
+  )
+  if (updated.value) {
+    await appendAudit(roomId, 'vote', username, { before: updated.value.votes?.[0]?.votes, after: votes })
+    countEvent('quikvote_votes_submitted_total', 'Ballots saved')
+    return true
+  }
+
+  const inserted = await roomsCollection.updateOne(
+    { ...filter, 'votes.username': { $ne: username } },
     {
       $push: {
         votes: {
           username,
-          votes
+          votes,
+          comments: comments ?? {},
+          updatedAt: now
+        }
+      },
+      $set: {
+        lastVoteAt: now
+      },
+      ...bumpVersion
+    }
+  )
+  const saved = await auditIfMatched(inserted, roomId, 'vote', username, { before: null, after: votes })
+  if (saved) {
+    countEvent('quikvote_votes_submitted_total', 'Ballots saved')
+  }
+  return saved
+}
+
+// Only a ballot the user has saved can be locked in; the zeros everyone
+// starts with on joining don't count, having no updatedAt.
+async function lockInUser(roomId, username) {
+  const result = await roomsCollection.updateOne(
+    {
+      _id: new ObjectId(roomId),
+      state: 'open',
+      votes: { $elemMatch: { username, updatedAt: { $exists: true } } },
+      lockedIn: { $ne: username }
+    },
+    {
+      $push: {
+        lockedIn: username,
+        lockIns: { username, at: new Date() }
+      },
+      ...bumpVersion
+    }
+  )
+  return await auditIfMatched(result, roomId, 'lock-in', username)
+}
+
+// actor is whoever did the unlocking: the user themselves, or the owner
+// letting them fix a mistake.
+async function unlockUser(roomId, username, expectedVersion, actor = username) {
+  const result = await roomsCollection.updateOne(
+    { _id: new ObjectId(roomId), state: 'open', lockedIn: username, ...atVersion(expectedVersion) },
+    {
+      $pull: {
+        lockedIn: username,
+        lockIns: { username }
+      },
+      ...bumpVersion
+    }
+  )
+  const change = actor === username ? {} : { target: username }
+  return await auditIfMatched(result, roomId, 'unlock', actor, change)
+}
+
+// Puts every ballot back to zeros and unlocks everyone, keeping the options
+// and who's in the room. Ballots lose their updatedAt, so they count as
+// unsaved again: nobody can lock in or be counted until they vote afresh.
+// Notes on options are kept, since they're about the options rather than
+// the scores.
+async function resetVotes(roomId, username, expectedVersion) {
+  const result = await roomsCollection.updateOne(
+    { _id: new ObjectId(roomId), state: 'open', ...atVersion(expectedVersion) },
+    [
+      {
+        $set: {
+          votes: {
+            $map: {
+              input: '$votes',
+              as: 'vote',
+              in: {
+                $mergeObjects: [
+                  {
+                    $arrayToObject: {
+                      $filter: { input: { $objectToArray: '$$vote' }, cond: { $ne: ['$$this.k', 'updatedAt'] } }
+                    }
+                  },
+                  { votes: { $arrayToObject: { $map: { input: '$options', in: { k: '$$this', v: 0 } } } } }
+                ]
+              }
+            }
+          },
+          lockedIn: [],
+          lockIns: [],
+          ...bumpVersionExpr
         }
       }
+    ]
+  )
+  return await auditIfMatched(result, roomId, 'reset', username)
+}
+
+async function closeRoom(roomId, closedAt = new Date(), expectedVersion) {
+  const result = await roomsCollection.updateOne(
+    { _id: new ObjectId(roomId), state: 'open', ...atVersion(expectedVersion) },
+    {
+      $set: {
+        state: 'closed',
+        closedAt
+      },
+      ...bumpVersion
     }
   )
-  return result.acknowledged && result.matchedCount === 1
+  const closed = result.acknowledged && result.matchedCount === 1
+  if (closed) {
+    countEvent('quikvote_rooms_closed_total', 'Rooms closed')
+  }
+  return closed
 }
 
-async function closeRoom(roomId) {
+async function setRoomOwner(roomId, currentOwner, newOwner, expectedVersion) {
   const result = await roomsCollection.updateOne(
-    { _id: new ObjectId(roomId) },
+    {
+      _id: new ObjectId(roomId),
+      state: 'open',
+      owner: currentOwner,
+      participants: newOwner,
+      ...atVersion(expectedVersion)
+    },
     {
       $set: {
-        state: 'closed'
+        owner: newOwner
+      },
+      ...bumpVersion
+    }
+  )
+  return result.acknowledged && result.matchedCount === 1
+}
+
+async function getRoomsDueToClose(now) {
+  const rooms = await roomsCollection.find({ state: 'open', closeAt: { $lte: now }, ...notDeleted }).toArray()
+  return rooms.map(withLockIns)
+}
+
+// A random code no room holds, in any state, other than except. The unique
+// index only covers open rooms, so it won't stop a code being handed out
+// that a closed room or a draft still answers to. Another room can still
+// take it before it's saved; that's left to the index to catch.
+async function unusedRoomCode(except) {
+  for (let attempt = 0; attempt < maxCodeAttempts; attempt++) {
+    const code = generateRoomCode()
+    if (code !== except && !await roomsCollection.findOne({ code, ...notDeleted }, { projection: { _id: 1 } })) {
+      return code
+    }
+  }
+  throw new Error('Unable to generate a unique room code')
+}
+
+// Opens a draft room to participants. Codes are only kept unique among open
+// rooms, so if another room took this one's code while it was a draft, it's
+// given a new one. Returns the published room, or null if the room wasn't a
+// draft at the expected version.
+async function publishRoom(roomId, expectedVersion) {
+  const filter = { _id: new ObjectId(roomId), state: 'draft', ...atVersion(expectedVersion) }
+  let changes = { state: 'open' }
+  for (let attempt = 0; attempt < maxCodeAttempts; attempt++) {
+    try {
+      const result = await roomsCollection.findOneAndUpdate(
+        filter,
+        { $set: changes, ...bumpVersion },
+        { returnDocument: 'after' }
+      )
+      return result.value
+    } catch (ex) {
+      if (ex.code !== duplicateKeyErrorCode) {
+        throw ex
+      }
+      changes = { state: 'open', code: await unusedRoomCode() }
+    }
+  }
+  throw new Error('Unable to generate a unique room code')
+}
+
+// Gives a room a fresh code, for when the old one got out. Returns the room
+// as updated, or null if it changed or closed first.
+async function regenerateRoomCode(roomId, expectedVersion) {
+  const room = await roomsCollection.findOne({ _id: new ObjectId(roomId) }, { projection: { code: 1 } })
+  for (let attempt = 0; attempt < maxCodeAttempts; attempt++) {
+    const code = await unusedRoomCode(room?.code)
+    try {
+      const result = await roomsCollection.findOneAndUpdate(
+        { _id: new ObjectId(roomId), state: editableStates, ...atVersion(expectedVersion) },
+        { $set: { code }, ...bumpVersion },
+        { returnDocument: 'after' }
+      )
+      return result.value
+    } catch (ex) {
+      if (ex.code !== duplicateKeyErrorCode) {
+        throw ex
       }
     }
+  }
+  throw new Error('Unable to generate a unique room code')
+}
+
+async function extendRoom(roomId, expiresAt, expectedVersion) {
+  const result = await roomsCollection.updateOne(
+    { _id: new ObjectId(roomId), state: editableStates, ...atVersion(expectedVersion) },
+    {
+      $set: {
+        expiresAt
+      },
+      ...bumpVersion
+    }
   )
   return result.acknowledged && result.matchedCount === 1
 }
@@ -139,10 +1085,51 @@ async function deleteRoom(roomId) {
   return result.acknowledged && result.deletedCount == 1
 }
 
-async function createResult(username, sortedOptions) {
+// Hides a room until it's restored. Its expiry is brought forward to the end
+// of the restore window, if that's sooner, so the TTL index removes it for
+// good once it can't be restored; the old expiry is kept for a restore.
+async function softDeleteRoom(roomId) {
+  const deletedAt = new Date()
+  const restorableUntil = new Date(deletedAt.getTime() + roomRestoreWindowMs)
+  const result = await roomsCollection.updateOne(
+    { _id: new ObjectId(roomId), ...notDeleted },
+    [
+      {
+        $set: {
+          deletedAt,
+          expiresBeforeDelete: '$expiresAt',
+          expiresAt: { $min: ['$expiresAt', restorableUntil] },
+          ...bumpVersionExpr
+        }
+      }
+    ]
+  )
+  return result.acknowledged && result.matchedCount === 1
+}
+
+async function restoreRoom(roomId) {
+  const result = await roomsCollection.updateOne(
+    {
+      _id: new ObjectId(roomId),
+      deletedAt: { $gt: new Date(Date.now() - roomRestoreWindowMs) }
+    },
+    [
+      { $set: { expiresAt: '$expiresBeforeDelete', ...bumpVersionExpr } },
+      { $unset: ['deletedAt', 'expiresBeforeDelete'] }
+    ]
+  )
+  return result.acknowledged && result.matchedCount === 1
+}
+
+async function createResult(room, sortedOptions, totals, details = {}) {
   const result = {
-    owner: username,
+    owner: room.owner,
+    roomId: room._id,
+    participants: room.participants,
+    spectators: room.spectators ?? [],
     sortedOptions,
+    totals: sortedOptions.map(option => ({ option, total: totals.get(option) ?? 0 })),
+    ...details,
     timestamp: Date.now()
   }
 
@@ -153,10 +1140,44 @@ async function createResult(username, sortedOptions) {
   }
 }
 
+// Chat messages live in their own collection so a long discussion doesn't
+// bloat the room document that every client fetches.
+async function addMessage(roomId, username, text) {
+  const message = {
+    roomId: new ObjectId(roomId),
+    username,
+    text,
+    at: new Date()
+  }
+  const result = await messagesCollection.insertOne(message)
+  return { ...message, _id: result.insertedId }
+}
+
+// The most recent messages, oldest first.
+async function getMessages(roomId, limit) {
+  const messages = await messagesCollection
+    .find({ roomId: new ObjectId(roomId) })
+    .sort({ at: -1 })
+    .limit(limit)
+    .toArray()
+  return messages.reverse()
+}
+
 async function getResult(resultId) {
+  if (!isValidId(resultId)) {
+    return null
+  }
   return await historyCollection.findOne(new ObjectId(resultId))
 }
 
+async function revealResult(resultId) {
+  const result = await historyCollection.updateOne(
+    { _id: new ObjectId(resultId) },
+    { $set: { visible: true } }
+  )
+  return result.acknowledged && result.matchedCount === 1
+}
+
 async function getHistory(username) {
   const cursor = historyCollection.find(
     { owner: username },
@@ -167,19 +1188,58 @@ async function getHistory(username) {
   return await cursor.toArray()
 }
 
-module.exports = {
+async function close() {
+  await client.close()
+}
+
+module.exports = withTimeouts({
+  connect,
+  ping,
+  close,
   getUser,
   getUserByToken,
   createUser,
   createRoom,
+  cloneRoom,
   getRoomByCode,
   getRoomById,
+  isValidId,
+  roomSorts,
+  listRoomsForUser,
   addParticipantToRoom,
+  addSpectatorToRoom,
+  removeParticipantFromRoom,
   addOptionToRoom,
-  submitUserVotes,
+  addOptionsToRoom,
+  setMaxOptions,
+  setVotingMethod,
+  updateRoomSettings,
+  removeOptionFromRoom,
+  setReaction,
+  pinOption,
+  unpinOption,
+  renameOption,
+  updateUserVotes,
+  lockInUser,
+  unlockUser,
+  resetVotes,
   closeRoom,
+  publishRoom,
+  regenerateRoomCode,
+  getRoomsDueToClose,
+  setRoomOwner,
+  extendRoom,
   deleteRoom,
+  softDeleteRoom,
+  getDeletedRoom,
+  restoreRoom,
+  roomRestoreWindowMs,
   createResult,
+  addMessage,
+  getAuditLog,
+  getMessages,
   getResult,
-  getHistory
-};
+  revealResult,
+  getHistory,
+  DatabaseTimeoutError
+});
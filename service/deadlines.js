@@ -0,0 +1,39 @@
+const DB = require('./database.js');
+const { closeRoomWithResult, lockInsNeeded } = require('./closeRoom.js')
+
+// Closes open rooms whose closeAt has passed, checking every intervalMs. The
+// rooms come from the database each time, so deadlines set before a restart
+// are still honoured after it. A close that loses a race with another change
+// is simply retried on the next sweep. Rooms still waiting on their
+// minimum number of lock ins stay open until they have them.
+function startDeadlineSweep(intervalMs) {
+  let sweeping = false
+  async function sweep() {
+    if (sweeping) {
+      return
+    }
+    sweeping = true
+    try {
+      const due = await DB.getRoomsDueToClose(new Date())
+      for (const room of due) {
+        if (lockInsNeeded(room) === 0) {
+          await closeRoomWithResult(room)
+        }
+      }
+    } catch (ex) {
+      console.error(`deadline sweep failed: ${ex.message}`)
+    } finally {
+      sweeping = false
+    }
+  }
+
+  sweep()
+  const timer = setInterval(sweep, intervalMs)
+  return {
+    stop() {
+      clearInterval(timer)
+    }
+  }
+}
+
+module.exports = { startDeadlineSweep };
@@ -0,0 +1,47 @@
+const DB = require('./database.js');
+const { sendError } = require('./errors.js')
+
+// The last stop for anything a handler throws, or rejects with: body parsing
+// failures, database timeouts and plain bugs all get a JSON error like any
+// other, instead of express's HTML page or a dropped connection.
+function errorHandler({ maxBodySize }) {
+  return (err, req, res, next) => {
+    if (err.type === 'entity.too.large') {
+      sendError(res, 413, 'BODY_TOO_LARGE', `Request body must be smaller than ${maxBodySize}`)
+      return
+    }
+    if (err.type === 'entity.parse.failed') {
+      sendError(res, 400, 'INVALID_JSON', 'Request body is not valid JSON')
+      return
+    }
+
+    if (err instanceof DB.DatabaseTimeoutError && !res.headersSent) {
+      console.error(JSON.stringify({
+        time: new Date().toISOString(),
+        level: 'error',
+        msg: 'database timeout',
+        requestId: req.id,
+        operation: err.operation
+      }))
+      sendError(res, 504, 'DATABASE_TIMEOUT', 'The database took too long to respond')
+      return
+    }
+
+    console.error(JSON.stringify({
+      time: new Date().toISOString(),
+      level: 'error',
+      msg: 'unhandled error',
+      requestId: req.id,
+      error: err.message,
+      stack: err.stack
+    }))
+    // once a response has started, all we can do is let express drop the connection
+    if (res.headersSent) {
+      next(err)
+      return
+    }
+    sendError(res, 500, 'INTERNAL_ERROR', 'Internal server error')
+  }
+}
+
+module.exports = { errorHandler };
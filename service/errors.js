@@ -0,0 +1,8 @@
+// Every endpoint reports errors in the same shape so clients can branch on a
+// stable code rather than parsing the message:
+//   { error: { code: 'ROOM_NOT_FOUND', message: 'Room 123 does not exist' } }
+function sendError(res, status, code, message) {
+  res.status(status).send({ error: { code, message } })
+}
+
+module.exports = { sendError };
@@ -1,52 +1,199 @@
+const fs = require('fs');
+const crypto = require('crypto');
+const path = require('path');
 const express = require('express');
 const bcrypt = require('bcrypt')
 const cookieParser = require('cookie-parser')
+const QRCode = require('qrcode')
 const DB = require('./database.js');
 const { peerProxy } = require('./peerProxy.js');
-const { calculateVoteResult } = require('./calculateVoteResult.js')
+const { sendError } = require('./errors.js')
+const { errorHandler } = require('./errorHandler.js')
+const { jsonBody, jsonOrFormBody } = require('./requestBody.js')
+const { rateLimit } = require('./rateLimit.js')
+const { requestLog } = require('./requestLog.js')
+const { asyncRouter } = require('./asyncRouter.js')
+const { cors } = require('./cors.js')
+const { configureRoomCodes, isValidRoomCode, normalizeRoomCode, roomCodeLimits } = require('./roomCode.js')
+const { compression } = require('./compression.js')
+const { getRegistry, requestMetrics } = require('./metrics.js')
+const { toCsv } = require('./csv.js')
+const { provisionalTally, votingMethods } = require('./calculateVoteResult.js')
+const { closeRoomWithResult, maybeAutoClose, lockInsNeeded, tallyRoom } = require('./closeRoom.js')
+const {
+  subscribe,
+  unsubscribe,
+  unsubscribeUser,
+  onlineUsers,
+  broadcastToRoom,
+  broadcastLockIn,
+  broadcastUnlock,
+  broadcastReset,
+  broadcastParticipant,
+  scheduleTally,
+  endRoom,
+  closeAll
+} = require('./roomHub.js')
+const { toRoomResponse, countReactions } = require('./roomResponse.js')
+const { toResultResponse } = require('./resultResponse.js')
+const { compareResults } = require('./compareResults.js')
+const {
+  normalizeOptionName,
+  sameOption,
+  validateOptionName,
+  validateNewOption,
+  validateOptionDetails
+} = require('./validateOption.js')
+const { validateVotes, cleanComments, unscoredOptions, hasVotesCast } = require('./validateVotes.js')
+const {
+  settingNames,
+  frozenChanges,
+  roomSettings,
+  validateSettings,
+  parseSettings,
+  quorumReached
+} = require('./roomSettings.js')
+const { randomSeed } = require('./tieBreak.js')
+const { startDeadlineSweep } = require('./deadlines.js')
+const { loadConfig } = require('./config.js')
+const { identiconSvg, fetchAvatar, AvatarTimeoutError } = require('./avatar.js')
+const { configureWebhooks } = require('./webhooks.js')
+const { openApiDocument } = require('./openapi.js')
+
+const config = loadConfig()
+const {
+  port,
+  publicDir,
+  reloadPages,
+  compressionThreshold,
+  publicBaseUrl,
+  corsOrigins,
+  corsCredentials
+} = config
+
+configureRoomCodes(config.roomCode)
+configureWebhooks(config.webhooks)
+DB.connect(config.database)
+  .then(() => console.log('db connected'))
+  .catch(ex => {
+    console.error(`Unable to connect to or set up the database because ${ex.message}`);
+    process.exit(1)
+  })
 
 const app = express();
 
 const authCookieName = 'token';
 
-const port = process.argv.length > 2 ? process.argv[2] : 4000;
+const minQrSize = 128
+const maxQrSize = 1024
+const defaultQrSize = 256
+
+const avatarMaxAgeSeconds = 300
+
+const mutationRateLimit = { capacity: 30, refillPerSecond: 1 }
+// a few new codes in a row, then one every ten minutes
+const codeRateLimit = { capacity: 3, refillPerSecond: 1 / 600 }
+
+const defaultRoomsLimit = 20
+const maxRoomsLimit = 100
+
+// long enough for a multi-codepoint emoji like a flag or a family
+const maxEmojiLength = 16
+const emojiPattern = /^[\p{Extended_Pictographic}\p{Regional_Indicator}][\p{Extended_Pictographic}\p{Emoji_Component}\u200d\ufe0f]*$/u
+
+const maxIdempotencyKeyLength = 255
+
+// bcrypt ignores anything past 72 bytes
+const maxRoomPasswordLength = 72
+
+const maxBatchOptions = 50
+
+const maxComparedResults = 20
+
+const maxSimulatedOptions = 50
+const maxSimulatedBallots = 1000
+
+const maxMessageLength = 500
+const messageHistoryLimit = 100
+
+const streamKeepAliveMs = 15000
+
+const defaultAuditLogLimit = 100
+const maxAuditLogLimit = 1000
+const optionActions = ['option-added', 'options-added', 'option-removed', 'option-renamed']
+
+const defaultExtendHours = 24
+const maxExtendHours = 7 * 24
+
+const maxBodySize = '16kb'
 
-app.use(express.json());
+// liveness and readiness probes for the load balancer
+app.get('/healthz', (_req, res) => {
+  res.status(200).send({ status: 'ok' })
+})
+
+app.get('/readyz', async (_req, res) => {
+  try {
+    const dbLatencyMs = await DB.ping()
+    res.status(200).send({ status: 'ready', dbLatencyMs })
+  } catch (ex) {
+    sendError(res, 503, 'DATABASE_UNAVAILABLE', ex.message)
+  }
+})
+
+app.get('/metrics', (_req, res) => {
+  res.status(200).type('text/plain; version=0.0.4').send(getRegistry().render())
+})
+
+// registered after the probes so health checks don't flood the log or metrics
+app.use(requestMetrics());
+app.use(requestLog());
+app.use(compression({ threshold: compressionThreshold }));
+app.use(express.json({ limit: maxBodySize }));
 app.use(cookieParser());
-app.use(express.static('public'));
+app.use(express.static(publicDir));
+
+if (corsOrigins.length > 0) {
+  app.use('/api', cors({ origins: corsOrigins, credentials: corsCredentials }))
+}
 
-const apiRouter = express.Router();
+const apiRouter = asyncRouter();
 app.use('/api', apiRouter);
 
-apiRouter.post('/register', async (req, res) => {
+apiRouter.post('/register', jsonBody('username', 'password'), async (req, res) => {
   if (!req.body.username) {
-    res.status(400).send({ msg: 'Missing username' })
+    sendError(res, 400, 'MISSING_FIELD', 'Missing username')
     return
   }
   if (!req.body.password) {
-    res.status(400).send({ msg: 'Missing password' })
+    sendError(res, 400, 'MISSING_FIELD', 'Missing password')
     return
   }
 
   let user = await DB.getUser(req.body.username)
   if (user) {
-    res.status(409).send({ msg: 'Existing user' });
+    sendError(res, 409, 'USER_EXISTS', 'Existing user')
     return
   }
 
   user = await DB.createUser(req.body.username, req.body.password)
+  if (!user) {
+    // someone took the name between the check and now
+    sendError(res, 409, 'USER_EXISTS', 'Existing user')
+    return
+  }
   setAuthCookie(res, user.token);
 
   res.status(201).send({ username: user.username });
 });
 
-apiRouter.post('/login', async (req, res) => {
+apiRouter.post('/login', jsonBody('username', 'password'), async (req, res) => {
   if (!req.body.username) {
-    res.status(400).send({ msg: 'Missing username' })
+    sendError(res, 400, 'MISSING_FIELD', 'Missing username')
     return
   }
   if (!req.body.password) {
-    res.status(400).send({ msg: 'Missing password' })
+    sendError(res, 400, 'MISSING_FIELD', 'Missing password')
     return
   }
 
@@ -56,7 +203,7 @@ apiRouter.post('/login', async (req, res) => {
     setAuthCookie(res, user.token);
     res.status(200).send({ username: user.username });
   } else {
-    res.status(400).send({ msg: 'Invalid username and/or password' })
+    sendError(res, 400, 'INVALID_CREDENTIALS', 'Invalid username and/or password')
   }
 });
 
@@ -71,6 +218,114 @@ async function getUserFromRequest(req) {
   return user
 }
 
+// Finds a participant by a client-supplied name, ignoring case and padding.
+function findParticipant(room, username) {
+  const wanted = String(username).trim().toLowerCase()
+  return room.participants.find(p => p.toLowerCase() === wanted)
+}
+
+// Expired rooms linger until mongo's TTL monitor gets to them, so treat them
+// as gone in the meantime.
+function isExpired(room) {
+  return room.expiresAt !== undefined && room.expiresAt <= new Date()
+}
+
+function baseUrl(req) {
+  return publicBaseUrl ?? `${req.protocol}://${req.get('host')}`
+}
+
+// The link that takes someone to the join page with the room's code filled in.
+function joinUrlFor(req, room) {
+  return `${baseUrl(req)}/join?code=${encodeURIComponent(room.code)}`
+}
+
+function sendCreatedRoom(req, res, room) {
+  res.status(201)
+    .location(`/api/room/${room.id}`)
+    .send({ id: room.id, code: room.code, joinUrl: joinUrlFor(req, room), avatarStyle: room.avatarStyle ?? 'icon' })
+}
+
+// Participants and spectators can both follow a room; only participants vote.
+function canWatch(room, username) {
+  return room.participants.includes(username) || (room.spectators ?? []).includes(username)
+}
+
+// Draft rooms take options and settings from their owner, but nothing else
+// until they're published.
+function isEditable(room) {
+  return room.state === 'open' || room.state === 'draft'
+}
+
+// Draft rooms aren't closed, just not published yet, so say which it is.
+function sendRoomNotOpen(res, room) {
+  if (room.state === 'draft') {
+    sendError(res, 409, 'ROOM_DRAFT', 'Room has not been published yet')
+    return
+  }
+  sendError(res, 409, 'ROOM_CLOSED', 'Room is not open')
+}
+
+// Sent when a conditional write finds the room changed since it was read.
+function sendRoomModified(res) {
+  sendError(res, 409, 'ROOM_MODIFIED', 'Room was changed by someone else, refetch and try again')
+}
+
+// settings the front end needs before anyone has logged in
+apiRouter.get('/config', (_req, res) => {
+  res.status(200).send({ roomCode: roomCodeLimits() })
+})
+
+// A machine-readable description of the API. It's built from the routes on
+// first request, once they've all been registered, and kept after that.
+let openApi = null
+apiRouter.get('/openapi.json', (_req, res) => {
+  openApi ??= openApiDocument(apiRouter, secureApiRouter)
+  res.status(200).send(openApi)
+})
+
+// A room's icon, by its code. Rooms whose owner chose an identicon get one
+// drawn here; everything else comes from the avatar service, proxied and
+// cached unless proxying is turned off. The SVG can't run scripts, wherever
+// it came from.
+apiRouter.get('/avatar/:seed?', async (req, res) => {
+  const seed = (req.params.seed ?? '').trim().toUpperCase()
+  if (!/^[A-Z0-9]{0,32}$/.test(seed)) {
+    sendError(res, 400, 'INVALID_SEED', 'Avatar seeds are up to 32 letters and digits')
+    return
+  }
+
+  const room = isValidRoomCode(seed) ? await DB.getRoomByCode(seed) : null
+  let svg = null
+  if (room?.avatarStyle !== 'identicon') {
+    if (!config.avatar.proxy) {
+      const url = new URL(config.avatar.serviceUrl)
+      url.searchParams.set('seed', seed)
+      res.set('Cache-Control', `public, max-age=${avatarMaxAgeSeconds}`)
+      res.redirect(302, url.toString())
+      return
+    }
+    try {
+      svg = await fetchAvatar(config.avatar.serviceUrl, seed, config.avatar.timeoutMs)
+    } catch (err) {
+      if (!(err instanceof AvatarTimeoutError)) {
+        throw err
+      }
+      sendError(res, 504, 'AVATAR_TIMEOUT', 'The avatar service took too long to answer')
+      return
+    }
+  }
+
+  res.set({
+    // short lived, since a code can name a different room later
+    'Cache-Control': `public, max-age=${avatarMaxAgeSeconds}`,
+    'Content-Type': 'image/svg+xml',
+    'Content-Security-Policy': "default-src 'none'; style-src 'unsafe-inline'",
+    'X-Content-Type-Options': 'nosniff'
+  })
+  // an identicon stands in if the service is down
+  res.status(200).send(svg ?? identiconSvg(seed))
+})
+
 apiRouter.get('/me', async (req, res) => {
   const user = await getUserFromRequest(req)
   if (user) {
@@ -80,205 +335,1870 @@ apiRouter.get('/me', async (req, res) => {
   }
 })
 
-const secureApiRouter = express.Router();
+const secureApiRouter = asyncRouter();
 apiRouter.use(secureApiRouter);
 
+// Loads the caller once for every route below; handlers read it from req.user.
 secureApiRouter.use(async (req, res, next) => {
   const user = await getUserFromRequest(req)
   if (user) {
+    req.user = user
     next();
   } else {
-    res.status(401).send({ msg: 'Unauthorized' });
+    sendError(res, 401, 'UNAUTHORIZED', 'Unauthorized')
   }
 });
 
-secureApiRouter.post('/room', async (req, res) => {
-  const user = await getUserFromRequest(req)
+// the auth token identifies the user, so it's a cheap per-user key
+const mutationLimiter = rateLimit({
+  ...mutationRateLimit,
+  keyFor: req => req.cookies[authCookieName]
+})
+secureApiRouter.use((req, res, next) => {
+  if (req.method === 'GET') {
+    next()
+    return
+  }
+  mutationLimiter(req, res, next)
+});
+
+// room and result ids are mongo ids; reject garbage before it reaches the database
+secureApiRouter.param('id', (req, res, next, id) => {
+  if (!DB.isValidId(id)) {
+    sendError(res, 400, 'INVALID_ID', `${id} is not a valid id`)
+    return
+  }
+  next()
+})
+
+// room codes are typed in by hand, so forgive case and stray spaces, but turn
+// away anything that couldn't be a code before it reaches the database
+secureApiRouter.param('code', (req, res, next, code) => {
+  const normalized = normalizeRoomCode(code)
+  if (!normalized) {
+    sendError(res, 400, 'INVALID_CODE', `${code} is not a valid room code`)
+    return
+  }
+  req.params.code = normalized
+  next()
+})
+
+secureApiRouter.post('/room', jsonBody(...settingNames, 'password', 'code', 'draft'), async (req, res) => {
+  const settings = Object.fromEntries(
+    settingNames
+      .filter(name => req.body[name] !== undefined)
+      .map(name => [name, req.body[name]])
+  )
+  const settingsError = validateSettings(settings)
+  if (settingsError) {
+    sendError(res, 400, 'INVALID_FIELD', settingsError)
+    return
+  }
+
+  // draft rooms can't be joined until the owner publishes them
+  const draft = req.body.draft ?? false
+  if (typeof draft !== 'boolean') {
+    sendError(res, 400, 'INVALID_FIELD', 'draft must be a boolean')
+    return
+  }
+
+  // lets a client retry, or a page reload, without creating a second room
+  const idempotencyKey = req.get('Idempotency-Key')
+  if (idempotencyKey !== undefined && (idempotencyKey === '' || idempotencyKey.length > maxIdempotencyKeyLength)) {
+    sendError(res, 400, 'INVALID_FIELD', `Idempotency-Key must be 1-${maxIdempotencyKeyLength} characters`)
+    return
+  }
 
-  const newRoom = await DB.createRoom(user.username)
+  const password = req.body.password
+  if (password !== undefined &&
+    (typeof password !== 'string' || password === '' || Buffer.byteLength(password) > maxRoomPasswordLength)) {
+    sendError(res, 400, 'INVALID_FIELD', `password must be 1-${maxRoomPasswordLength} bytes`)
+    return
+  }
+
+  let code
+  if (req.body.code !== undefined) {
+    code = String(req.body.code).toUpperCase()
+    if (!isValidRoomCode(code)) {
+      const { minLength, maxLength } = roomCodeLimits()
+      sendError(res, 400, 'INVALID_FIELD', `Room code must be ${minLength}-${maxLength} letters or numbers`)
+      return
+    }
+  }
+
+  const user = req.user
+
+  const newRoom = await DB.createRoom(user.username, {
+    ...parseSettings(settings),
+    draft,
+    code,
+    password,
+    idempotencyKey
+  })
+
+  if (!newRoom) {
+    sendError(res, 409, 'ROOM_CODE_TAKEN', `Room code ${code} is already in use`)
+    return
+  }
 
-  res.status(201).send({ id: newRoom.id, code: newRoom.code })
+  sendCreatedRoom(req, res, newRoom)
 })
 
-secureApiRouter.get('/room/:id', async (req, res) => {
-  const user = await getUserFromRequest(req)
+// Hides the room from everyone, its owner included, until it's restored.
+// Results already published are kept.
+secureApiRouter.delete('/room/:id', jsonBody(), async (req, res) => {
+  const user = req.user
   const roomId = req.params.id
   const room = await DB.getRoomById(roomId)
 
   if (!room) {
-    res.status(404).send({ msg: `Room ${roomId} does not exist` })
+    sendError(res, 404, 'ROOM_NOT_FOUND', `Room ${roomId} does not exist`)
     return
   }
 
-  if (!room.state === 'open') {
-    res.status(409).send({ msg: 'Room is not open' })
+  if (room.owner !== user.username) {
+    sendError(res, 403, 'NOT_OWNER', 'User is not owner of room')
     return
   }
 
-  res.status(200).send({ ...room, isOwner: room.owner === user.username })
+  if (await DB.softDeleteRoom(roomId)) {
+    endRoom(roomId)
+    res.status(204).end()
+    return
+  }
+  sendError(res, 404, 'ROOM_NOT_FOUND', `Room ${roomId} does not exist`)
 })
 
-secureApiRouter.post('/room/:code/join', async (req, res) => {
-  const user = await getUserFromRequest(req)
-  const roomCode = req.params.code
-  const room = await DB.getRoomByCode(roomCode)
+secureApiRouter.post('/room/:id/restore', jsonBody(), async (req, res) => {
+  const user = req.user
+  const roomId = req.params.id
+  const room = await DB.getDeletedRoom(roomId)
 
   if (!room) {
-    res.status(404).send({ msg: `Room ${roomCode} does not exist` })
+    sendError(res, 404, 'ROOM_NOT_FOUND', `No deleted room ${roomId}`)
     return
   }
 
-  if (!room.state === 'open') {
-    res.status(409).send({ msg: 'Room is not open' })
+  if (room.owner !== user.username) {
+    sendError(res, 403, 'NOT_OWNER', 'User is not owner of room')
     return
   }
 
-  const success = await DB.addParticipantToRoom(roomCode, user.username)
+  if (room.deletedAt <= new Date(Date.now() - DB.roomRestoreWindowMs)) {
+    sendError(res, 410, 'RESTORE_WINDOW_PASSED', 'Room was deleted too long ago to restore')
+    return
+  }
 
-  if (success) {
-    res.status(200).send({ id: room._id })
-  } else {
-    res.status(500).send({ msg: 'error adding participant' })
+  if (await DB.restoreRoom(roomId)) {
+    res.status(200).send({ id: room._id, code: room.code })
+    return
   }
+  sendError(res, 410, 'RESTORE_WINDOW_PASSED', 'Room was deleted too long ago to restore')
 })
 
-secureApiRouter.post('/room/:id/options', async (req, res) => {
-  if (!req.body.option) {
-    res.status(400).send({ msg: 'Missing option' })
+secureApiRouter.post('/room/:id/publish', jsonBody(), async (req, res) => {
+  const user = req.user
+  const roomId = req.params.id
+  const room = await DB.getRoomById(roomId)
+
+  if (!room) {
+    sendError(res, 404, 'ROOM_NOT_FOUND', `Room ${roomId} does not exist`)
     return
   }
 
-  const user = await getUserFromRequest(req)
+  if (room.owner !== user.username) {
+    sendError(res, 403, 'NOT_OWNER', 'User is not owner of room')
+    return
+  }
+
+  if (room.state === 'open') {
+    sendError(res, 409, 'ALREADY_PUBLISHED', 'Room is already open')
+    return
+  }
+
+  if (room.state !== 'draft') {
+    sendRoomNotOpen(res, room)
+    return
+  }
+
+  const published = await DB.publishRoom(roomId, room.version ?? 0)
+  if (!published) {
+    sendRoomModified(res)
+    return
+  }
+  res.status(200).send({ id: published._id, code: published.code, joinUrl: joinUrlFor(req, published) })
+})
+
+// Copies the options and settings of a room the caller owns, open or
+// closed, into a new room.
+secureApiRouter.post('/room/:id/clone', jsonBody(), async (req, res) => {
+  const user = req.user
   const roomId = req.params.id
   const room = await DB.getRoomById(roomId)
 
   if (!room) {
-    res.status(404).send({ msg: `Room ${roomId} does not exist` })
+    sendError(res, 404, 'ROOM_NOT_FOUND', `Room ${roomId} does not exist`)
     return
   }
 
-  if (!room.state === 'open') {
-    res.status(409).send({ msg: 'Room is not open' })
+  if (room.owner !== user.username) {
+    sendError(res, 403, 'NOT_OWNER', 'User is not owner of room')
     return
   }
 
-  if (!room.participants.includes(user.username)) {
-    res.status(403).send({ msg: 'User is not allowed to add options to room' })
+  const newRoom = await DB.cloneRoom(room, user.username)
+  sendCreatedRoom(req, res, newRoom)
+})
+
+secureApiRouter.get('/rooms', async (req, res) => {
+  const limit = parseInt(req.query.limit ?? defaultRoomsLimit)
+  const offset = parseInt(req.query.offset ?? 0)
+  if (!Number.isInteger(limit) || limit < 1 || limit > maxRoomsLimit) {
+    sendError(res, 400, 'INVALID_FIELD', `limit must be between 1 and ${maxRoomsLimit}`)
+    return
+  }
+  if (!Number.isInteger(offset) || offset < 0) {
+    sendError(res, 400, 'INVALID_FIELD', 'offset must be a non-negative integer')
+    return
+  }
+  const sort = req.query.sort ?? 'created'
+  if (!Object.hasOwn(DB.roomSorts, sort)) {
+    sendError(res, 400, 'INVALID_FIELD', `sort must be one of ${Object.keys(DB.roomSorts).join(', ')}`)
+    return
+  }
+
+  const user = req.user
+
+  const { rooms, total } = await DB.listRoomsForUser(user.username, limit, offset, sort)
+
+  res.status(200).send({ rooms, total, limit, offset, sort })
+})
+
+secureApiRouter.get('/room/:id', async (req, res) => {
+  const user = req.user
+  const roomId = req.params.id
+  const room = await DB.getRoomById(roomId)
+
+  if (!room) {
+    sendError(res, 404, 'ROOM_NOT_FOUND', `Room ${roomId} does not exist`)
+    return
+  }
+
+  if (isExpired(room)) {
+    sendError(res, 410, 'ROOM_EXPIRED', 'Room has expired')
     return
   }
 
-  const newOption = req.body.option
-  if (room.options.map(opt => opt.toLowerCase()).includes(newOption.toLowerCase())) {
-    res.status(409).send({ msg: 'Option already exists' })
+  // owners still see their drafts, to set them up before publishing
+  const ownDraft = room.state === 'draft' && room.owner === user.username
+  if (room.state !== 'open' && !ownDraft) {
+    sendRoomNotOpen(res, room)
     return
   }
 
-  if (await DB.addOptionToRoom(roomId, newOption)) {
-    res.status(201).send({ options: [...room.options, newOption] })
+  // every change to the room moves its version on, and what's sent depends
+  // on who's asking, so the two together say whether a poller's copy is stale
+  const caller = crypto.createHash('sha1').update(user.username).digest('hex').slice(0, 8)
+  res.set({
+    'ETag': `W/"${room._id}-${room.version ?? 0}-${caller}"`,
+    'Cache-Control': 'private, no-cache'
+  })
+  if (req.fresh) {
+    res.status(304).end()
     return
   }
-  res.status(500).send({ msg: 'unknown server error' })
+
+  res.status(200).send(toRoomResponse(room, user.username))
 })
 
-secureApiRouter.post('/room/:id/lockin', async (req, res) => {
-  if (!req.body.votes) {
-    res.status(400).send({ msg: 'Missing votes' })
+// Lets the owner see the standings so far without closing the room.
+secureApiRouter.get('/room/:id/tally', async (req, res) => {
+  const user = req.user
+  const roomId = req.params.id
+  const room = await DB.getRoomById(roomId)
+
+  if (!room) {
+    sendError(res, 404, 'ROOM_NOT_FOUND', `Room ${roomId} does not exist`)
     return
   }
 
-  const user = await getUserFromRequest(req)
+  if (room.owner !== user.username) {
+    sendError(res, 403, 'NOT_OWNER', 'User is not owner of room')
+    return
+  }
+
+  if (room.state !== 'open') {
+    sendRoomNotOpen(res, room)
+    return
+  }
+
+  // a room that has reached its quorum has enough ballots to be worth a look
+  if (room.tallyPreview === false && !quorumReached(room)) {
+    sendError(res, 403, 'TALLY_PREVIEW_DISABLED', 'Tally previews are turned off for this room')
+    return
+  }
+
+  res.status(200).send(provisionalTally(room))
+})
+
+// Server-sent events fallback for clients that can't hold a websocket open.
+// Streams the same events as the websocket hub until the room closes.
+secureApiRouter.get('/room/:id/events', async (req, res) => {
+  const user = req.user
   const roomId = req.params.id
   const room = await DB.getRoomById(roomId)
 
   if (!room) {
-    res.status(404).send({ msg: `Room ${roomId} does not exist` })
+    sendError(res, 404, 'ROOM_NOT_FOUND', `Room ${roomId} does not exist`)
     return
   }
 
-  if (!room.state === 'open') {
-    res.status(409).send({ msg: 'Room is not open' })
+  if (isExpired(room)) {
+    sendError(res, 410, 'ROOM_EXPIRED', 'Room has expired')
     return
   }
 
-  if (!room.participants.includes(user.username)) {
-    res.status(403).send({ msg: 'User is not allowed to participate in room' })
+  if (!isEditable(room)) {
+    sendRoomNotOpen(res, room)
     return
   }
 
-  await DB.submitUserVotes(roomId, user.username, req.body.votes)
+  if (!canWatch(room, user.username)) {
+    sendError(res, 403, 'NOT_PARTICIPANT', 'User is not allowed to participate in room')
+    return
+  }
 
-  const isOwner = room.owner === user.username
+  res.status(200).set({
+    'Content-Type': 'text/event-stream',
+    'Cache-Control': 'no-cache',
+    'Connection': 'keep-alive'
+  })
+  res.flushHeaders()
+  res.write('retry: 3000\n\n')
 
-  res.status(200).send({ resultsId: '', isOwner })
+  const stream = {
+    user: user.username,
+    send: (msg) => res.write(`data: ${msg}\n\n`),
+    close: () => res.end()
+  }
+  subscribe(roomId, stream)
+  stream.send(JSON.stringify({ type: 'room', room: toRoomResponse(room, user.username), online: onlineUsers(roomId) }))
+
+  // a comment now and then finds connections that dropped without closing,
+  // so they stop counting as online
+  const keepAlive = setInterval(() => res.write(': keep-alive\n\n'), streamKeepAliveMs)
+  req.on('close', () => {
+    clearInterval(keepAlive)
+    unsubscribe(stream)
+  })
 })
 
-secureApiRouter.post('/room/:id/close', async (req, res) => {
-  const user = await getUserFromRequest(req)
+const codeLimiter = rateLimit({
+  ...codeRateLimit,
+  keyFor: req => `${req.params.id}:${req.cookies[authCookieName]}`
+})
+
+// Replaces a leaked join code. The old code stops finding the room at once.
+secureApiRouter.post('/room/:id/code', codeLimiter, jsonBody(), async (req, res) => {
+  const user = req.user
   const roomId = req.params.id
   const room = await DB.getRoomById(roomId)
 
   if (!room) {
-    res.status(404).send({ msg: `Room ${roomId} does not exist` })
+    sendError(res, 404, 'ROOM_NOT_FOUND', `Room ${roomId} does not exist`)
     return
   }
-  const isOwner = room.owner === user.username
 
-  if (!isOwner) {
-    res.status(403).send({ msg: 'User is not owner of room' })
+  if (room.owner !== user.username) {
+    sendError(res, 403, 'NOT_OWNER', 'User is not owner of room')
+    return
+  }
+
+  if (!isEditable(room)) {
+    sendRoomNotOpen(res, room)
+    return
+  }
+
+  const updated = await DB.regenerateRoomCode(roomId, room.version ?? 0)
+  if (!updated) {
+    sendRoomModified(res)
     return
   }
+  broadcastToRoom(roomId, { type: 'code', code: updated.code })
+  res.status(200).send({ code: updated.code, joinUrl: joinUrlFor(req, updated) })
+})
+
+secureApiRouter.get('/room/:id/qr', async (req, res) => {
+  const user = req.user
+  const roomId = req.params.id
+  const room = await DB.getRoomById(roomId)
 
-  if (!room.state === 'open') {
-    res.status(409).send({ msg: 'Room is not open' })
+  if (!room) {
+    sendError(res, 404, 'ROOM_NOT_FOUND', `Room ${roomId} does not exist`)
     return
   }
 
-  await DB.closeRoom(roomId)
+  if (!room.participants.includes(user.username)) {
+    sendError(res, 403, 'NOT_PARTICIPANT', 'User is not allowed to participate in room')
+    return
+  }
 
-  const sortedOptions = calculateVoteResult(room.votes)
-  const result = await DB.createResult(user.username, sortedOptions)
+  const requestedSize = parseInt(req.query.size) || defaultQrSize
+  const size = Math.min(Math.max(requestedSize, minQrSize), maxQrSize)
+  // drawn here rather than by a QR service, which would be sent every
+  // room's join link
+  const png = await QRCode.toBuffer(joinUrlFor(req, room), { type: 'png', width: size, margin: 1 })
 
-  res.status(200).send({ resultsId: result._id })
+  res.status(200).set({
+    'Content-Type': 'image/png',
+    'Cache-Control': 'private, max-age=3600'
+  })
+  res.send(png)
 })
 
-secureApiRouter.get('/results/:id', async (req, res) => {
-  const resultsId = req.params.id
-  const result = await DB.getResult(resultsId)
+// What someone about to join a room can see: who runs it, how many are in it,
+// and whether they'll need a password. Closed and expired rooms look the same
+// as ones that never existed.
+secureApiRouter.get('/room/by-code/:code', async (req, res) => {
+  const roomCode = req.params.code
+  const room = await DB.getRoomByCode(roomCode)
 
-  if (!result) {
-    res.status(404).send({ msg: `Result does not exist` })
+  if (!room || room.state !== 'open' || isExpired(room)) {
+    sendError(res, 404, 'ROOM_NOT_FOUND', `Room ${roomCode} does not exist`)
     return
   }
 
-  res.status(200).send({ results: result.sortedOptions })
+  res.status(200).send({
+    code: room.code,
+    owner: room.owner,
+    participantCount: room.participants.length,
+    maxParticipants: room.maxParticipants ?? 0,
+    state: room.state,
+    hasPassword: Boolean(room.passwordHash)
+  })
 })
 
-secureApiRouter.get('/history', async (req, res) => {
-  const user = await getUserFromRequest(req)
+secureApiRouter.post('/room/:code/join', jsonBody('password'), async (req, res) => {
+  const user = req.user
+  const roomCode = req.params.code
+  const room = await DB.getRoomByCode(roomCode)
 
-  const history = await DB.getHistory(user.username)
+  if (!room) {
+    sendError(res, 404, 'ROOM_NOT_FOUND', `Room ${roomCode} does not exist`)
+    return
+  }
 
-  res.status(200).send({ history })
+  if (isExpired(room)) {
+    sendError(res, 410, 'ROOM_EXPIRED', 'Room has expired')
+    return
+  }
+
+  if (room.state !== 'open') {
+    sendRoomNotOpen(res, room)
+    return
+  }
+
+  // joining again is a no-op so it can't disturb the user's saved ballot
+  if (room.participants.includes(user.username)) {
+    res.status(200).send({ id: room._id })
+    return
+  }
+
+  if (room.passwordHash) {
+    const password = typeof req.body.password === 'string' ? req.body.password : ''
+    if (!await bcrypt.compare(password, room.passwordHash)) {
+      sendError(res, 401, 'WRONG_PASSWORD', 'Room password is missing or incorrect')
+      return
+    }
+  }
+
+  const isFull = room.maxParticipants > 0 && room.participants.length >= room.maxParticipants
+  if (isFull) {
+    sendError(res, 409, 'ROOM_FULL', 'Room is full')
+    return
+  }
+
+  const success = await DB.addParticipantToRoom(roomCode, user.username)
+
+  if (success) {
+    await broadcastParticipant(room._id, 'participant-joined', user.username)
+    res.status(200).send({ id: room._id })
+  } else if (room.maxParticipants > 0) {
+    // someone else took the last spot between our read and the update
+    sendError(res, 409, 'ROOM_FULL', 'Room is full')
+  } else {
+    sendError(res, 500, 'INTERNAL_ERROR', 'error adding participant')
+  }
 })
 
-app.use(function(err, _req, res, _next) {
-  res.status(500).send({ type: err.name, message: err.message });
-});
+// Follows a room without a ballot. Spectators get the room and its live
+// updates, but can't vote, lock in or add options.
+secureApiRouter.post('/room/:code/spectate', jsonBody('password'), async (req, res) => {
+  const user = req.user
+  const roomCode = req.params.code
+  const room = await DB.getRoomByCode(roomCode)
 
-app.use((_req, res) => {
-  res.sendFile('index.html', { root: 'public' });
-});
+  if (!room) {
+    sendError(res, 404, 'ROOM_NOT_FOUND', `Room ${roomCode} does not exist`)
+    return
+  }
 
-function setAuthCookie(res, authToken) {
-  res.cookie(authCookieName, authToken, {
-    secure: true,
-    httpOnly: true,
-    sameSite: 'strict',
-  });
-}
+  if (isExpired(room)) {
+    sendError(res, 410, 'ROOM_EXPIRED', 'Room has expired')
+    return
+  }
 
-const httpService = app.listen(port, () => {
-  console.log(`Listening on port ${port}`);
-});
+  if (room.state !== 'open') {
+    sendRoomNotOpen(res, room)
+    return
+  }
+
+  if (room.participants.includes(user.username)) {
+    sendError(res, 409, 'ALREADY_PARTICIPANT', 'User is already a participant in room')
+    return
+  }
+
+  if (room.passwordHash) {
+    const password = typeof req.body.password === 'string' ? req.body.password : ''
+    if (!await bcrypt.compare(password, room.passwordHash)) {
+      sendError(res, 401, 'WRONG_PASSWORD', 'Room password is missing or incorrect')
+      return
+    }
+  }
+
+  if (await DB.addSpectatorToRoom(roomCode, user.username)) {
+    res.status(200).send({ id: room._id })
+    return
+  }
+  sendRoomModified(res)
+})
+
+secureApiRouter.delete('/room/:code/participant', jsonBody(), async (req, res) => {
+  const user = req.user
+  const roomCode = req.params.code
+  const room = await DB.getRoomByCode(roomCode)
+
+  if (!room) {
+    sendError(res, 404, 'ROOM_NOT_FOUND', `Room ${roomCode} does not exist`)
+    return
+  }
+
+  if (room.state !== 'open') {
+    sendRoomNotOpen(res, room)
+    return
+  }
+
+  if (!room.participants.includes(user.username)) {
+    sendError(res, 404, 'NOT_PARTICIPANT', 'User is not a participant in room')
+    return
+  }
+
+  if (room.owner === user.username) {
+    sendError(res, 409, 'OWNER_CANNOT_LEAVE', 'Owner cannot leave room without transferring ownership or closing it')
+    return
+  }
+
+  if (await DB.removeParticipantFromRoom(room._id, user.username, room.version ?? 0)) {
+    unsubscribeUser(room._id, user.username)
+    await broadcastParticipant(room._id, 'participant-left', user.username)
+    scheduleTally(room._id)
+    await maybeAutoClose(room._id)
+    res.status(204).end()
+    return
+  }
+  sendRoomModified(res)
+})
+
+secureApiRouter.post('/room/:id/options', jsonOrFormBody(maxBodySize, 'option', 'description', 'imageUrl'), async (req, res) => {
+  if (!req.body.option) {
+    sendError(res, 400, 'MISSING_FIELD', 'Missing option')
+    return
+  }
+
+  const user = req.user
+  const roomId = req.params.id
+  const room = await DB.getRoomById(roomId)
+
+  if (!room) {
+    sendError(res, 404, 'ROOM_NOT_FOUND', `Room ${roomId} does not exist`)
+    return
+  }
+
+  const newOption = normalizeOptionName(req.body.option)
+  const details = { description: req.body.description, imageUrl: req.body.imageUrl }
+  const invalid = validateNewOption(room, user.username, newOption) ?? validateOptionDetails(details)
+  if (invalid) {
+    sendError(res, invalid.status, invalid.code, invalid.msg)
+    return
+  }
+
+  if (await DB.addOptionToRoom(roomId, newOption, user.username, details, room.version ?? 0)) {
+    const options = [...room.options, newOption]
+    broadcastToRoom(roomId, { type: 'options', options, details: { [newOption]: details } })
+    res.status(201).send({ options })
+    return
+  }
+  sendRoomModified(res)
+})
+
+// Adds a list of options at once. Options the room already has, or that
+// repeat earlier in the list, are skipped rather than failing the request.
+secureApiRouter.post('/room/:id/options/batch', jsonBody('options'), async (req, res) => {
+  const requested = req.body.options
+  if (!Array.isArray(requested) || requested.length === 0) {
+    sendError(res, 400, 'MISSING_FIELD', 'Missing options')
+    return
+  }
+  if (requested.length > maxBatchOptions) {
+    sendError(res, 400, 'INVALID_FIELD', `At most ${maxBatchOptions} options can be added at once`)
+    return
+  }
+
+  const user = req.user
+  const roomId = req.params.id
+  const room = await DB.getRoomById(roomId)
+
+  if (!room) {
+    sendError(res, 404, 'ROOM_NOT_FOUND', `Room ${roomId} does not exist`)
+    return
+  }
+
+  // validate each option against the room as it would be with the earlier
+  // ones added, so duplicates within the batch and the caps are caught too
+  const pending = { ...room, options: [...room.options], optionAuthors: { ...room.optionAuthors } }
+  const added = []
+  const skipped = []
+  for (const option of requested.map(normalizeOptionName)) {
+    const invalid = validateNewOption(pending, user.username, option)
+    if (invalid?.code === 'OPTION_EXISTS') {
+      skipped.push(option)
+      continue
+    }
+    if (invalid) {
+      sendError(res, invalid.status, invalid.code, invalid.msg)
+      return
+    }
+    added.push(option)
+    pending.options.push(option)
+    pending.optionAuthors[option] = user.username
+  }
+
+  if (added.length === 0) {
+    res.status(200).send({ options: room.options, added, skipped })
+    return
+  }
+
+  if (await DB.addOptionsToRoom(roomId, added, user.username, room.version ?? 0)) {
+    broadcastToRoom(roomId, { type: 'options', options: pending.options })
+    res.status(201).send({ options: pending.options, added, skipped })
+    return
+  }
+  sendRoomModified(res)
+})
+
+secureApiRouter.delete('/room/:id/options', jsonBody('option'), async (req, res) => {
+  if (!req.body.option) {
+    sendError(res, 400, 'MISSING_FIELD', 'Missing option')
+    return
+  }
+
+  const user = req.user
+  const roomId = req.params.id
+  const room = await DB.getRoomById(roomId)
+
+  if (!room) {
+    sendError(res, 404, 'ROOM_NOT_FOUND', `Room ${roomId} does not exist`)
+    return
+  }
+
+  if (!isEditable(room)) {
+    sendRoomNotOpen(res, room)
+    return
+  }
+
+  const option = req.body.option
+  if (!room.options.includes(option)) {
+    sendError(res, 404, 'OPTION_NOT_FOUND', `Option ${option} does not exist`)
+    return
+  }
+
+  const isOwner = room.owner === user.username
+  const isAuthor = room.optionAuthors?.[option] === user.username
+  if (!isOwner && !isAuthor) {
+    sendError(res, 403, 'NOT_OPTION_AUTHOR', 'User is not allowed to remove option from room')
+    return
+  }
+
+  if (await DB.removeOptionFromRoom(roomId, option, user.username, room.version ?? 0)) {
+    const options = room.options.filter(opt => opt !== option)
+    broadcastToRoom(roomId, { type: 'options', options })
+    scheduleTally(roomId)
+    res.status(200).send({ options })
+    return
+  }
+  sendRoomModified(res)
+})
+
+secureApiRouter.patch('/room/:id/max-options', jsonBody('maxOptions'), async (req, res) => {
+  const maxOptions = req.body.maxOptions
+  if (!Number.isInteger(maxOptions) || maxOptions < 0) {
+    sendError(res, 400, 'INVALID_FIELD', 'maxOptions must be a non-negative integer')
+    return
+  }
+
+  const user = req.user
+  const roomId = req.params.id
+  const room = await DB.getRoomById(roomId)
+
+  if (!room) {
+    sendError(res, 404, 'ROOM_NOT_FOUND', `Room ${roomId} does not exist`)
+    return
+  }
+
+  if (room.owner !== user.username) {
+    sendError(res, 403, 'NOT_OWNER', 'User is not owner of room')
+    return
+  }
+
+  if (!isEditable(room)) {
+    sendRoomNotOpen(res, room)
+    return
+  }
+
+  if (hasVotesCast(room)) {
+    sendError(res, 409, 'VOTING_STARTED', 'Option limit cannot change once voting has started')
+    return
+  }
+
+  if (maxOptions > 0 && maxOptions < room.options.length) {
+    sendError(res, 409, 'OPTION_LIMIT_TOO_LOW', `Room already has ${room.options.length} options`)
+    return
+  }
+
+  if (await DB.setMaxOptions(roomId, maxOptions, room.version ?? 0)) {
+    res.status(200).send({ maxOptions })
+    return
+  }
+  sendRoomModified(res)
+})
+
+secureApiRouter.patch('/room/:id/method', jsonBody('votingMethod'), async (req, res) => {
+  const votingMethod = req.body.votingMethod
+  if (!votingMethods.includes(votingMethod)) {
+    sendError(res, 400, 'INVALID_FIELD', `Unknown voting method ${votingMethod}`)
+    return
+  }
+
+  const user = req.user
+  const roomId = req.params.id
+  const room = await DB.getRoomById(roomId)
+
+  if (!room) {
+    sendError(res, 404, 'ROOM_NOT_FOUND', `Room ${roomId} does not exist`)
+    return
+  }
+
+  if (room.owner !== user.username) {
+    sendError(res, 403, 'NOT_OWNER', 'User is not owner of room')
+    return
+  }
+
+  if (!isEditable(room)) {
+    sendRoomNotOpen(res, room)
+    return
+  }
+
+  if (hasVotesCast(room)) {
+    sendError(res, 409, 'VOTING_STARTED', 'Voting method cannot change once voting has started')
+    return
+  }
+
+  if (await DB.setVotingMethod(roomId, votingMethod, room.version ?? 0)) {
+    broadcastToRoom(roomId, { type: 'voting-method', votingMethod })
+    res.status(200).send({ votingMethod })
+    return
+  }
+  sendRoomModified(res)
+})
+
+secureApiRouter.get('/room/:id/settings', async (req, res) => {
+  const user = req.user
+  const roomId = req.params.id
+  const room = await DB.getRoomById(roomId)
+
+  if (!room) {
+    sendError(res, 404, 'ROOM_NOT_FOUND', `Room ${roomId} does not exist`)
+    return
+  }
+
+  if (room.owner !== user.username) {
+    sendError(res, 403, 'NOT_OWNER', 'User is not owner of room')
+    return
+  }
+
+  res.status(200).send(roomSettings(room))
+})
+
+// Changes any number of settings in one go; either all of them apply or
+// none do.
+secureApiRouter.patch('/room/:id/settings', jsonBody(...settingNames), async (req, res) => {
+  const changes = req.body
+  if (Object.keys(changes).length === 0) {
+    sendError(res, 400, 'MISSING_FIELD', 'No settings to change')
+    return
+  }
+
+  const user = req.user
+  const roomId = req.params.id
+  const room = await DB.getRoomById(roomId)
+
+  if (!room) {
+    sendError(res, 404, 'ROOM_NOT_FOUND', `Room ${roomId} does not exist`)
+    return
+  }
+
+  if (room.owner !== user.username) {
+    sendError(res, 403, 'NOT_OWNER', 'User is not owner of room')
+    return
+  }
+
+  if (!isEditable(room)) {
+    sendRoomNotOpen(res, room)
+    return
+  }
+
+  const current = roomSettings(room)
+  const settingsError = validateSettings(changes, current)
+  if (settingsError) {
+    sendError(res, 400, 'INVALID_FIELD', settingsError)
+    return
+  }
+
+  const frozen = frozenChanges(changes, current)
+  if (frozen.length > 0 && hasVotesCast(room)) {
+    sendError(res, 409, 'VOTING_STARTED', `${frozen.join(', ')} cannot change once voting has started`)
+    return
+  }
+
+  if (changes.maxOptions > 0 && changes.maxOptions < room.options.length) {
+    sendError(res, 409, 'OPTION_LIMIT_TOO_LOW', `Room already has ${room.options.length} options`)
+    return
+  }
+
+  const parsed = parseSettings(changes)
+  if (await DB.updateRoomSettings(roomId, parsed, frozen.length > 0, room.version ?? 0)) {
+    if (changes.votingMethod !== undefined && changes.votingMethod !== current.votingMethod) {
+      broadcastToRoom(roomId, { type: 'voting-method', votingMethod: changes.votingMethod })
+    }
+    if (changes.closeAt !== undefined) {
+      const closesInMs = parsed.closeAt ? parsed.closeAt - Date.now() : null
+      broadcastToRoom(roomId, { type: 'deadline', closeAt: parsed.closeAt, closesInMs })
+    }
+    res.status(200).send({ ...current, ...parsed })
+    return
+  }
+  sendRoomModified(res)
+})
+
+// Keeps an option at the top of everyone's list, or lets it go back to its
+// usual place.
+secureApiRouter.post('/room/:id/pins', jsonBody('option'), async (req, res) => {
+  if (!req.body.option) {
+    sendError(res, 400, 'MISSING_FIELD', 'Missing option')
+    return
+  }
+
+  const user = req.user
+  const roomId = req.params.id
+  const room = await DB.getRoomById(roomId)
+
+  if (!room) {
+    sendError(res, 404, 'ROOM_NOT_FOUND', `Room ${roomId} does not exist`)
+    return
+  }
+
+  if (room.owner !== user.username) {
+    sendError(res, 403, 'NOT_OWNER', 'User is not owner of room')
+    return
+  }
+
+  if (!isEditable(room)) {
+    sendRoomNotOpen(res, room)
+    return
+  }
+
+  const option = req.body.option
+  if (!room.options.includes(option)) {
+    sendError(res, 404, 'OPTION_NOT_FOUND', `Option ${option} does not exist`)
+    return
+  }
+
+  if (await DB.pinOption(roomId, option, room.version ?? 0)) {
+    const pinnedOptions = [...new Set([...(room.pinnedOptions ?? []), option])]
+    broadcastToRoom(roomId, { type: 'pins', pinnedOptions })
+    res.status(200).send({ pinnedOptions })
+    return
+  }
+  sendRoomModified(res)
+})
+
+secureApiRouter.delete('/room/:id/pins', jsonBody('option'), async (req, res) => {
+  if (!req.body.option) {
+    sendError(res, 400, 'MISSING_FIELD', 'Missing option')
+    return
+  }
+
+  const user = req.user
+  const roomId = req.params.id
+  const room = await DB.getRoomById(roomId)
+
+  if (!room) {
+    sendError(res, 404, 'ROOM_NOT_FOUND', `Room ${roomId} does not exist`)
+    return
+  }
+
+  if (room.owner !== user.username) {
+    sendError(res, 403, 'NOT_OWNER', 'User is not owner of room')
+    return
+  }
+
+  if (!isEditable(room)) {
+    sendRoomNotOpen(res, room)
+    return
+  }
+
+  const option = req.body.option
+  if (await DB.unpinOption(roomId, option, room.version ?? 0)) {
+    const pinnedOptions = (room.pinnedOptions ?? []).filter(opt => opt !== option)
+    broadcastToRoom(roomId, { type: 'pins', pinnedOptions })
+    res.status(200).send({ pinnedOptions })
+    return
+  }
+  sendRoomModified(res)
+})
+
+secureApiRouter.patch('/room/:id/options', jsonBody('old', 'new'), async (req, res) => {
+  if (!req.body.old || !req.body.new) {
+    sendError(res, 400, 'MISSING_FIELD', 'Missing old or new option')
+    return
+  }
+
+  const user = req.user
+  const roomId = req.params.id
+  const room = await DB.getRoomById(roomId)
+
+  if (!room) {
+    sendError(res, 404, 'ROOM_NOT_FOUND', `Room ${roomId} does not exist`)
+    return
+  }
+
+  if (!isEditable(room)) {
+    sendRoomNotOpen(res, room)
+    return
+  }
+
+  const oldOption = req.body.old
+  const newOption = normalizeOptionName(req.body.new)
+  const invalidName = validateOptionName(room, newOption)
+  if (invalidName) {
+    sendError(res, invalidName.status, invalidName.code, invalidName.msg)
+    return
+  }
+  if (!room.options.includes(oldOption)) {
+    sendError(res, 404, 'OPTION_NOT_FOUND', `Option ${oldOption} does not exist`)
+    return
+  }
+
+  const isOwner = room.owner === user.username
+  const isAuthor = room.optionAuthors?.[oldOption] === user.username
+  if (!isOwner && !isAuthor) {
+    sendError(res, 403, 'NOT_OPTION_AUTHOR', 'User is not allowed to edit option')
+    return
+  }
+
+  const collides = room.options
+    .filter(opt => opt !== oldOption)
+    .some(opt => sameOption(opt, newOption))
+  if (collides) {
+    sendError(res, 409, 'OPTION_EXISTS', 'Option already exists')
+    return
+  }
+
+  if (await DB.renameOption(roomId, oldOption, newOption, user.username, room.version ?? 0)) {
+    const options = room.options.map(opt => opt === oldOption ? newOption : opt)
+    broadcastToRoom(roomId, { type: 'options', options, renamed: { from: oldOption, to: newOption } })
+    res.status(200).send({ options })
+    return
+  }
+  sendRoomModified(res)
+})
+
+secureApiRouter.post('/room/:id/react', jsonBody('option', 'emoji'), async (req, res) => {
+  if (!req.body.option || !req.body.emoji) {
+    sendError(res, 400, 'MISSING_FIELD', 'Missing option or emoji')
+    return
+  }
+  const emoji = String(req.body.emoji)
+  if (emoji.length > maxEmojiLength || !emojiPattern.test(emoji)) {
+    sendError(res, 400, 'INVALID_FIELD', 'emoji must be a single emoji')
+    return
+  }
+
+  const user = req.user
+  const roomId = req.params.id
+  const room = await DB.getRoomById(roomId)
+
+  if (!room) {
+    sendError(res, 404, 'ROOM_NOT_FOUND', `Room ${roomId} does not exist`)
+    return
+  }
+
+  if (room.state !== 'open') {
+    sendRoomNotOpen(res, room)
+    return
+  }
+
+  if (!room.participants.includes(user.username)) {
+    sendError(res, 403, 'NOT_PARTICIPANT', 'User is not allowed to participate in room')
+    return
+  }
+
+  const option = req.body.option
+  if (!room.options.includes(option)) {
+    sendError(res, 404, 'OPTION_NOT_FOUND', `Option ${option} does not exist`)
+    return
+  }
+
+  if (!await DB.setReaction(roomId, user.username, option, emoji)) {
+    sendRoomModified(res)
+    return
+  }
+  const updated = await DB.getRoomById(roomId)
+  const reactions = countReactions(updated.reactions)
+  broadcastToRoom(roomId, { type: 'reactions', reactions })
+  res.status(200).send({ reactions })
+})
+
+// Audit cursors are the time and id of the last entry on a page, as
+// `${ms}-${id}`. Returns undefined for anything else.
+function parseAuditCursor(cursor) {
+  const match = typeof cursor === 'string' && /^(\d+)-([0-9a-f]{24})$/.exec(cursor)
+  if (!match) {
+    return undefined
+  }
+  return { at: new Date(Number(match[1])), id: match[2] }
+}
+
+// The room's audit log, newest first, a page at a time. It is only ever
+// appended to, so there is deliberately no way to change it through the API.
+secureApiRouter.get('/room/:id/audit', async (req, res) => {
+  const user = req.user
+  const roomId = req.params.id
+  const room = await DB.getRoomById(roomId)
+
+  if (!room) {
+    sendError(res, 404, 'ROOM_NOT_FOUND', `Room ${roomId} does not exist`)
+    return
+  }
+
+  if (room.owner !== user.username) {
+    sendError(res, 403, 'NOT_OWNER', 'User is not owner of room')
+    return
+  }
+
+  const limit = parseInt(req.query.limit ?? defaultAuditLogLimit)
+  if (!Number.isInteger(limit) || limit < 1 || limit > maxAuditLogLimit) {
+    sendError(res, 400, 'INVALID_FIELD', `limit must be between 1 and ${maxAuditLogLimit}`)
+    return
+  }
+  let before
+  if (req.query.before !== undefined) {
+    before = parseAuditCursor(req.query.before)
+    if (!before) {
+      sendError(res, 400, 'INVALID_FIELD', 'before must be a cursor from a previous page')
+      return
+    }
+  }
+  const action = req.query.type
+  if (action !== undefined && typeof action !== 'string') {
+    sendError(res, 400, 'INVALID_FIELD', 'type must be a single action')
+    return
+  }
+
+  // one extra entry tells us whether there's another page
+  let entries = await DB.getAuditLog(roomId, limit + 1, { before, action })
+  const last = entries.length > limit ? entries[limit - 1] : undefined
+  entries = entries.slice(0, limit)
+  if (room.anonymous) {
+    // anonymous rooms keep who voted what hidden, even from the owner
+    entries = entries.map(entry => optionActions.includes(entry.action) ? entry : { ...entry, username: undefined, target: undefined })
+  }
+  const nextCursor = last ? `${last.at.getTime()}-${last._id}` : null
+  res.status(200).send({ entries, nextCursor })
+})
+
+// Who has joined the room and, of those watching, who has it open right now.
+secureApiRouter.get('/room/:id/presence', async (req, res) => {
+  const user = req.user
+  const roomId = req.params.id
+  const room = await DB.getRoomById(roomId)
+
+  if (!room) {
+    sendError(res, 404, 'ROOM_NOT_FOUND', `Room ${roomId} does not exist`)
+    return
+  }
+
+  if (!canWatch(room, user.username)) {
+    sendError(res, 403, 'NOT_PARTICIPANT', 'User is not allowed to participate in room')
+    return
+  }
+
+  res.status(200).send({ joined: room.participants, online: onlineUsers(roomId) })
+})
+
+secureApiRouter.get('/room/:id/messages', async (req, res) => {
+  const user = req.user
+  const roomId = req.params.id
+  const room = await DB.getRoomById(roomId)
+
+  if (!room) {
+    sendError(res, 404, 'ROOM_NOT_FOUND', `Room ${roomId} does not exist`)
+    return
+  }
+
+  if (!canWatch(room, user.username)) {
+    sendError(res, 403, 'NOT_PARTICIPANT', 'User is not allowed to participate in room')
+    return
+  }
+
+  const messages = await DB.getMessages(roomId, messageHistoryLimit)
+  res.status(200).send({ messages })
+})
+
+secureApiRouter.post('/room/:id/messages', jsonBody('text'), async (req, res) => {
+  const text = typeof req.body.text === 'string' ? req.body.text.trim() : ''
+  if (!text) {
+    sendError(res, 400, 'MISSING_FIELD', 'Missing text')
+    return
+  }
+  if (text.length > maxMessageLength) {
+    sendError(res, 400, 'INVALID_FIELD', `Messages must be at most ${maxMessageLength} characters`)
+    return
+  }
+
+  const user = req.user
+  const roomId = req.params.id
+  const room = await DB.getRoomById(roomId)
+
+  if (!room) {
+    sendError(res, 404, 'ROOM_NOT_FOUND', `Room ${roomId} does not exist`)
+    return
+  }
+
+  if (room.state !== 'open') {
+    sendRoomNotOpen(res, room)
+    return
+  }
+
+  if (!room.participants.includes(user.username)) {
+    sendError(res, 403, 'NOT_PARTICIPANT', 'User is not allowed to participate in room')
+    return
+  }
+
+  const message = await DB.addMessage(roomId, user.username, text)
+  broadcastToRoom(roomId, { type: 'message', message })
+  res.status(201).send({ message })
+})
+
+secureApiRouter.post('/room/:id/vote', jsonBody('votes', 'comments'), async (req, res) => {
+  if (!req.body.votes) {
+    sendError(res, 400, 'MISSING_FIELD', 'Missing votes')
+    return
+  }
+
+  const user = req.user
+  const roomId = req.params.id
+  const room = await DB.getRoomById(roomId)
+
+  if (!room) {
+    sendError(res, 404, 'ROOM_NOT_FOUND', `Room ${roomId} does not exist`)
+    return
+  }
+
+  if (room.state !== 'open') {
+    sendRoomNotOpen(res, room)
+    return
+  }
+
+  if (!room.participants.includes(user.username)) {
+    sendError(res, 403, 'NOT_PARTICIPANT', 'User is not allowed to participate in room')
+    return
+  }
+
+  if (room.lockedIn?.includes(user.username)) {
+    sendError(res, 409, 'ALREADY_LOCKED_IN', 'User has already locked in')
+    return
+  }
+
+  const votes = req.body.votes
+  const invalid = validateVotes(room, votes)
+  if (invalid) {
+    sendError(res, 400, 'INVALID_VOTES', invalid)
+    return
+  }
+  const { comments, error } = req.body.comments === undefined ? {} : cleanComments(room, req.body.comments)
+  if (error) {
+    sendError(res, 400, 'INVALID_COMMENTS', error)
+    return
+  }
+
+  if (await DB.updateUserVotes(roomId, user.username, votes, room.version ?? 0, comments)) {
+    scheduleTally(roomId)
+    res.status(200).send({ votes, comments })
+    return
+  }
+  sendRoomModified(res)
+})
+
+secureApiRouter.post('/room/:id/lockin', jsonBody('votes', 'comments'), async (req, res) => {
+  const user = req.user
+  const roomId = req.params.id
+  const room = await DB.getRoomById(roomId)
+
+  if (!room) {
+    sendError(res, 404, 'ROOM_NOT_FOUND', `Room ${roomId} does not exist`)
+    return
+  }
+
+  if (room.state !== 'open') {
+    sendRoomNotOpen(res, room)
+    return
+  }
+
+  if (!room.participants.includes(user.username)) {
+    sendError(res, 403, 'NOT_PARTICIPANT', 'User is not allowed to participate in room')
+    return
+  }
+
+  if (room.lockedIn?.includes(user.username)) {
+    sendError(res, 409, 'ALREADY_LOCKED_IN', 'User has already locked in')
+    return
+  }
+
+  // votes are optional here; without them we lock in the user's saved ballot
+  if (req.body.votes) {
+    const invalid = validateVotes(room, req.body.votes)
+    if (invalid) {
+      sendError(res, 400, 'INVALID_VOTES', invalid)
+      return
+    }
+    const { comments, error } = req.body.comments === undefined ? {} : cleanComments(room, req.body.comments)
+    if (error) {
+      sendError(res, 400, 'INVALID_COMMENTS', error)
+      return
+    }
+    if (!await DB.updateUserVotes(roomId, user.username, req.body.votes, room.version ?? 0, comments)) {
+      sendRoomModified(res)
+      return
+    }
+  }
+
+  // an incomplete ballot is still saved, just not locked in
+  if (room.requireComplete) {
+    const ballot = req.body.votes ?? room.votes.find(v => v.username === user.username)?.votes
+    const unscored = unscoredOptions(room, ballot)
+    if (unscored.length > 0) {
+      sendError(res, 400, 'INCOMPLETE_BALLOT', `Every option must be scored; unscored: ${unscored.join(', ')}`)
+      return
+    }
+  }
+
+  if (!await DB.lockInUser(roomId, user.username)) {
+    sendError(res, 409, 'NO_VOTES', 'User has no recorded votes to lock in')
+    return
+  }
+
+  await broadcastLockIn(roomId, user.username)
+
+  const isOwner = room.owner === user.username
+  const result = await maybeAutoClose(roomId)
+
+  res.status(200).send({ resultsId: result?._id ?? '', isOwner })
+})
+
+secureApiRouter.post('/room/:id/unlock', jsonBody(), async (req, res) => {
+  const user = req.user
+  const roomId = req.params.id
+  const room = await DB.getRoomById(roomId)
+
+  if (!room) {
+    sendError(res, 404, 'ROOM_NOT_FOUND', `Room ${roomId} does not exist`)
+    return
+  }
+
+  // includes rooms that auto-closed when the last participant locked in
+  if (room.state !== 'open') {
+    sendRoomNotOpen(res, room)
+    return
+  }
+
+  if (!room.participants.includes(user.username)) {
+    sendError(res, 403, 'NOT_PARTICIPANT', 'User is not allowed to participate in room')
+    return
+  }
+
+  if (!room.lockedIn?.includes(user.username)) {
+    sendError(res, 409, 'NOT_LOCKED_IN', 'User has not locked in')
+    return
+  }
+
+  if (await DB.unlockUser(roomId, user.username, room.version ?? 0)) {
+    await broadcastUnlock(roomId, user.username)
+    res.status(204).end()
+    return
+  }
+  sendRoomModified(res)
+})
+
+// Wipes every ballot so a practice run can start over in the same room.
+secureApiRouter.post('/room/:id/reset', jsonBody(), async (req, res) => {
+  const user = req.user
+  const roomId = req.params.id
+  const room = await DB.getRoomById(roomId)
+
+  if (!room) {
+    sendError(res, 404, 'ROOM_NOT_FOUND', `Room ${roomId} does not exist`)
+    return
+  }
+
+  if (room.owner !== user.username) {
+    sendError(res, 403, 'NOT_OWNER', 'User is not owner of room')
+    return
+  }
+
+  if (room.state !== 'open') {
+    sendRoomNotOpen(res, room)
+    return
+  }
+
+  if (await DB.resetVotes(roomId, user.username, room.version ?? 0)) {
+    await broadcastReset(roomId)
+    res.status(204).end()
+    return
+  }
+  sendRoomModified(res)
+})
+
+// Lets a locked in participant change their vote, for when they can't
+// unlock themselves.
+secureApiRouter.post('/room/:id/unlock/:username', jsonBody(), async (req, res) => {
+  const user = req.user
+  const roomId = req.params.id
+  const room = await DB.getRoomById(roomId)
+
+  if (!room) {
+    sendError(res, 404, 'ROOM_NOT_FOUND', `Room ${roomId} does not exist`)
+    return
+  }
+
+  if (room.owner !== user.username) {
+    sendError(res, 403, 'NOT_OWNER', 'User is not owner of room')
+    return
+  }
+
+  if (room.state !== 'open') {
+    sendRoomNotOpen(res, room)
+    return
+  }
+
+  const target = findParticipant(room, req.params.username)
+  if (!target) {
+    sendError(res, 404, 'PARTICIPANT_NOT_FOUND', `User ${req.params.username} is not a participant in room`)
+    return
+  }
+
+  if (!room.lockedIn?.includes(target)) {
+    sendError(res, 409, 'NOT_LOCKED_IN', `User ${target} has not locked in`)
+    return
+  }
+
+  if (await DB.unlockUser(roomId, target, room.version ?? 0, user.username)) {
+    await broadcastUnlock(roomId, target, true)
+    res.status(204).end()
+    return
+  }
+  sendRoomModified(res)
+})
+
+secureApiRouter.post('/room/:id/close', jsonBody(), async (req, res) => {
+  const user = req.user
+  const roomId = req.params.id
+  const room = await DB.getRoomById(roomId)
+
+  if (!room) {
+    sendError(res, 404, 'ROOM_NOT_FOUND', `Room ${roomId} does not exist`)
+    return
+  }
+  const isOwner = room.owner === user.username
+
+  if (!isOwner) {
+    sendError(res, 403, 'NOT_OWNER', 'User is not owner of room')
+    return
+  }
+
+  if (room.state !== 'open') {
+    sendRoomNotOpen(res, room)
+    return
+  }
+
+  const needed = lockInsNeeded(room)
+  if (needed > 0) {
+    sendError(res, 409, 'NOT_ENOUGH_LOCKED_IN',
+      `${needed} more ${needed === 1 ? 'participant needs' : 'participants need'} to lock in before the room can close`)
+    return
+  }
+
+  // the close only goes through if the room is still open and unchanged, so
+  // two closes racing each other can't both publish a result
+  const result = await closeRoomWithResult(room)
+  if (!result) {
+    const current = await DB.getRoomById(roomId)
+    if (current?.state !== 'open') {
+      sendError(res, 409, 'ROOM_CLOSED', 'Room is not open')
+      return
+    }
+    sendRoomModified(res)
+    return
+  }
+
+  // the result comes back with the close so the client can show it straight
+  // away, without fetching it again
+  // closing short of the quorum is allowed, but the owner is told the
+  // result rests on fewer ballots than they wanted
+  const belowQuorum = room.quorum > 0 && !quorumReached(room)
+  res.status(200).send({
+    resultsId: result._id,
+    resultsVisible: result.visible !== false,
+    result: toResultResponse(result, user.username),
+    warning: belowQuorum
+      ? `Closed with ${room.lockedIn?.length ?? 0} of the ${room.quorum} lock ins needed for quorum`
+      : undefined
+  })
+})
+
+secureApiRouter.post('/room/:id/kick', jsonBody('username'), async (req, res) => {
+  if (!req.body.username) {
+    sendError(res, 400, 'MISSING_FIELD', 'Missing username')
+    return
+  }
+
+  const user = req.user
+  const roomId = req.params.id
+  const room = await DB.getRoomById(roomId)
+
+  if (!room) {
+    sendError(res, 404, 'ROOM_NOT_FOUND', `Room ${roomId} does not exist`)
+    return
+  }
+
+  if (room.owner !== user.username) {
+    sendError(res, 403, 'NOT_OWNER', 'User is not owner of room')
+    return
+  }
+
+  if (room.state !== 'open') {
+    sendRoomNotOpen(res, room)
+    return
+  }
+
+  const target = findParticipant(room, req.body.username)
+  if (!target) {
+    sendError(res, 404, 'PARTICIPANT_NOT_FOUND', `User ${req.body.username} is not a participant in room`)
+    return
+  }
+
+  if (target === room.owner) {
+    sendError(res, 409, 'OWNER_CANNOT_LEAVE', 'Owner cannot kick themselves')
+    return
+  }
+
+  if (await DB.removeParticipantFromRoom(roomId, target, room.version ?? 0)) {
+    broadcastToRoom(roomId, { type: 'kicked', username: target })
+    unsubscribeUser(roomId, target)
+    await broadcastParticipant(roomId, 'participant-left', target, { kicked: true })
+    scheduleTally(roomId)
+    await maybeAutoClose(roomId)
+    res.status(204).end()
+    return
+  }
+  sendRoomModified(res)
+})
+
+secureApiRouter.post('/room/:id/transfer', jsonBody('newOwner'), async (req, res) => {
+  if (!req.body.newOwner) {
+    sendError(res, 400, 'MISSING_FIELD', 'Missing newOwner')
+    return
+  }
+
+  const user = req.user
+  const roomId = req.params.id
+  const room = await DB.getRoomById(roomId)
+
+  if (!room) {
+    sendError(res, 404, 'ROOM_NOT_FOUND', `Room ${roomId} does not exist`)
+    return
+  }
+
+  if (room.owner !== user.username) {
+    sendError(res, 403, 'NOT_OWNER', 'User is not owner of room')
+    return
+  }
+
+  if (room.state !== 'open') {
+    sendRoomNotOpen(res, room)
+    return
+  }
+
+  const newOwner = findParticipant(room, req.body.newOwner)
+  if (!newOwner) {
+    sendError(res, 404, 'PARTICIPANT_NOT_FOUND', `User ${req.body.newOwner} is not a participant in room`)
+    return
+  }
+
+  if (await DB.setRoomOwner(roomId, user.username, newOwner, room.version ?? 0)) {
+    broadcastToRoom(roomId, { type: 'owner-changed', owner: newOwner })
+    res.status(200).send({ owner: newOwner, isOwner: newOwner === user.username })
+    return
+  }
+  sendRoomModified(res)
+})
+
+secureApiRouter.post('/room/:id/extend', jsonBody('hours'), async (req, res) => {
+  const hours = req.body.hours ?? defaultExtendHours
+  if (!Number.isInteger(hours) || hours < 1 || hours > maxExtendHours) {
+    sendError(res, 400, 'INVALID_FIELD', `hours must be an integer between 1 and ${maxExtendHours}`)
+    return
+  }
+
+  const user = req.user
+  const roomId = req.params.id
+  const room = await DB.getRoomById(roomId)
+
+  if (!room) {
+    sendError(res, 404, 'ROOM_NOT_FOUND', `Room ${roomId} does not exist`)
+    return
+  }
+
+  if (room.owner !== user.username) {
+    sendError(res, 403, 'NOT_OWNER', 'User is not owner of room')
+    return
+  }
+
+  if (isExpired(room)) {
+    sendError(res, 410, 'ROOM_EXPIRED', 'Room has expired')
+    return
+  }
+
+  if (!isEditable(room)) {
+    sendRoomNotOpen(res, room)
+    return
+  }
+
+  const expiresAt = new Date(Math.max(Date.now(), room.expiresAt?.getTime() ?? 0) + hours * 60 * 60 * 1000)
+  if (await DB.extendRoom(roomId, expiresAt, room.version ?? 0)) {
+    res.status(200).send({ expiresAt })
+    return
+  }
+  sendRoomModified(res)
+})
+
+function canViewResult(result, username) {
+  // results created before participants were recorded are owner-only
+  const participants = result.participants ?? [result.owner]
+  return result.owner === username || participants.includes(username) || (result.spectators ?? []).includes(username)
+}
+
+secureApiRouter.get('/results/:id/export', async (req, res) => {
+  const format = req.query.format ?? 'csv'
+  if (format !== 'csv' && format !== 'json') {
+    sendError(res, 400, 'INVALID_FIELD', 'format must be csv or json')
+    return
+  }
+
+  const user = req.user
+  const resultsId = req.params.id
+  const result = await DB.getResult(resultsId)
+
+  if (!result) {
+    sendError(res, 404, 'RESULT_NOT_FOUND', `Result does not exist`)
+    return
+  }
+
+  if (!canViewResult(result, user.username)) {
+    sendError(res, 403, 'NOT_PARTICIPANT', 'User was not a participant in room')
+    return
+  }
+
+  if (result.visible === false && result.owner !== user.username) {
+    sendError(res, 403, 'RESULTS_HIDDEN', 'The owner has not revealed the results yet')
+    return
+  }
+
+  const totals = new Map((result.totals ?? []).map(t => [t.option, t.total]))
+  // results from before breakdowns were recorded only have totals
+  const breakdowns = new Map((result.breakdown ?? []).map(b => [b.option, b]))
+  const rows = result.sortedOptions.map((option, i) => ({
+    option,
+    totalScore: totals.get(option) ?? 0,
+    rank: i + 1,
+    voters: breakdowns.get(option)?.voters,
+    mean: breakdowns.get(option)?.mean,
+    stdDev: breakdowns.get(option)?.stdDev,
+    histogram: breakdowns.get(option)?.histogram
+  }))
+
+  res.set('Content-Disposition', `attachment; filename="results-${resultsId}.${format}"`)
+  if (format === 'json') {
+    res.status(200).send({ results: rows })
+    return
+  }
+  res.status(200).type('text/csv').send(toCsv(
+    ['option', 'totalScore', 'rank', 'voters', 'mean', 'stdDev', 'histogram'],
+    rows.map(row => [
+      row.option,
+      row.totalScore,
+      row.rank,
+      row.voters ?? '',
+      row.mean === undefined ? '' : Math.round(row.mean * 100) / 100,
+      row.stdDev === undefined ? '' : Math.round(row.stdDev * 100) / 100,
+      // score:count pairs, e.g. "3:1 5:2"
+      row.histogram?.map(h => `${h.score}:${h.count}`).join(' ') ?? ''
+    ])
+  ))
+})
+
+// Tallies made up ballots the way a room would, without touching any room,
+// to see what each voting method makes of them.
+secureApiRouter.post('/tally/simulate', jsonBody('options', 'ballots', 'method', 'tieBreak', 'winnerCount', 'seed'), async (req, res) => {
+  const { options, ballots } = req.body
+  if (!Array.isArray(options) || options.length === 0 || options.length > maxSimulatedOptions ||
+    !options.every(opt => typeof opt === 'string' && opt !== '') || new Set(options).size !== options.length) {
+    sendError(res, 400, 'INVALID_FIELD', `options must be a list of 1 to ${maxSimulatedOptions} distinct names`)
+    return
+  }
+  if (!Array.isArray(ballots) || ballots.length > maxSimulatedBallots) {
+    sendError(res, 400, 'INVALID_FIELD', `ballots must be a list of at most ${maxSimulatedBallots} score maps`)
+    return
+  }
+  if (req.body.seed !== undefined && (!Number.isInteger(req.body.seed) || req.body.seed < 0)) {
+    sendError(res, 400, 'INVALID_FIELD', 'seed must be a non-negative integer')
+    return
+  }
+
+  const settings = {
+    votingMethod: req.body.method ?? 'score',
+    ...req.body.tieBreak !== undefined && { tieBreak: req.body.tieBreak },
+    ...req.body.winnerCount !== undefined && { winnerCount: req.body.winnerCount }
+  }
+  const invalidSetting = validateSettings(settings)
+  if (invalidSetting) {
+    sendError(res, 400, 'INVALID_FIELD', invalidSetting)
+    return
+  }
+
+  const room = {
+    ...settings,
+    options,
+    // ballots are numbered, since only their scores matter here
+    votes: ballots.map((votes, i) => ({ username: `voter-${i + 1}`, votes }))
+  }
+  for (const [i, ballot] of ballots.entries()) {
+    const invalid = validateVotes(room, ballot)
+    if (invalid) {
+      sendError(res, 400, 'INVALID_VOTES', `Ballot ${i + 1}: ${invalid}`)
+      return
+    }
+  }
+
+  const seed = room.tieBreak === 'random-seeded' ? req.body.seed ?? randomSeed() : undefined
+  const { sortedOptions, totals, details } = tallyRoom(room, seed)
+  res.status(200).send(toResultResponse({
+    sortedOptions,
+    totals: sortedOptions.map(option => ({ option, total: totals.get(option) ?? 0 })),
+    ...details
+  }))
+})
+
+// Merges several results of the same poll, run in different rooms, into one
+// table and a combined ranking.
+secureApiRouter.post('/results/compare', jsonBody('ids'), async (req, res) => {
+  const requested = req.body.ids
+  if (!Array.isArray(requested) || requested.length === 0) {
+    sendError(res, 400, 'MISSING_FIELD', 'Missing ids')
+    return
+  }
+  if (requested.length > maxComparedResults) {
+    sendError(res, 400, 'INVALID_FIELD', `At most ${maxComparedResults} results can be compared at once`)
+    return
+  }
+  if (!requested.every(id => typeof id === 'string')) {
+    sendError(res, 400, 'INVALID_FIELD', 'ids must be a list of result ids')
+    return
+  }
+
+  const user = req.user
+  const ids = [...new Set(requested)]
+  const results = await Promise.all(ids.map(id => DB.getResult(id)))
+
+  const missing = ids.filter((_id, i) => !results[i])
+  if (missing.length > 0) {
+    sendError(res, 404, 'RESULT_NOT_FOUND', `Result(s) do not exist: ${missing.join(', ')}`)
+    return
+  }
+
+  const forbidden = ids.filter((_id, i) => !canViewResult(results[i], user.username))
+  if (forbidden.length > 0) {
+    sendError(res, 403, 'NOT_PARTICIPANT', `User was not a participant in result(s): ${forbidden.join(', ')}`)
+    return
+  }
+
+  const hidden = ids.filter((_id, i) => results[i].visible === false && results[i].owner !== user.username)
+  if (hidden.length > 0) {
+    sendError(res, 403, 'RESULTS_HIDDEN', `The owner has not revealed result(s): ${hidden.join(', ')}`)
+    return
+  }
+
+  res.status(200).send(compareResults(results))
+})
+
+secureApiRouter.get('/results/:id', async (req, res) => {
+  const user = req.user
+  const resultsId = req.params.id
+  const result = await DB.getResult(resultsId)
+
+  if (!result) {
+    sendError(res, 404, 'RESULT_NOT_FOUND', `Result does not exist`)
+    return
+  }
+
+  if (!canViewResult(result, user.username)) {
+    sendError(res, 403, 'NOT_PARTICIPANT', 'User was not a participant in room')
+    return
+  }
+
+  if (result.visible === false && result.owner !== user.username) {
+    sendError(res, 403, 'RESULTS_HIDDEN', 'The owner has not revealed the results yet')
+    return
+  }
+
+  res.status(200).send(toResultResponse(result, user.username))
+})
+
+// Shows a hidden result to everyone who took part.
+secureApiRouter.post('/results/:id/reveal', jsonBody(), async (req, res) => {
+  const user = req.user
+  const resultsId = req.params.id
+  const result = await DB.getResult(resultsId)
+
+  if (!result) {
+    sendError(res, 404, 'RESULT_NOT_FOUND', `Result does not exist`)
+    return
+  }
+
+  if (result.owner !== user.username) {
+    sendError(res, 403, 'NOT_OWNER', 'User is not owner of room')
+    return
+  }
+
+  if (result.visible !== false) {
+    res.status(200).send({ visible: true })
+    return
+  }
+
+  if (await DB.revealResult(resultsId)) {
+    res.status(200).send({ visible: true })
+    return
+  }
+  sendError(res, 404, 'RESULT_NOT_FOUND', `Result does not exist`)
+})
+
+secureApiRouter.get('/history', async (req, res) => {
+  const user = req.user
+
+  const history = await DB.getHistory(user.username)
+
+  res.status(200).send({ history })
+})
+
+app.use(errorHandler({ maxBodySize }))
+
+// Read once at startup so serving the app never depends on the disk. Null
+// when there's no build yet, e.g. while vite serves the front end itself.
+function loadIndexHtml() {
+  try {
+    return fs.readFileSync(path.join(publicDir, 'index.html'), 'utf8')
+  } catch (ex) {
+    console.warn(`could not load index.html from ${publicDir}: ${ex.message}`)
+    return null
+  }
+}
+
+let indexHtml = loadIndexHtml()
+
+app.use((_req, res) => {
+  if (reloadPages) {
+    indexHtml = loadIndexHtml()
+  }
+  if (indexHtml === null) {
+    sendError(res, 404, 'NOT_FOUND', 'Page not found')
+    return
+  }
+  res.type('html').send(indexHtml)
+});
+
+function setAuthCookie(res, authToken) {
+  res.cookie(authCookieName, authToken, {
+    secure: true,
+    httpOnly: true,
+    // a front end on another site only gets the cookie back if it's allowed cross site
+    sameSite: corsCredentials ? 'none' : 'strict',
+  });
+}
+
+const httpService = app.listen(port, () => {
+  console.log(`Listening on port ${port}`);
+});
+
+const wsProxy = peerProxy(httpService, { origins: corsOrigins });
+
+const deadlineSweep = startDeadlineSweep(config.deadlineSweepMs)
+
+// On deploy, stop taking new connections, let in-flight requests finish and
+// tell live clients we're going, then close the database. Anything still
+// running after the grace period is cut off.
+const { shutdownGraceMs } = config
+
+let shuttingDown = false
+async function shutdown(signal) {
+  if (shuttingDown) {
+    return
+  }
+  shuttingDown = true
+  console.log(`${signal} received, shutting down`)
+  setTimeout(() => {
+    console.error(`shutdown took longer than ${shutdownGraceMs}ms, exiting`)
+    process.exit(1)
+  }, shutdownGraceMs).unref()
+
+  const serverClosed = new Promise(resolve => httpService.close(resolve))
+  deadlineSweep.stop()
+  wsProxy.close()
+  closeAll()
+  httpService.closeIdleConnections()
+  await serverClosed
+  await DB.close()
+  process.exit(0)
+}
 
-peerProxy(httpService);
+process.on('SIGINT', () => shutdown('SIGINT'))
+process.on('SIGTERM', () => shutdown('SIGTERM'))
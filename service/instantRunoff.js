@@ -0,0 +1,45 @@
+// Each ballot ranks the options the user gave a positive score, highest first.
+// Options with a zero or missing score are unranked, so a ballot is exhausted
+// once all of its ranked options have been eliminated.
+function rankBallot(userVotes, options) {
+  return options
+    .filter(opt => (userVotes[opt] ?? 0) > 0)
+    .sort((a, b) => userVotes[b] - userVotes[a])
+}
+
+function instantRunoff(votes, options, compareTies) {
+  const ballots = votes.map(v => rankBallot(v.votes, options))
+  const totalScores = new Map(options.map(opt => [opt, 0]))
+  votes.forEach(v => {
+    options.forEach(opt => totalScores.set(opt, totalScores.get(opt) + (v.votes[opt] ?? 0) * (v.weight ?? 1)))
+  })
+
+  let remaining = [...options]
+  const eliminated = []
+
+  while (remaining.length > 1) {
+    const firstChoices = new Map(remaining.map(opt => [opt, 0]))
+    ballots.forEach((ballot, i) => {
+      const choice = ballot.find(opt => firstChoices.has(opt))
+      if (choice !== undefined) {
+        firstChoices.set(choice, firstChoices.get(choice) + (votes[i].weight ?? 1))
+      }
+    })
+
+    // eliminate the option with the fewest first choices; ties go to the
+    // lower total score, and then to whichever loses the room's tie break
+    const loser = remaining.reduce((worst, opt) => {
+      const diff = firstChoices.get(opt) - firstChoices.get(worst) ||
+        totalScores.get(opt) - totalScores.get(worst) ||
+        compareTies(worst, opt)
+      return diff < 0 ? opt : worst
+    })
+
+    remaining = remaining.filter(opt => opt !== loser)
+    eliminated.push(loser)
+  }
+
+  return [...remaining, ...eliminated.reverse()]
+}
+
+module.exports = { instantRunoff };
@@ -0,0 +1,134 @@
+// A small Prometheus registry: counters and histograms with labels, rendered
+// in the text exposition format for /metrics.
+
+const defaultBuckets = [0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10]
+
+function labelKey(labels) {
+  return JSON.stringify(Object.entries(labels).sort(([a], [b]) => a.localeCompare(b)))
+}
+
+function formatLabels(labels) {
+  const entries = Object.entries(labels)
+  if (entries.length === 0) {
+    return ''
+  }
+  const escape = value => String(value).replace(/\\/g, '\\\\').replace(/\n/g, '\\n').replace(/"/g, '\\"')
+  return `{${entries.map(([name, value]) => `${name}="${escape(value)}"`).join(',')}}`
+}
+
+class Counter {
+  constructor(name, help) {
+    this.name = name
+    this.help = help
+    this.values = new Map()
+  }
+
+  inc(labels = {}, amount = 1) {
+    const key = labelKey(labels)
+    const current = this.values.get(key) ?? { labels, value: 0 }
+    current.value += amount
+    this.values.set(key, current)
+  }
+
+  get(labels = {}) {
+    return this.values.get(labelKey(labels))?.value ?? 0
+  }
+
+  render() {
+    const lines = [`# HELP ${this.name} ${this.help}`, `# TYPE ${this.name} counter`]
+    this.values.forEach(({ labels, value }) => lines.push(`${this.name}${formatLabels(labels)} ${value}`))
+    return lines.join('\n')
+  }
+}
+
+class Histogram {
+  constructor(name, help, buckets = defaultBuckets) {
+    this.name = name
+    this.help = help
+    this.buckets = buckets
+    this.values = new Map()
+  }
+
+  observe(labels, value) {
+    const key = labelKey(labels)
+    const current = this.values.get(key) ?? { labels, counts: this.buckets.map(() => 0), sum: 0, count: 0 }
+    this.buckets.forEach((bound, i) => {
+      if (value <= bound) {
+        current.counts[i] += 1
+      }
+    })
+    current.sum += value
+    current.count += 1
+    this.values.set(key, current)
+  }
+
+  render() {
+    const lines = [`# HELP ${this.name} ${this.help}`, `# TYPE ${this.name} histogram`]
+    this.values.forEach(({ labels, counts, sum, count }) => {
+      this.buckets.forEach((bound, i) => {
+        lines.push(`${this.name}_bucket${formatLabels({ ...labels, le: bound })} ${counts[i]}`)
+      })
+      lines.push(`${this.name}_bucket${formatLabels({ ...labels, le: '+Inf' })} ${count}`)
+      lines.push(`${this.name}_sum${formatLabels(labels)} ${sum}`)
+      lines.push(`${this.name}_count${formatLabels(labels)} ${count}`)
+    })
+    return lines.join('\n')
+  }
+}
+
+// Metrics are created on first use and looked up by name after that, so
+// every caller naming the same metric shares it.
+class Registry {
+  constructor() {
+    this.metrics = new Map()
+  }
+
+  counter(name, help) {
+    return this.getOrCreate(name, () => new Counter(name, help))
+  }
+
+  histogram(name, help, buckets) {
+    return this.getOrCreate(name, () => new Histogram(name, help, buckets))
+  }
+
+  getOrCreate(name, create) {
+    if (!this.metrics.has(name)) {
+      this.metrics.set(name, create())
+    }
+    return this.metrics.get(name)
+  }
+
+  render() {
+    return [...this.metrics.values()].map(metric => metric.render()).join('\n\n') + '\n'
+  }
+}
+
+// The registry everything records to. Swapping it out lets a test start from
+// zero and look at exactly what it caused.
+let registry = new Registry()
+
+function getRegistry() {
+  return registry
+}
+
+function setRegistry(newRegistry) {
+  registry = newRegistry
+}
+
+// Times every request, labelled by the route that handled it rather than the
+// raw path, so ids don't turn into a metric each.
+function requestMetrics() {
+  return (req, res, next) => {
+    const start = process.hrtime.bigint()
+    res.on('finish', () => {
+      const seconds = Number(process.hrtime.bigint() - start) / 1e9
+      const route = req.route ? `${req.baseUrl}${req.route.path}` : 'unmatched'
+      registry
+        .histogram('http_request_duration_seconds', 'Time taken to handle HTTP requests')
+        .observe({ method: req.method, route, status: res.statusCode }, seconds)
+    })
+    next()
+  }
+}
+
+module.exports = { Registry, getRegistry, setRegistry, requestMetrics };
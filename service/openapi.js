@@ -0,0 +1,373 @@
+const { version } = require('./package.json')
+const { settingsSchema } = require('./roomSettings.js')
+
+function ref(name) {
+  return { $ref: `#/components/schemas/${name}` }
+}
+
+function json(schema) {
+  return { content: { 'application/json': { schema } } }
+}
+
+function ok(description, schema) {
+  return { description, ...(schema && json(schema)) }
+}
+
+const scoreMap = {
+  type: 'object',
+  description: 'option -> score',
+  additionalProperties: { type: 'integer' }
+}
+
+const commentMap = {
+  type: 'object',
+  description: 'option -> a short note on it',
+  additionalProperties: { type: 'string', maxLength: 280 }
+}
+
+const totals = {
+  type: 'array',
+  items: {
+    type: 'object',
+    properties: {
+      option: { type: 'string' },
+      total: { type: 'number' },
+      rank: { type: 'integer' },
+      isWinner: { type: 'boolean' }
+    }
+  }
+}
+
+const schemas = {
+  Error: {
+    type: 'object',
+    description: 'What every endpoint answers with when a request fails. Clients branch on code, which is stable.',
+    properties: {
+      error: {
+        type: 'object',
+        properties: {
+          code: { type: 'string', example: 'ROOM_NOT_FOUND' },
+          message: { type: 'string', example: 'Room 123 does not exist' }
+        },
+        required: ['code', 'message']
+      }
+    },
+    required: ['error']
+  },
+  RoomSettings: settingsSchema(),
+  NewRoom: {
+    allOf: [
+      ref('RoomSettings'),
+      {
+        type: 'object',
+        properties: {
+          password: { type: 'string', description: 'needed to join, if given' },
+          code: { type: 'string', description: 'a custom room code' },
+          draft: { type: 'boolean', default: false, description: "can't be joined until published" }
+        }
+      }
+    ]
+  },
+  CreatedRoom: {
+    type: 'object',
+    properties: {
+      id: { type: 'string' },
+      code: { type: 'string' },
+      joinUrl: { type: 'string', format: 'uri' },
+      avatarStyle: { type: 'string' }
+    }
+  },
+  RoomSummary: {
+    type: 'object',
+    description: "What anyone can see of an open room before they've joined",
+    properties: {
+      code: { type: 'string' },
+      owner: { type: 'string' },
+      participantCount: { type: 'integer' },
+      maxParticipants: { type: 'integer' },
+      state: { type: 'string' },
+      hasPassword: { type: 'boolean' }
+    }
+  },
+  RoomResponse: {
+    description: "A room as the caller sees it. Other participants' notes, the weights and the webhook " +
+      'are left out for anyone but the owner.',
+    allOf: [
+      ref('RoomSettings'),
+      {
+        type: 'object',
+        properties: {
+          _id: { type: 'string' },
+          code: { type: 'string' },
+          owner: { type: 'string' },
+          state: { type: 'string', enum: ['draft', 'open', 'closed'] },
+          options: { type: 'array', items: { type: 'string' }, description: 'in the order the caller sees them' },
+          optionDetails: { type: 'object', additionalProperties: { type: 'object' } },
+          pinnedOptions: { type: 'array', items: { type: 'string' } },
+          participants: { type: 'array', items: { type: 'string' } },
+          votes: {
+            type: 'array',
+            items: {
+              type: 'object',
+              properties: {
+                username: { type: 'string' },
+                votes: scoreMap,
+                comments: commentMap,
+                updatedAt: { type: 'string', format: 'date-time' }
+              }
+            }
+          },
+          lockedIn: { type: 'array', items: { type: 'string' } },
+          lockIns: {
+            type: 'array',
+            items: {
+              type: 'object',
+              properties: { username: { type: 'string' }, at: { type: 'string', format: 'date-time' } }
+            }
+          },
+          reactions: { type: 'object', description: 'option -> emoji -> count' },
+          myReactions: { type: 'object', additionalProperties: { type: 'string' } },
+          isOwner: { type: 'boolean' },
+          isSpectator: { type: 'boolean' },
+          lockedInCount: { type: 'integer' },
+          participantCount: { type: 'integer' },
+          spectators: { type: 'array', items: { type: 'string' } },
+          spectatorCount: { type: 'integer' },
+          version: { type: 'integer', description: 'moves on with every change to the room' },
+          hasPassword: { type: 'boolean' },
+          closesInMs: { type: 'integer', nullable: true }
+        }
+      }
+    ]
+  },
+  Ballot: {
+    type: 'object',
+    properties: { votes: scoreMap, comments: commentMap }
+  },
+  LockIn: {
+    type: 'object',
+    properties: {
+      resultsId: { type: 'string', description: "the result's id if locking in closed the room, otherwise empty" },
+      isOwner: { type: 'boolean' }
+    }
+  },
+  Tally: {
+    type: 'object',
+    description: 'The standings so far in an open room',
+    properties: {
+      results: { type: 'array', items: { type: 'string' } },
+      totals,
+      ties: { type: 'array', items: { type: 'array', items: { type: 'string' } } },
+      lockedInCount: { type: 'integer' },
+      participantCount: { type: 'integer' }
+    }
+  },
+  ResultResponse: {
+    type: 'object',
+    properties: {
+      id: { type: 'string' },
+      visible: { type: 'boolean' },
+      results: { type: 'array', items: { type: 'string' }, description: 'every option, best first' },
+      totals,
+      ties: { type: 'array', items: { type: 'array', items: { type: 'string' } } },
+      tieBreak: { type: 'string' },
+      tieBreakSeed: { type: 'integer' },
+      winnerCount: { type: 'integer' },
+      winners: { type: 'array', items: { type: 'string' } },
+      winnerOverflow: { type: 'integer' },
+      closedAt: { type: 'string', format: 'date-time' },
+      voteTimes: { type: 'array', items: { type: 'object' } },
+      breakdown: { type: 'array', items: { type: 'object' } },
+      pairwise: { type: 'object' },
+      condorcetWinner: { type: 'string', nullable: true },
+      bordaTotals: {
+        type: 'array',
+        items: { type: 'object', properties: { option: { type: 'string' }, points: { type: 'number' } } }
+      },
+      comments: { type: 'array', items: { type: 'object' } }
+    }
+  },
+  ClosedRoom: {
+    type: 'object',
+    properties: {
+      resultsId: { type: 'string' },
+      resultsVisible: { type: 'boolean' },
+      result: ref('ResultResponse'),
+      warning: { type: 'string', description: 'set when the room closed short of its quorum' }
+    }
+  },
+  Comparison: {
+    type: 'object',
+    properties: {
+      results: { type: 'array', items: { type: 'object' } },
+      table: {
+        type: 'array',
+        items: {
+          type: 'object',
+          properties: {
+            option: { type: 'string' },
+            scores: { type: 'object', additionalProperties: { type: 'number' } },
+            combined: { type: 'number' }
+          }
+        }
+      },
+      ranking: { type: 'array', items: { type: 'object' } }
+    }
+  },
+  Simulation: {
+    type: 'object',
+    required: ['options', 'ballots'],
+    properties: {
+      options: { type: 'array', items: { type: 'string' } },
+      ballots: { type: 'array', items: scoreMap },
+      method: { type: 'string' },
+      tieBreak: { type: 'string' },
+      winnerCount: { type: 'integer' },
+      seed: { type: 'integer', minimum: 0 }
+    }
+  }
+}
+
+// What's known about the room, vote and result endpoints beyond their path
+// and method, by "method path" as the path appears in the document.
+const operations = {
+  'post /room': {
+    summary: 'Create a room',
+    requestBody: json(ref('NewRoom')),
+    responses: { 201: ok('The new room', ref('CreatedRoom')) }
+  },
+  'get /room/{id}': {
+    summary: 'Get a room',
+    responses: { 200: ok('The room', ref('RoomResponse')), 304: ok("The caller's copy is current") }
+  },
+  'get /room/by-code/{code}': {
+    summary: 'Look up an open room by its code',
+    responses: { 200: ok('The room', ref('RoomSummary')) }
+  },
+  'post /room/{code}/join': {
+    summary: 'Join a room',
+    requestBody: json({ type: 'object', properties: { password: { type: 'string' } } }),
+    responses: { 200: ok('Joined', { type: 'object', properties: { id: { type: 'string' } } }) }
+  },
+  'get /room/{id}/settings': {
+    summary: "Get a room's settings",
+    responses: { 200: ok('The settings', ref('RoomSettings')) }
+  },
+  'patch /room/{id}/settings': {
+    summary: "Change a room's settings",
+    requestBody: json(ref('RoomSettings')),
+    responses: { 200: ok('The settings after the change', ref('RoomSettings')) }
+  },
+  'get /room/{id}/tally': {
+    summary: 'Get the standings so far',
+    responses: { 200: ok('The standings', ref('Tally')) }
+  },
+  'post /room/{id}/vote': {
+    summary: "Save the caller's ballot",
+    requestBody: json(ref('Ballot')),
+    responses: { 200: ok('The saved ballot', ref('Ballot')) }
+  },
+  'post /room/{id}/lockin': {
+    summary: "Lock in the caller's ballot",
+    description: 'Saves the ballot first if one is given; otherwise locks in the one already saved.',
+    requestBody: json(ref('Ballot')),
+    responses: { 200: ok('Locked in', ref('LockIn')) }
+  },
+  'post /room/{id}/unlock': {
+    summary: "Unlock the caller's ballot so it can be changed",
+    responses: { 204: ok('Unlocked') }
+  },
+  'post /room/{id}/close': {
+    summary: 'Close a room and publish its result',
+    responses: { 200: ok('The result', ref('ClosedRoom')) }
+  },
+  'get /results/{id}': {
+    summary: 'Get a result',
+    responses: { 200: ok('The result', ref('ResultResponse')) }
+  },
+  'post /results/{id}/reveal': {
+    summary: 'Show a hidden result to everyone who took part',
+    responses: { 200: ok('Revealed', { type: 'object', properties: { visible: { type: 'boolean' } } }) }
+  },
+  'post /results/compare': {
+    summary: 'Compare several results option by option',
+    requestBody: json({ type: 'object', required: ['ids'], properties: { ids: { type: 'array', items: { type: 'string' } } } }),
+    responses: { 200: ok('The comparison', ref('Comparison')) }
+  },
+  'post /tally/simulate': {
+    summary: 'Tally hypothetical ballots without saving anything',
+    requestBody: json(ref('Simulation')),
+    responses: { 200: ok('What the result would be', ref('ResultResponse')) }
+  }
+}
+
+// Every route registered directly on router. Routers mounted on it are
+// wrapped by asyncRouter, which hides their routes, so they're walked
+// separately.
+function routesOf(router, secure) {
+  return router.stack.filter(layer => layer.route).flatMap(layer =>
+    Object.keys(layer.route.methods)
+      .filter(method => method !== '_all')
+      .map(method => ({ method, path: layer.route.path, secure })))
+}
+
+// "/avatar/:seed?" into the OpenAPI paths it stands for: "/avatar" and
+// "/avatar/{seed}".
+function openApiPaths(path) {
+  const full = path.replace(/:(\w+)\??/g, '{$1}')
+  return /:\w+\?$/.test(path) ? [full, path.replace(/\/:\w+\?$/, '') || '/'] : [full]
+}
+
+function parameters(path) {
+  return [...path.matchAll(/\{(\w+)\}/g)].map(([, name]) => ({
+    name,
+    in: 'path',
+    required: true,
+    schema: { type: 'string' }
+  }))
+}
+
+// An OpenAPI 3 description of the API served by router and secured, the
+// router mounted on it that requires a logged in user. Paths come from the
+// routes themselves, so none are missed; the ones in operations are
+// described in full.
+function openApiDocument(router, secured) {
+  const paths = {}
+  for (const route of [...routesOf(router, false), ...routesOf(secured, true)]) {
+    for (const path of openApiPaths(route.path)) {
+      const known = operations[`${route.method} ${path}`] ?? {}
+      const operation = {
+        summary: known.summary ?? `${route.method.toUpperCase()} ${path}`,
+        ...(known.description && { description: known.description }),
+        ...(route.secure && { security: [{ cookieAuth: [] }] }),
+        ...(parameters(path).length > 0 && { parameters: parameters(path) }),
+        ...(known.requestBody && { requestBody: known.requestBody }),
+        responses: {
+          ...(known.responses ?? { 200: ok('Success') }),
+          ...(route.secure && { 401: { $ref: '#/components/responses/Unauthorized' } }),
+          default: { $ref: '#/components/responses/Error' }
+        }
+      }
+      paths[path] = { ...paths[path], [route.method]: operation }
+    }
+  }
+
+  return {
+    openapi: '3.0.3',
+    info: { title: 'QuikVote API', version },
+    servers: [{ url: '/api' }],
+    paths,
+    components: {
+      schemas,
+      responses: {
+        Error: ok('The request failed', ref('Error')),
+        Unauthorized: ok('The caller is not logged in', ref('Error'))
+      },
+      securitySchemes: {
+        cookieAuth: { type: 'apiKey', in: 'cookie', name: 'token' }
+      }
+    }
+  }
+}
+
+module.exports = { openApiDocument };
@@ -1,6 +1,11 @@
 const DB = require('./database.js');
 const { WebSocketServer } = require('ws');
-const { calculateVoteResult } = require('./calculateVoteResult.js')
+const { closeRoomWithResult, maybeAutoClose, lockInsNeeded } = require('./closeRoom.js')
+const { validateVotes, cleanComments, unscoredOptions } = require('./validateVotes.js')
+const { normalizeOptionName, validateNewOption, validateOptionDetails } = require('./validateOption.js')
+const { subscribe, unsubscribe, onlineUsers, broadcastToRoom, broadcastLockIn } = require('./roomHub.js')
+const { toRoomResponse } = require('./roomResponse.js')
+const { isAllowedOrigin } = require('./cors.js')
 const uuid = require('uuid');
 
 const authCookieName = 'token';
@@ -19,12 +24,22 @@ async function authenticate(request, next) {
   }
 }
 
-function peerProxy(httpServer) {
+// Browsers send the auth cookie with a websocket from any page, and the
+// upgrade isn't covered by CORS, so only origins the API accepts may open one.
+// Clients that aren't browsers send no Origin and are let through.
+function peerProxy(httpServer, { origins = [] } = {}) {
   const wss = new WebSocketServer({ noServer: true });
 
   httpServer.on('upgrade', (request, socket, head) => {
     socket.on('error', onSocketError)
 
+    const origin = request.headers.origin
+    if (origin && !isAllowedOrigin(origin, request.headers.host, origins)) {
+      socket.write('HTTP/1.1 403 Forbidden\r\n\r\n');
+      socket.destroy();
+      return;
+    }
+
     authenticate(request, function next(err, user) {
       if (err || !user) {
         socket.write('HTTP/1.1 401 Unauthorized\r\n\r\n');
@@ -43,23 +58,31 @@ function peerProxy(httpServer) {
   let connections = [];
 
   wss.on('connection', (ws, _request, user) => {
-    const connection = { id: uuid.v4(), alive: true, ws: ws, user: user.username };
+    const connection = { id: uuid.v4(), alive: true, ws: ws, user: user.username, send: (msg) => ws.send(msg) };
     connections.push(connection);
 
-    // Forward messages to everyone except the sender
     ws.on('message', async function message(data) {
-      const dataParsed = JSON.parse(data)
-      console.log(`Recieved ws message from ${connection.user}: ${JSON.stringify(dataParsed, undefined, 4)}`)
-      if (dataParsed.type == 'new_option') {
-        handleNewOption(dataParsed, connection, connections)
-      } else if (dataParsed.type == 'lock_in') {
-        handleLockIn(dataParsed, connection, connections)
-      } else if (dataParsed.type == 'close_room') {
-        handleCloseRoom(dataParsed, connection, connections)
+      // a bad message or a database failure shouldn't take the server down
+      try {
+        const dataParsed = JSON.parse(data)
+        console.log(`Recieved ws message from ${connection.user}: ${JSON.stringify(dataParsed, undefined, 4)}`)
+        if (dataParsed.type == 'subscribe') {
+          await handleSubscribe(dataParsed, connection)
+        } else if (dataParsed.type == 'new_option') {
+          await handleNewOption(dataParsed, connection)
+        } else if (dataParsed.type == 'lock_in') {
+          await handleLockIn(dataParsed, connection)
+        } else if (dataParsed.type == 'close_room') {
+          await handleCloseRoom(dataParsed, connection)
+        }
+      } catch (ex) {
+        console.error(`failed to handle ws message from ${connection.user}: ${ex.stack}`)
       }
     });
 
     ws.on('close', () => {
+      unsubscribe(connection)
+
       const pos = connections.findIndex((o, i) => o.id === connection.id);
 
       if (pos >= 0) {
@@ -72,7 +95,7 @@ function peerProxy(httpServer) {
     });
   });
 
-  setInterval(() => {
+  const heartbeat = setInterval(() => {
     connections.forEach((c) => {
       if (!c.alive) {
         c.ws.terminate();
@@ -82,72 +105,144 @@ function peerProxy(httpServer) {
       }
     });
   }, 10000);
+
+  // Warns every client the server is going away, then closes their sockets
+  // with 1001 (going away) so they know to reconnect.
+  return {
+    close() {
+      clearInterval(heartbeat)
+      const message = JSON.stringify({ type: 'server-closing' })
+      connections.forEach((c) => {
+        c.ws.send(message)
+        c.ws.close(1001, 'server closing')
+      })
+      wss.close()
+    }
+  };
 }
 
-async function handleNewOption(event, connection, connections) {
+async function handleSubscribe(event, connection) {
   const room = await DB.getRoomById(event.room)
   if (!room) {
     console.warn(`no room with id ${event.room}`)
     return
   }
-  if (!room.state === 'open') {
-    console.warn('room is closed')
+  if (!room.participants.includes(connection.user) && !(room.spectators ?? []).includes(connection.user)) {
+    console.warn(`room does not include user ${connection.user}`)
     return
   }
-  if (!room.participants.includes(connection.user)) {
-    console.warn(`room does not include user ${connection.user}`)
+
+  subscribe(room._id, connection)
+  connection.ws.send(JSON.stringify({ type: 'room', room: toRoomResponse(room, connection.user), online: onlineUsers(room._id) }))
+}
+
+async function handleNewOption(event, connection) {
+  const room = await DB.getRoomById(event.room)
+  if (!room) {
+    console.warn(`no room with id ${event.room}`)
     return
   }
 
-  const newOption = event.option
-  if (room.options.map(opt => opt.toLowerCase()).includes(newOption.toLowerCase())) {
-    console.warn('room already includes option')
+  const newOption = normalizeOptionName(event.option)
+  const details = { description: event.description, imageUrl: event.imageUrl }
+  const invalid = validateNewOption(room, connection.user, newOption) ?? validateOptionDetails(details)
+  if (invalid) {
+    console.warn(invalid.msg)
     return
   }
 
-  if (await DB.addOptionToRoom(event.room, newOption)) {
-    connections.filter(c => room.participants.includes(c.user)).forEach((c) => {
-      c.ws.send(JSON.stringify({ type: 'options', options: [...room.options, newOption] }));
-    });
+  if (await DB.addOptionToRoom(event.room, newOption, connection.user, details, room.version ?? 0)) {
+    broadcastToRoom(room._id, {
+      type: 'options',
+      options: [...room.options, newOption],
+      details: { [newOption]: details }
+    })
+  } else {
+    console.warn(`room ${event.room} changed before option could be added`)
   }
 }
 
-async function handleLockIn(event, connection, connections) {
+// how many times a lock in is tried against a room that keeps changing
+// under it, e.g. while others are voting at the same moment
+const maxLockInAttempts = 3
+
+// Tells the client its lock in didn't go through, so it doesn't go on
+// showing the ballot as locked in.
+function rejectLockIn(connection, roomId, code, message) {
+  console.warn(message)
+  connection.send(JSON.stringify({ type: 'lock-in-failed', room: roomId, code, message }))
+}
+
+async function handleLockIn(event, connection, attempt = 1) {
   const user = connection.user
   const roomId = event.room
   const room = await DB.getRoomById(roomId)
 
   if (!room) {
-    console.warn(`no room with id ${event.room}`)
+    rejectLockIn(connection, roomId, 'ROOM_NOT_FOUND', `no room with id ${event.room}`)
     return
   }
 
-  if (!room.state === 'open') {
-    console.warn('room is closed')
+  if (room.state !== 'open') {
+    rejectLockIn(connection, roomId, 'ROOM_CLOSED', 'room is closed')
     return
   }
 
   if (!room.participants.includes(user)) {
-    console.warn(`room does not include user ${connection.user}`)
+    rejectLockIn(connection, roomId, 'NOT_PARTICIPANT', `room does not include user ${connection.user}`)
     return
   }
 
-  await DB.submitUserVotes(roomId, user, event.votes)
+  if (room.lockedIn?.includes(user)) {
+    rejectLockIn(connection, roomId, 'ALREADY_LOCKED_IN', `user ${user} has already locked in`)
+    return
+  }
 
-  const new_room = await DB.getRoomById(roomId)
-  if (new_room.votes.length == new_room.participants.length) {
-    // all users have voted
-    await DB.closeRoom(roomId)
+  if (event.votes) {
+    const invalid = validateVotes(room, event.votes)
+    if (invalid) {
+      rejectLockIn(connection, roomId, 'INVALID_VOTES', invalid)
+      return
+    }
+    const { comments, error } = event.comments === undefined ? {} : cleanComments(room, event.comments)
+    if (error) {
+      rejectLockIn(connection, roomId, 'INVALID_COMMENTS', error)
+      return
+    }
+    if (!await DB.updateUserVotes(roomId, user, event.votes, room.version ?? 0, comments)) {
+      // someone else changed the room since it was read; check the ballot
+      // against the room as it is now and try again
+      if (attempt < maxLockInAttempts) {
+        await handleLockIn(event, connection, attempt + 1)
+        return
+      }
+      rejectLockIn(connection, roomId, 'ROOM_MODIFIED', `room ${roomId} changed before votes could be saved`)
+      return
+    }
+  }
 
-    const sortedOptions = calculateVoteResult(new_room.votes)
-    const result = await DB.createResult(user, sortedOptions)
-    connections.filter(c => new_room.participants.includes(c.user)).forEach((c) => {
-      c.ws.send(JSON.stringify({ type: 'results-available', id: result._id }));
-    });
+  // an incomplete ballot is still saved, just not locked in
+  if (room.requireComplete) {
+    const ballot = event.votes ?? room.votes.find(v => v.username === user)?.votes
+    const unscored = unscoredOptions(room, ballot)
+    if (unscored.length > 0) {
+      rejectLockIn(connection, roomId, 'INCOMPLETE_BALLOT', `Every option must be scored; unscored: ${unscored.join(', ')}`)
+      return
+    }
   }
+
+  if (!await DB.lockInUser(roomId, user)) {
+    rejectLockIn(connection, roomId, 'NO_VOTES', `user ${user} has no recorded votes to lock in`)
+    return
+  }
+
+  connection.send(JSON.stringify({ type: 'lock-in-accepted', room: roomId }))
+  await broadcastLockIn(roomId, user)
+
+  await maybeAutoClose(roomId)
 }
 
-async function handleCloseRoom(event, connection, connections) {
+async function handleCloseRoom(event, connection) {
   const user = connection.user
   const roomId = event.room
   const room = await DB.getRoomById(roomId)
@@ -157,7 +252,7 @@ async function handleCloseRoom(event, connection, connections) {
     return
   }
 
-  if (!room.state === 'open') {
+  if (room.state !== 'open') {
     console.warn('room is closed')
     return
   }
@@ -167,13 +262,14 @@ async function handleCloseRoom(event, connection, connections) {
     return
   }
 
-  await DB.closeRoom(roomId)
+  if (lockInsNeeded(room) > 0) {
+    console.warn(`room ${roomId} needs ${lockInsNeeded(room)} more lock ins before it can close`)
+    return
+  }
 
-  const sortedOptions = calculateVoteResult(room.votes)
-  const result = await DB.createResult(user, sortedOptions)
-  connections.filter(c => room.participants.includes(c.user)).forEach((c) => {
-    c.ws.send(JSON.stringify({ type: 'results-available', id: result._id }));
-  });
+  if (!await closeRoomWithResult(room)) {
+    console.warn(`room ${roomId} changed before it could be closed`)
+  }
 }
 
 module.exports = { peerProxy };
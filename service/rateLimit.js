@@ -0,0 +1,45 @@
+const { sendError } = require('./errors.js')
+
+const sweepIntervalMs = 60 * 1000
+
+// Token bucket rate limiter. Each key can burst up to `capacity` requests and
+// then earns back `refillPerSecond` tokens a second. Buckets that have refilled
+// completely are forgotten, so idle users don't hold on to memory.
+function rateLimit({ capacity, refillPerSecond, keyFor }) {
+  const buckets = new Map()
+
+  function refill(bucket, now) {
+    const elapsedSeconds = (now - bucket.updatedAt) / 1000
+    bucket.tokens = Math.min(capacity, bucket.tokens + elapsedSeconds * refillPerSecond)
+    bucket.updatedAt = now
+  }
+
+  setInterval(() => {
+    const now = Date.now()
+    buckets.forEach((bucket, key) => {
+      refill(bucket, now)
+      if (bucket.tokens >= capacity) {
+        buckets.delete(key)
+      }
+    })
+  }, sweepIntervalMs).unref()
+
+  return (req, res, next) => {
+    const key = keyFor(req)
+    const now = Date.now()
+    const bucket = buckets.get(key) ?? { tokens: capacity, updatedAt: now }
+    refill(bucket, now)
+    buckets.set(key, bucket)
+
+    if (bucket.tokens < 1) {
+      const retryAfter = Math.ceil((1 - bucket.tokens) / refillPerSecond)
+      res.set('Retry-After', String(retryAfter))
+      sendError(res, 429, 'RATE_LIMITED', `Too many requests, retry in ${retryAfter}s`)
+      return
+    }
+    bucket.tokens -= 1
+    next()
+  }
+}
+
+module.exports = { rateLimit };
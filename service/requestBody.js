@@ -0,0 +1,52 @@
+const express = require('express');
+const { sendError } = require('./errors.js')
+
+// Rejects bodies that aren't a JSON object or that carry fields the endpoint
+// doesn't know about, so a typo'd setting isn't silently ignored.
+function jsonBody(...allowedFields) {
+  return (req, res, next) => {
+    if (typeof req.body !== 'object' || req.body === null || Array.isArray(req.body)) {
+      sendError(res, 400, 'INVALID_JSON', 'Request body must be a JSON object')
+      return
+    }
+    const unknown = Object.keys(req.body).filter(field => !allowedFields.includes(field))
+    if (unknown.length > 0) {
+      sendError(res, 400, 'UNKNOWN_FIELD', `Unknown field(s): ${unknown.join(', ')}`)
+      return
+    }
+    next()
+  }
+}
+
+// Like jsonBody, but plain HTML forms can post too. Empty form fields count
+// as left out, since browsers send every input whether it was filled in or
+// not. Bodies that are neither JSON nor a form get a 415.
+function jsonOrFormBody(maxBodySize, ...allowedFields) {
+  const checkFields = jsonBody(...allowedFields)
+  const parseForm = express.urlencoded({ extended: false, limit: maxBodySize })
+  return (req, res, next) => {
+    if (!req.is('application/x-www-form-urlencoded')) {
+      if (req.is('application/json') === false) {
+        sendError(res, 415, 'UNSUPPORTED_MEDIA_TYPE', 'Request body must be JSON or a form')
+        return
+      }
+      checkFields(req, res, next)
+      return
+    }
+    parseForm(req, res, err => {
+      if (err) {
+        next(err)
+        return
+      }
+      const repeated = Object.keys(req.body).filter(field => Array.isArray(req.body[field]))
+      if (repeated.length > 0) {
+        sendError(res, 400, 'INVALID_FIELD', `Field(s) given more than once: ${repeated.join(', ')}`)
+        return
+      }
+      req.body = Object.fromEntries(Object.entries(req.body).filter(([, value]) => value !== ''))
+      checkFields(req, res, next)
+    })
+  }
+}
+
+module.exports = { jsonBody, jsonOrFormBody };
@@ -0,0 +1,32 @@
+const uuid = require('uuid');
+
+// Logs one JSON line per request once the response has gone out. Each request
+// gets an id, kept on `req.id` and echoed in the X-Request-ID header, so a
+// user's report can be matched to the log line. Authenticated requests also
+// log who made them.
+function requestLog() {
+  return (req, res, next) => {
+    const start = process.hrtime.bigint()
+    req.id = uuid.v4()
+    res.set('X-Request-ID', req.id)
+
+    res.on('finish', () => {
+      const durationMs = Number(process.hrtime.bigint() - start) / 1e6
+      console.log(JSON.stringify({
+        time: new Date().toISOString(),
+        level: res.statusCode >= 500 ? 'error' : 'info',
+        msg: 'request',
+        requestId: req.id,
+        method: req.method,
+        path: req.originalUrl.split('?')[0],
+        status: res.statusCode,
+        durationMs: Math.round(durationMs * 10) / 10,
+        username: req.user?.username
+      }))
+    })
+
+    next()
+  }
+}
+
+module.exports = { requestLog };
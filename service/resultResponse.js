@@ -0,0 +1,33 @@
+// The result as username sees it. Fields added over time fall back to what a
+// result from before them meant.
+function toResultResponse(result, username) {
+  // results from before multiple winners had a single winner
+  const winners = result.winners ?? result.sortedOptions.slice(0, 1)
+  const rank = new Map(result.sortedOptions.map((option, i) => [option, i + 1]))
+  return {
+    id: result._id,
+    visible: result.visible !== false,
+    results: result.sortedOptions,
+    totals: (result.totals ?? []).map(t => ({
+      ...t,
+      rank: rank.get(t.option),
+      isWinner: winners.includes(t.option)
+    })),
+    ties: result.ties ?? [],
+    tieBreak: result.tieBreak ?? 'earliest-added',
+    tieBreakSeed: result.tieBreakSeed,
+    winnerCount: result.winnerCount ?? 1,
+    winners,
+    winnerOverflow: result.winnerOverflow ?? 0,
+    closedAt: result.closedAt,
+    voteTimes: result.voteTimes ?? [],
+    breakdown: result.breakdown ?? [],
+    pairwise: result.pairwise,
+    condorcetWinner: result.condorcetWinner,
+    bordaTotals: result.bordaTotals,
+    // notes on options are the owner's unless the room shared them
+    comments: result.commentsPublic || result.owner === username ? result.comments ?? [] : undefined
+  }
+}
+
+module.exports = { toResultResponse };
@@ -0,0 +1,53 @@
+const crypto = require('crypto');
+
+// custom codes, and generated ones, are between these lengths
+const MIN_CODE_LENGTH = 4
+const MAX_CODE_LENGTH = 12
+
+// leaves out 0/O and 1/I/L, which are easily mixed up when read off a screen
+const defaultAlphabet = 'ABCDEFGHJKMNPQRSTUVWXYZ23456789'
+
+// what generated codes look like, as set at startup from the config
+let codeLength = 4
+let codeAlphabet = defaultAlphabet
+
+function configureRoomCodes({ length, alphabet }) {
+  codeLength = length
+  codeAlphabet = alphabet
+}
+
+function generateRoomCode() {
+  let code = ''
+  for (let i = 0; i < codeLength; i++) {
+    code += codeAlphabet[crypto.randomInt(codeAlphabet.length)]
+  }
+  return code
+}
+
+// Whether code could name a room, custom or generated. Expects upper case.
+function isValidRoomCode(code) {
+  return code.length >= MIN_CODE_LENGTH && code.length <= MAX_CODE_LENGTH && /^[A-Z0-9]+$/.test(code)
+}
+
+// The code as it's stored, for one typed in by hand: case and stray spaces
+// are forgiven. Null if it couldn't be a code at all.
+function normalizeRoomCode(code) {
+  const normalized = String(code).trim().toUpperCase()
+  return isValidRoomCode(normalized) ? normalized : null
+}
+
+// what the join page needs to know to accept any code
+function roomCodeLimits() {
+  return { length: codeLength, minLength: MIN_CODE_LENGTH, maxLength: MAX_CODE_LENGTH }
+}
+
+module.exports = {
+  configureRoomCodes,
+  generateRoomCode,
+  isValidRoomCode,
+  normalizeRoomCode,
+  roomCodeLimits,
+  MIN_CODE_LENGTH,
+  MAX_CODE_LENGTH,
+  defaultAlphabet
+};
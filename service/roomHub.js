@@ -0,0 +1,205 @@
+// Tracks which clients (websocket connections or event streams) are watching
+// which room, so changes made through either the REST API or the websocket
+// reach every viewer. A subscriber is anything with a send(message) method.
+const DB = require('./database.js');
+const { provisionalTally } = require('./calculateVoteResult.js')
+const { quorumReached } = require('./roomSettings.js')
+
+const rooms = new Map()
+
+// Who has the room open right now, as opposed to who has joined it. A user
+// with several tabs open counts once.
+function onlineUsers(roomId) {
+  const connections = rooms.get(String(roomId)) ?? []
+  return [...new Set([...connections].map(c => c.user))].sort()
+}
+
+function isOnline(key, username) {
+  return [...rooms.get(key) ?? []].some(c => c.user === username)
+}
+
+function broadcastPresence(key) {
+  broadcastToRoom(key, { type: 'presence', online: onlineUsers(key) })
+}
+
+// Subscribing or unsubscribing tells the room when it changes who's online.
+function subscribe(roomId, connection) {
+  const key = String(roomId)
+  if (!rooms.has(key)) {
+    rooms.set(key, new Set())
+  }
+  const wasOnline = isOnline(key, connection.user)
+  rooms.get(key).add(connection)
+  if (!wasOnline) {
+    broadcastPresence(key)
+  }
+}
+
+function removeFromRoom(key, connection) {
+  const connections = rooms.get(key)
+  if (!connections?.delete(connection)) {
+    return
+  }
+  if (connections.size === 0) {
+    rooms.delete(key)
+  } else if (!isOnline(key, connection.user)) {
+    broadcastPresence(key)
+  }
+}
+
+function unsubscribe(connection) {
+  rooms.forEach((_connections, key) => removeFromRoom(key, connection))
+}
+
+function unsubscribeUser(roomId, username) {
+  const key = String(roomId)
+  rooms.get(key)?.forEach(c => {
+    if (c.user === username) {
+      removeFromRoom(key, c)
+      c.close?.()
+    }
+  })
+}
+
+function broadcastToRoom(roomId, event) {
+  const message = JSON.stringify(event)
+  rooms.get(String(roomId))?.forEach(c => c.send(message))
+}
+
+function sendToUser(roomId, username, event) {
+  const message = JSON.stringify(event)
+  rooms.get(String(roomId))?.forEach(c => {
+    if (c.user === username) {
+      c.send(message)
+    }
+  })
+}
+
+const tallyDebounceMs = 250
+const pendingTallies = new Map()
+
+// Sends the owner the standings so far. Calls within tallyDebounceMs of each
+// other are coalesced into one update, so a flurry of votes sends one tally.
+// Nobody else gets it, and rooms with previews turned off send nothing until
+// they reach their quorum.
+function scheduleTally(roomId) {
+  const key = String(roomId)
+  if (pendingTallies.has(key)) {
+    return
+  }
+  pendingTallies.set(key, setTimeout(async () => {
+    pendingTallies.delete(key)
+    try {
+      const room = await DB.getRoomById(key)
+      if (!room || room.state !== 'open' || (room.tallyPreview === false && !quorumReached(room))) {
+        return
+      }
+      sendToUser(key, room.owner, { type: 'tally', tally: provisionalTally(room) })
+    } catch (ex) {
+      console.error(`failed to send tally for room ${key}: ${ex.message}`)
+    }
+  }, tallyDebounceMs))
+}
+
+// Drops every subscriber of a room that has closed, ending any event streams.
+function endRoom(roomId) {
+  const key = String(roomId)
+  clearTimeout(pendingTallies.get(key))
+  pendingTallies.delete(key)
+  rooms.get(key)?.forEach(c => c.close?.())
+  rooms.delete(key)
+}
+
+async function broadcastLockIn(roomId, username) {
+  const room = await DB.getRoomById(roomId)
+  const lockIn = room.lockIns.find(l => l.username === username)
+  broadcastToRoom(roomId, {
+    type: 'locked-in',
+    username: room.anonymous ? undefined : username,
+    at: room.anonymous ? undefined : lockIn?.at,
+    lockedInCount: room.lockedIn?.length ?? 0,
+    participantCount: room.participants.length
+  })
+  // only the lock in that meets the quorum announces it
+  if (room.quorum > 0 && room.lockedIn?.length === room.quorum) {
+    broadcastToRoom(roomId, {
+      type: 'quorum-reached',
+      quorum: room.quorum,
+      lockedInCount: room.lockedIn.length,
+      participantCount: room.participants.length
+    })
+  }
+  scheduleTally(roomId)
+}
+
+// When the owner did the unlocking, the user is told so their client lets
+// them vote again.
+async function broadcastUnlock(roomId, username, byOwner = false) {
+  const room = await DB.getRoomById(roomId)
+  broadcastToRoom(roomId, {
+    type: 'unlocked',
+    username: room.anonymous ? undefined : username,
+    lockedInCount: room.lockedIn?.length ?? 0,
+    participantCount: room.participants.length
+  })
+  if (byOwner) {
+    sendToUser(roomId, username, { type: 'unlocked-by-owner' })
+  }
+  scheduleTally(roomId)
+}
+
+// Tells everyone to clear their ballots after the owner reset the votes.
+async function broadcastReset(roomId) {
+  const room = await DB.getRoomById(roomId)
+  broadcastToRoom(roomId, {
+    type: 'reset',
+    lockedInCount: 0,
+    participantCount: room.participants.length
+  })
+  scheduleTally(roomId)
+}
+
+// Tells the owner someone joined or left (type is participant-joined or
+// participant-left). Rooms with announceParticipants set tell everyone.
+async function broadcastParticipant(roomId, type, username, details = {}) {
+  const room = await DB.getRoomById(roomId)
+  if (!room) {
+    return
+  }
+  const event = { type, username, ...details, participantCount: room.participants.length }
+  if (room.announceParticipants) {
+    broadcastToRoom(roomId, event)
+  } else {
+    sendToUser(roomId, room.owner, event)
+  }
+}
+
+// Tells every event stream the server is going away and ends it. Websocket
+// connections are closed by peerProxy.
+function closeAll() {
+  pendingTallies.forEach(timeout => clearTimeout(timeout))
+  pendingTallies.clear()
+  const message = JSON.stringify({ type: 'server-closing' })
+  rooms.forEach(connections => connections.forEach(c => {
+    if (!c.ws) {
+      c.send(message)
+      c.close?.()
+    }
+  }))
+  rooms.clear()
+}
+
+module.exports = {
+  subscribe,
+  unsubscribe,
+  unsubscribeUser,
+  onlineUsers,
+  broadcastToRoom,
+  broadcastLockIn,
+  broadcastUnlock,
+  broadcastReset,
+  broadcastParticipant,
+  scheduleTally,
+  endRoom,
+  closeAll
+};
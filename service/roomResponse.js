@@ -0,0 +1,96 @@
+const crypto = require('crypto');
+const { sumScores, weightedVotes } = require('./calculateVoteResult.js')
+const { seededRandom } = require('./tieBreak.js')
+const { quorumReached } = require('./roomSettings.js')
+
+// { option: { emoji: count } }, which is all anyone sees of other people's
+// reactions.
+function countReactions(reactions = []) {
+  const counts = {}
+  reactions.forEach(({ option, emoji }) => {
+    counts[option] ??= {}
+    counts[option][emoji] = (counts[option][emoji] ?? 0) + 1
+  })
+  return counts
+}
+
+// The options in an order of the user's own. It's seeded by the user and
+// room, so it's the same on every reload but differs from everyone else's.
+function shuffledFor(room, username, unshuffled) {
+  const digest = crypto.createHash('sha256').update(`${room._id}:${username}`).digest()
+  const random = seededRandom(digest.readUInt32BE(0))
+  const options = [...unshuffled]
+  for (let i = options.length - 1; i > 0; i--) {
+    const j = Math.floor(random() * (i + 1))
+    const swapped = options[i]
+    options[i] = options[j]
+    options[j] = swapped
+  }
+  return options
+}
+
+// Pinned options first, then the rest, shuffled if the room asks for it.
+function orderedOptions(room, username) {
+  const pinned = (room.pinnedOptions ?? []).filter(opt => room.options.includes(opt))
+  const rest = room.options.filter(opt => !pinned.includes(opt))
+  return [...pinned, ...(room.shuffleOptions ? shuffledFor(room, username, rest) : rest)]
+}
+
+function toRoomResponse(room, username) {
+  const response = {
+    ...room,
+    reactions: countReactions(room.reactions),
+    // option -> emoji for the caller's own reactions
+    myReactions: Object.fromEntries((room.reactions ?? [])
+      .filter(r => r.username === username)
+      .map(r => [r.option, r.emoji])),
+    isOwner: room.owner === username,
+    lockedInCount: room.lockedIn?.length ?? 0,
+    participantCount: room.participants.length,
+    spectators: room.spectators ?? [],
+    spectatorCount: room.spectators?.length ?? 0,
+    isSpectator: (room.spectators ?? []).includes(username),
+    version: room.version ?? 0,
+    hasPassword: Boolean(room.passwordHash),
+    // relative, so clients can count down without trusting their own clock
+    closesInMs: room.closeAt ? Math.max(0, room.closeAt - Date.now()) : null
+  }
+  delete response.passwordHash
+  delete response.idempotencyKey
+  // only the order shown changes; the room keeps its own for tie breaks
+  response.options = orderedOptions(room, username)
+  response.pinnedOptions = room.pinnedOptions ?? []
+  // weights would show who carries more say, and the webhook where results
+  // go, so only the owner sees them
+  if (room.owner !== username) {
+    delete response.weights
+    delete response.webhookUrl
+  }
+
+  // notes on options are for the owner, unless the room shares them
+  if (room.owner !== username && !room.commentsPublic) {
+    response.votes = room.votes.map(v => v.username === username ? v : { ...v, comments: undefined })
+  }
+
+  // anonymous rooms only reveal the caller's own ballot. The owner gets the
+  // totals too, when they'd see the live tally anyway.
+  if (room.anonymous) {
+    response.votes = room.votes.filter(v => v.username === username)
+    if (room.owner === username && (room.tallyPreview !== false || quorumReached(room))) {
+      response.tallies = Object.fromEntries(sumScores(weightedVotes(room), room.options))
+    }
+    delete response.lockedIn
+    delete response.lockIns
+  }
+
+  // with results hidden until the owner reveals them, other people's ballots
+  // and the totals would give the result away
+  if (room.resultsVisible === false && room.owner !== username) {
+    response.votes = room.votes.filter(v => v.username === username)
+    delete response.tallies
+  }
+
+  return response
+}
+
+module.exports = { toRoomResponse, countReactions };
@@ -0,0 +1,202 @@
+const { isDeepStrictEqual } = require('util');
+const { votingMethods } = require('./calculateVoteResult.js')
+const { tieBreaks } = require('./tieBreak.js')
+const { DEFAULT_MAX_OPTION_LENGTH, MAX_OPTION_LENGTH_LIMIT, DEFAULT_MAX_OPTIONS } = require('./validateOption.js')
+const { DEFAULT_MIN_SCORE, DEFAULT_MAX_SCORE } = require('./validateVotes.js')
+const { webhooksEnabled, checkWebhookUrl } = require('./webhooks.js')
+
+const avatarStyles = ['icon', 'identicon']
+
+function nonNegativeInteger(name) {
+  return {
+    check: value => Number.isInteger(value) && value >= 0 ? null : `${name} must be a non-negative integer`,
+    schema: { minimum: 0 }
+  }
+}
+
+function boolean(name) {
+  return value => typeof value === 'boolean' ? null : `${name} must be a boolean`
+}
+
+// The settings an owner chooses for a room, with the value a room that never
+// set one behaves as and a check that returns a message for a bad value.
+// Where the default alone doesn't say what a setting takes, schema adds to
+// what the API description says about it.
+const settings = {
+  votingMethod: {
+    default: 'score',
+    check: value => votingMethods.includes(value) ? null : `Unknown voting method ${value}`,
+    schema: { enum: votingMethods }
+  },
+  tieBreak: {
+    default: 'earliest-added',
+    check: value => tieBreaks.includes(value) ? null : `Unknown tie break ${value}`,
+    schema: { enum: tieBreaks }
+  },
+  winnerCount: {
+    default: 1,
+    check: value => Number.isInteger(value) && value >= 1 ? null : 'winnerCount must be a positive integer',
+    schema: { minimum: 1 }
+  },
+  maxParticipants: { default: 0, ...nonNegativeInteger('maxParticipants') },
+  // how many must lock in before the room can close
+  minParticipants: { default: 0, ...nonNegativeInteger('minParticipants') },
+  // how many lock ins make the standings meaningful: the owner is told when
+  // it's reached and can see the tally from then on, even without previews
+  quorum: { default: 0, ...nonNegativeInteger('quorum') },
+  autoClose: { default: true, check: boolean('autoClose') },
+  // when the room closes on its own, or null for no deadline
+  closeAt: {
+    default: null,
+    check: value => value === null || (typeof value === 'string' && new Date(value) > new Date())
+      ? null
+      : 'closeAt must be a future date, or null',
+    parse: value => value === null ? null : new Date(value),
+    schema: { type: 'string', format: 'date-time' }
+  },
+  minScore: {
+    default: DEFAULT_MIN_SCORE,
+    check: value => Number.isInteger(value) ? null : 'minScore must be an integer'
+  },
+  maxScore: {
+    default: DEFAULT_MAX_SCORE,
+    check: value => Number.isInteger(value) ? null : 'maxScore must be an integer'
+  },
+  totalBudget: { default: 0, ...nonNegativeInteger('totalBudget') },
+  maxOptionsPerUser: { default: 0, ...nonNegativeInteger('maxOptionsPerUser') },
+  // 0 for no limit
+  maxOptions: { default: DEFAULT_MAX_OPTIONS, ...nonNegativeInteger('maxOptions') },
+  anonymous: { default: false, check: boolean('anonymous') },
+  tallyPreview: { default: true, check: boolean('tallyPreview') },
+  // show each participant the options in their own order, against bias
+  // towards whatever is listed first
+  shuffleOptions: { default: false, check: boolean('shuffleOptions') },
+  // whether participants see the result as soon as the room closes, rather
+  // than when the owner reveals it
+  resultsVisible: { default: true, check: boolean('resultsVisible') },
+  // whether everyone, not just the owner, hears about joins and leaves
+  announceParticipants: { default: false, check: boolean('announceParticipants') },
+  // whether everyone sees the notes left on options with the result, rather
+  // than only the owner
+  commentsPublic: { default: false, check: boolean('commentsPublic') },
+  // the room's icon: the avatar service's, or an identicon drawn here
+  avatarStyle: {
+    default: 'icon',
+    check: value => avatarStyles.includes(value) ? null : `avatarStyle must be one of ${avatarStyles.join(', ')}`,
+    schema: { enum: avatarStyles }
+  },
+  // where the result is posted when the room closes, or null for nowhere
+  webhookUrl: {
+    default: null,
+    check: value => {
+      if (value === null) {
+        return null
+      }
+      if (!webhooksEnabled()) {
+        return 'webhooks are not enabled on this server'
+      }
+      return typeof value === 'string' ? checkWebhookUrl(value) : 'webhookUrl must be a URL, or null'
+    },
+    schema: { type: 'string', format: 'uri' }
+  },
+  // whether a ballot must score every option before it can be locked in
+  requireComplete: { default: false, check: boolean('requireComplete') },
+  maxOptionLength: {
+    default: DEFAULT_MAX_OPTION_LENGTH,
+    check: value => Number.isInteger(value) && value >= 1 && value <= MAX_OPTION_LENGTH_LIMIT
+      ? null
+      : `maxOptionLength must be an integer between 1 and ${MAX_OPTION_LENGTH_LIMIT}`,
+    schema: { minimum: 1, maximum: MAX_OPTION_LENGTH_LIMIT }
+  },
+  // username -> how many times their ballot counts; anyone missing counts once
+  weights: {
+    default: {},
+    check: value => typeof value === 'object' && value !== null && !Array.isArray(value) &&
+      Object.values(value).every(weight => Number.isInteger(weight) && weight >= 1)
+      ? null
+      : 'weights must map usernames to positive integers',
+    schema: { additionalProperties: { type: 'integer', minimum: 1 } }
+  }
+}
+
+const settingNames = Object.keys(settings)
+
+// Settings that change what a ballot means, how much it counts, or who can
+// see it, so they're fixed once anyone has scored an option.
+const frozenOnceVoting = ['votingMethod', 'minScore', 'maxScore', 'totalBudget', 'anonymous', 'maxOptions', 'weights']
+
+// The frozenOnceVoting settings that changes would give a new value.
+// Sending a setting's current value again doesn't count as changing it.
+function frozenChanges(changes, current) {
+  return frozenOnceVoting.filter(name => name in changes && !isDeepStrictEqual(changes[name], current[name]))
+}
+
+// Turns checked settings from a request body into what the room stores.
+function parseSettings(changes) {
+  return Object.fromEntries(Object.entries(changes).map(([name, value]) =>
+    [name, settings[name].parse ? settings[name].parse(value) : value]))
+}
+
+// A room's settings, filling in defaults for any it predates.
+function roomSettings(room) {
+  return Object.fromEntries(settingNames.map(name => [name, room[name] ?? settings[name].default]))
+}
+
+// JSON schema types for each kind of default a setting has.
+function schemaType(value) {
+  if (typeof value === 'boolean') {
+    return { type: 'boolean' }
+  }
+  if (Number.isInteger(value)) {
+    return { type: 'integer' }
+  }
+  if (typeof value === 'object' && value !== null) {
+    return { type: 'object' }
+  }
+  return { type: 'string' }
+}
+
+// An OpenAPI schema for the room settings, worked out from the settings
+// themselves so it can't fall behind them. Settings whose default is null
+// can be set back to null.
+function settingsSchema() {
+  const properties = Object.fromEntries(settingNames.map(name => {
+    const setting = settings[name]
+    const schema = { ...schemaType(setting.default), ...setting.schema }
+    if (setting.default === null) {
+      schema.nullable = true
+    } else {
+      schema.default = setting.default
+    }
+    return [name, schema]
+  }))
+  return { type: 'object', properties }
+}
+
+// Whether enough participants have locked in to meet the room's quorum.
+// Rooms without one never reach it.
+function quorumReached(room) {
+  return (room.quorum ?? 0) > 0 && (room.lockedIn?.length ?? 0) >= room.quorum
+}
+
+// Checks the given settings, and that together with current (the room's
+// settings, or the defaults for a new room) they make sense. Returns a
+// message, or null if they're fine.
+function validateSettings(changes, current = roomSettings({})) {
+  for (const name of Object.keys(changes)) {
+    const msg = settings[name].check(changes[name])
+    if (msg) {
+      return msg
+    }
+  }
+  const merged = { ...current, ...changes }
+  if (merged.minScore > merged.maxScore) {
+    return 'minScore must not be greater than maxScore'
+  }
+  if (merged.maxParticipants > 0 && merged.minParticipants > merged.maxParticipants) {
+    return 'minParticipants must not be greater than maxParticipants'
+  }
+  return null
+}
+
+module.exports = { settingNames, frozenOnceVoting, frozenChanges, roomSettings, validateSettings, parseSettings, quorumReached, settingsSchema };
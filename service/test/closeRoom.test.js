@@ -0,0 +1,81 @@
+const test = require('node:test');
+const assert = require('node:assert');
+const { stubModules, tick } = require('./stubs.js')
+
+const rooms = new Map()
+const results = []
+
+// closes like the real closeRoom: only an open room still at the version the
+// caller read moves on
+const DB = {
+  async closeRoom(roomId, closedAt, expectedVersion) {
+    await tick()
+    const room = rooms.get(roomId)
+    if (room.state !== 'open' || (room.version ?? 0) !== expectedVersion) {
+      return false
+    }
+    room.state = 'closed'
+    room.version = (room.version ?? 0) + 1
+    return true
+  },
+  async createResult(room, sortedOptions, totals, details) {
+    await tick()
+    const result = { _id: `result-${results.length + 1}`, roomId: room._id, sortedOptions, totals, ...details }
+    results.push(result)
+    return result
+  },
+  async getRoomById(roomId) {
+    return structuredClone(rooms.get(roomId))
+  }
+}
+stubModules({ './database.js': DB })
+
+const { closeRoomWithResult } = require('../closeRoom.js')
+
+function openRoom(id) {
+  const room = {
+    _id: id,
+    owner: 'alice',
+    state: 'open',
+    version: 3,
+    options: ['pizza', 'tacos'],
+    participants: ['alice', 'bob'],
+    lockedIn: ['alice', 'bob'],
+    votes: [
+      { username: 'alice', votes: { pizza: 5, tacos: 1 } },
+      { username: 'bob', votes: { pizza: 2, tacos: 4 } }
+    ]
+  }
+  rooms.set(id, room)
+  return structuredClone(room)
+}
+
+test('two closes racing each other publish one result', async () => {
+  results.length = 0
+  const room = openRoom('race')
+
+  const outcomes = await Promise.all([closeRoomWithResult(room), closeRoomWithResult(structuredClone(room))])
+
+  assert.strictEqual(outcomes.filter(Boolean).length, 1)
+  assert.strictEqual(results.length, 1)
+  assert.strictEqual(rooms.get('race').state, 'closed')
+})
+
+test('a close against an already closed room publishes nothing', async () => {
+  results.length = 0
+  const room = openRoom('closed')
+  assert.ok(await closeRoomWithResult(room))
+
+  assert.strictEqual(await closeRoomWithResult(room), null)
+  assert.strictEqual(results.length, 1)
+})
+
+test('many concurrent closes still publish one result', async () => {
+  results.length = 0
+  const room = openRoom('crowd')
+
+  const outcomes = await Promise.all(Array.from({ length: 10 }, () => closeRoomWithResult(structuredClone(room))))
+
+  assert.strictEqual(outcomes.filter(Boolean).length, 1)
+  assert.strictEqual(results.length, 1)
+})
@@ -0,0 +1,47 @@
+const test = require('node:test');
+const assert = require('node:assert');
+const crypto = require('node:crypto');
+const { stubModules } = require('./stubs.js')
+const { fakeMongo } = require('./fakeMongo.js')
+
+const { mongodb } = fakeMongo()
+stubModules({
+  mongodb,
+  uuid: { v4: () => crypto.randomUUID() },
+  bcrypt: {}
+})
+
+const DB = require('../database.js')
+
+test.before(async () => {
+  const log = console.log
+  console.log = () => {}
+  await DB.connect({ url: 'mongodb://fake', timeoutMs: 1000, operationTimeouts: new Map() })
+  console.log = log
+})
+
+test('a draft sharing an open room\'s code doesn\'t hide the open room', async () => {
+  const open = await DB.createRoom('alice', { code: 'LUNCH1' })
+  const draft = await DB.createRoom('bob', { code: 'LUNCH1', draft: true })
+  assert.ok(draft, 'drafts may share a code with an open room')
+
+  const found = await DB.getRoomByCode('LUNCH1')
+
+  assert.strictEqual(String(found._id), String(open.id))
+  assert.strictEqual(found.state, 'open')
+})
+
+test('without an open room, a code finds the newest room that had it', async () => {
+  const older = await DB.createRoom('alice', { code: 'LUNCH2' })
+  assert.ok(await DB.closeRoom(String(older.id)))
+  const newer = await DB.createRoom('bob', { code: 'LUNCH2', draft: true })
+
+  assert.strictEqual(String((await DB.getRoomByCode('LUNCH2'))._id), String(newer.id))
+})
+
+test('a deleted room is never found by its code', async () => {
+  const room = await DB.createRoom('alice', { code: 'LUNCH3' })
+  assert.ok(await DB.deleteRoom(String(room.id)))
+
+  assert.strictEqual(await DB.getRoomByCode('LUNCH3'), null)
+})
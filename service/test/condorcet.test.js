@@ -0,0 +1,91 @@
+const test = require('node:test');
+const assert = require('node:assert');
+const { stubModules } = require('./stubs.js')
+
+stubModules({ './database.js': {} })
+
+const { pairwiseMatrix, condorcetWinner, rankedPairs } = require('../condorcet.js')
+const { calculateVoteResult } = require('../calculateVoteResult.js')
+const { tallyRoom } = require('../closeRoom.js')
+
+const options = ['A', 'B', 'C']
+
+// n ballots ranking the options in order, as scores 3, 2, 1
+function ballots(n, order) {
+  return Array.from({ length: n }, (_, i) => ({
+    username: `${order.join('')}${i}`,
+    votes: Object.fromEntries(order.map((opt, rank) => [opt, order.length - rank]))
+  }))
+}
+
+// the textbook cycle: A beats B 6-3, B beats C 7-2, C beats A 5-4
+const cycle = [
+  ...ballots(4, ['A', 'B', 'C']),
+  ...ballots(3, ['B', 'C', 'A']),
+  ...ballots(2, ['C', 'A', 'B'])
+]
+
+function room(votes, extra = {}) {
+  return {
+    _id: 'room',
+    owner: 'owner',
+    votingMethod: 'condorcet',
+    options,
+    participants: votes.map(v => v.username),
+    votes,
+    ...extra
+  }
+}
+
+const inOrder = (a, b) => options.indexOf(a) - options.indexOf(b)
+
+test('the pairwise matrix counts each head to head preference', () => {
+  const { wins } = pairwiseMatrix(cycle, options)
+
+  assert.deepStrictEqual(wins, [
+    [0, 6, 4],
+    [3, 0, 7],
+    [5, 2, 0]
+  ])
+})
+
+test('a cycle has no Condorcet winner', () => {
+  assert.strictEqual(condorcetWinner(pairwiseMatrix(cycle, options)), null)
+})
+
+test('ranked pairs breaks the cycle by dropping its weakest win', () => {
+  // B>C (7-2) and A>B (6-3) are locked in; C>A (5-4) would close the cycle
+  assert.deepStrictEqual(rankedPairs(pairwiseMatrix(cycle, options), inOrder), ['A', 'B', 'C'])
+})
+
+test('a Condorcet winner comes first even when it has the lower score total', () => {
+  // B is everyone's second choice but beats both others head to head
+  const votes = [
+    { username: 'u1', votes: { A: 10, B: 9, C: 0 } },
+    { username: 'u2', votes: { C: 10, B: 9, A: 0 } },
+    { username: 'u3', votes: { B: 1, A: 0, C: 0 } }
+  ]
+
+  assert.strictEqual(condorcetWinner(pairwiseMatrix(votes, options)), 'B')
+  assert.strictEqual(calculateVoteResult(room(votes), 0)[0], 'B')
+})
+
+test('weighted ballots count as many times as their weight', () => {
+  const votes = [
+    { username: 'heavy', votes: { A: 2, B: 1, C: 0 } },
+    { username: 'light1', votes: { B: 2, A: 1, C: 0 } },
+    { username: 'light2', votes: { B: 2, A: 1, C: 0 } }
+  ]
+
+  assert.strictEqual(calculateVoteResult(room(votes, { weights: { heavy: 3 } }), 0)[0], 'A')
+})
+
+test('the result keeps the pairwise matrix so it can be audited', () => {
+  const { sortedOptions, details } = tallyRoom(room(cycle), undefined)
+
+  assert.deepStrictEqual(sortedOptions, ['A', 'B', 'C'])
+  assert.deepStrictEqual(details.pairwise.options, options)
+  assert.deepStrictEqual(details.pairwise.wins[2][0], 5)
+  assert.strictEqual(details.condorcetWinner, null)
+  assert.deepStrictEqual(details.winners, ['A'])
+})
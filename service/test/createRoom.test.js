@@ -0,0 +1,69 @@
+const test = require('node:test');
+const assert = require('node:assert');
+const crypto = require('node:crypto');
+const { stubModules } = require('./stubs.js')
+const { fakeMongo } = require('./fakeMongo.js')
+
+const { mongodb, collections } = fakeMongo()
+stubModules({
+  mongodb,
+  uuid: { v4: () => crypto.randomUUID() },
+  bcrypt: { hash: async password => `hashed:${password}` }
+})
+
+const DB = require('../database.js')
+const { validateNewOption } = require('../validateOption.js')
+const { validateVotes } = require('../validateVotes.js')
+const { settingNames, settingsSchema } = require('../roomSettings.js')
+
+test.before(async () => {
+  const log = console.log
+  console.log = () => {}
+  await DB.connect({ url: 'mongodb://fake', timeoutMs: 1000, operationTimeouts: new Map() })
+  console.log = log
+})
+
+test('a new room has its owner as a participant', async () => {
+  const room = await DB.createRoom('alice')
+
+  assert.deepStrictEqual(room.participants, ['alice'])
+  assert.deepStrictEqual(collections.room.documents.at(-1).participants, ['alice'])
+})
+
+test('the owner can add options as soon as the room is created', async () => {
+  const room = await DB.createRoom('alice')
+
+  assert.strictEqual(validateNewOption(room, 'alice', 'Pizza'), null)
+})
+
+test('the owner can add options to a draft room before publishing it', async () => {
+  const room = await DB.createRoom('alice', { draft: true })
+
+  assert.strictEqual(room.state, 'draft')
+  assert.strictEqual(validateNewOption(room, 'alice', 'Pizza'), null)
+})
+
+test('the owner starts with a ballot, so they can vote straight away', async () => {
+  const room = await DB.createRoom('alice')
+  const withOption = { ...room, options: ['Pizza'] }
+
+  assert.ok(room.votes.some(v => v.username === 'alice'))
+  assert.strictEqual(validateVotes(withOption, { Pizza: 3 }), null)
+})
+
+test('someone who has not joined still cannot add options', async () => {
+  const room = await DB.createRoom('alice')
+
+  assert.strictEqual(validateNewOption(room, 'mallory', 'Pizza')?.code, 'NOT_PARTICIPANT')
+})
+
+test('a room created without settings has every setting at its advertised default', async () => {
+  const room = await DB.createRoom('alice')
+  const { properties } = settingsSchema()
+
+  for (const name of settingNames) {
+    const stored = room[name] ?? null
+    assert.deepStrictEqual(stored, properties[name].default ?? null, name)
+  }
+  assert.strictEqual(properties.maxOptions.default, 50)
+})
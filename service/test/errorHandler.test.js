@@ -0,0 +1,111 @@
+const test = require('node:test');
+const assert = require('node:assert');
+const { stubModules } = require('./stubs.js')
+
+class DatabaseTimeoutError extends Error {
+  constructor(operation) {
+    super(`database ${operation} timed out`)
+    this.operation = operation
+  }
+}
+
+// just enough of express.Router to see what asyncRouter registers
+function Router() {
+  const routes = []
+  const router = { routes }
+  for (const method of ['use', 'get', 'post', 'put', 'patch', 'delete']) {
+    router[method] = (...args) => routes.push({ method, args })
+  }
+  return router
+}
+
+stubModules({
+  express: { Router },
+  './database.js': { DatabaseTimeoutError }
+})
+
+const { asyncRouter } = require('../asyncRouter.js')
+const { errorHandler } = require('../errorHandler.js')
+
+function fakeResponse() {
+  return {
+    statusCode: 200,
+    headersSent: false,
+    status(code) {
+      this.statusCode = code
+      return this
+    },
+    send(body) {
+      this.body = body
+      this.headersSent = true
+      return this
+    }
+  }
+}
+
+// Runs the route's handler as express would, passing anything it hands to
+// next on to the error handler. Resolves once the response is settled.
+function dispatch(handler, res = fakeResponse()) {
+  const handle = errorHandler({ maxBodySize: '100kb' })
+  return new Promise(resolve => {
+    const next = err => {
+      if (!err) {
+        resolve({ res })
+        return
+      }
+      handle(err, { id: 'test' }, res, passedOn => resolve({ res, passedOn }))
+      if (res.headersSent) {
+        resolve({ res })
+      }
+    }
+    handler({}, res, next)
+  })
+}
+
+test('a handler that rejects gets a clean 500 instead of a hanging request', async t => {
+  t.mock.method(console, 'error', () => {})
+  const router = asyncRouter()
+  router.get('/boom', async () => {
+    throw new Error('boom')
+  })
+
+  const { res } = await dispatch(router.routes[0].args[1])
+
+  assert.strictEqual(res.statusCode, 500)
+  assert.deepStrictEqual(res.body, { error: { code: 'INTERNAL_ERROR', message: 'Internal server error' } })
+})
+
+test('a handler that rejects after its response started is handed back to express', async t => {
+  t.mock.method(console, 'error', () => {})
+  const router = asyncRouter()
+  router.get('/late', async (_req, res) => {
+    res.send('partial')
+    throw new Error('too late')
+  })
+
+  const { res, passedOn } = await dispatch(router.routes[0].args[1])
+
+  assert.strictEqual(res.body, 'partial')
+  assert.strictEqual(passedOn?.message, 'too late')
+})
+
+test('a database timeout is reported as 504', async t => {
+  t.mock.method(console, 'error', () => {})
+  const router = asyncRouter()
+  router.get('/slow', async () => {
+    throw new DatabaseTimeoutError('getRoomById')
+  })
+
+  const { res } = await dispatch(router.routes[0].args[1])
+
+  assert.strictEqual(res.statusCode, 504)
+  assert.strictEqual(res.body.error.code, 'DATABASE_TIMEOUT')
+})
+
+test('error handlers keep their arity so express still recognises them', () => {
+  const router = asyncRouter()
+  const handler = (_err, _req, _res, _next) => {}
+  router.use(handler)
+
+  assert.strictEqual(router.routes[0].args[0], handler)
+})
@@ -0,0 +1,528 @@
+// An in-memory stand-in for the parts of the mongodb package database.js
+// uses: filters, update operators and $set pipeline stages, unique (and
+// partial) indexes, and case-insensitive collations. It evaluates only the
+// operators the service's queries need and throws on any other, so a test
+// can't pass by quietly ignoring part of a query.
+
+// Ids increase in the order they're made, as real ones do (they lead with
+// a timestamp), so sorting on _id puts the newest last.
+let lastId = 0
+
+class ObjectId {
+  constructor(id = (++lastId).toString(16).padStart(24, '0')) {
+    this.id = String(id)
+  }
+  static isValid(id) {
+    return /^[0-9a-f]{24}$/i.test(String(id))
+  }
+  toString() {
+    return this.id
+  }
+  toHexString() {
+    return this.id
+  }
+  equals(other) {
+    return String(other) === this.id
+  }
+}
+
+class MongoServerError extends Error {
+  constructor(message, code) {
+    super(message)
+    this.code = code
+  }
+}
+
+// documents handed out are copies, as they would be from a real server
+function copy(value) {
+  if (value instanceof ObjectId) {
+    return value
+  }
+  if (value instanceof Date) {
+    return new Date(value)
+  }
+  if (Array.isArray(value)) {
+    return value.map(copy)
+  }
+  if (value && typeof value === 'object') {
+    return Object.fromEntries(Object.entries(value).map(([k, v]) => [k, copy(v)]))
+  }
+  return value
+}
+
+function isPlainObject(value) {
+  return value !== null && typeof value === 'object' && !Array.isArray(value) &&
+    !(value instanceof ObjectId) && !(value instanceof Date)
+}
+
+function isOperatorObject(value) {
+  return isPlainObject(value) && Object.keys(value).length > 0 && Object.keys(value).every(k => k.startsWith('$'))
+}
+
+// strength 1 or 2 ignores case, as the service's collations do
+function caseInsensitive(collation) {
+  return collation !== undefined && collation.strength <= 2
+}
+
+function equal(a, b, collation) {
+  if (a instanceof ObjectId || b instanceof ObjectId) {
+    return String(a) === String(b)
+  }
+  if (a instanceof Date && b instanceof Date) {
+    return a.getTime() === b.getTime()
+  }
+  if (typeof a === 'string' && typeof b === 'string' && caseInsensitive(collation)) {
+    return a.localeCompare(b, collation.locale, { sensitivity: 'accent' }) === 0
+  }
+  if (Array.isArray(a) && Array.isArray(b)) {
+    return a.length === b.length && a.every((v, i) => equal(v, b[i], collation))
+  }
+  if (isPlainObject(a) && isPlainObject(b)) {
+    const keys = Object.keys(a)
+    return keys.length === Object.keys(b).length && keys.every(k => equal(a[k], b[k], collation))
+  }
+  // a missing field matches null
+  return (a ?? null) === (b ?? null)
+}
+
+function compare(a, b) {
+  if (a instanceof ObjectId || b instanceof ObjectId) {
+    return String(a ?? '').localeCompare(String(b ?? ''))
+  }
+  if (a === b) {
+    return 0
+  }
+  if (a === undefined || a === null) {
+    return -1
+  }
+  if (b === undefined || b === null) {
+    return 1
+  }
+  return a < b ? -1 : a > b ? 1 : 0
+}
+
+// Every value a dotted path reaches, looking inside arrays along the way as
+// a query does. A path that reaches nothing yields [undefined].
+function valuesAt(doc, path) {
+  let values = [doc]
+  for (const key of path.split('.')) {
+    values = values.flatMap(value => {
+      if (Array.isArray(value) && !/^\d+$/.test(key)) {
+        return value.map(element => element?.[key])
+      }
+      return [value?.[key]]
+    })
+  }
+  return values
+}
+
+// what a query compares a value against: the value, and if it's an array,
+// each of its elements
+function candidates(values) {
+  return values.flatMap(value => Array.isArray(value) ? [value, ...value] : [value])
+}
+
+function matchesCondition(values, condition, collation) {
+  if (!isOperatorObject(condition)) {
+    return candidates(values).some(value => equal(value, condition, collation))
+  }
+  return Object.entries(condition).every(([op, operand]) => {
+    switch (op) {
+      case '$eq':
+        return matchesCondition(values, operand, collation)
+      case '$ne':
+        return !matchesCondition(values, operand, collation)
+      case '$in':
+        return operand.some(option => matchesCondition(values, option, collation))
+      case '$nin':
+        return !operand.some(option => matchesCondition(values, option, collation))
+      case '$exists':
+        return values.some(value => value !== undefined) === Boolean(operand)
+      case '$lt':
+        return candidates(values).some(value => value !== undefined && compare(value, operand) < 0)
+      case '$lte':
+        return candidates(values).some(value => value !== undefined && compare(value, operand) <= 0)
+      case '$gt':
+        return candidates(values).some(value => value !== undefined && compare(value, operand) > 0)
+      case '$gte':
+        return candidates(values).some(value => value !== undefined && compare(value, operand) >= 0)
+      case '$size':
+        return values.some(value => Array.isArray(value) && value.length === operand)
+      case '$elemMatch':
+        return values.some(value => Array.isArray(value) && value.some(element => isOperatorObject(operand)
+          ? matchesCondition([element], operand, collation)
+          : matches(element, operand, collation)))
+      default:
+        throw new Error(`fakeMongo does not support the query operator ${op}`)
+    }
+  })
+}
+
+function matches(doc, filter = {}, collation) {
+  // a bare id, as in deleteOne(id), is shorthand for { _id: id }
+  if (filter instanceof ObjectId) {
+    filter = { _id: filter }
+  }
+  return Object.entries(filter).every(([key, condition]) => {
+    switch (key) {
+      case '$or':
+        return condition.some(sub => matches(doc, sub, collation))
+      case '$and':
+        return condition.every(sub => matches(doc, sub, collation))
+      case '$nor':
+        return !condition.some(sub => matches(doc, sub, collation))
+      case '$expr':
+        return Boolean(evaluate(condition, { $$ROOT: doc }, doc))
+      default:
+        return matchesCondition(valuesAt(doc, key), condition, collation)
+    }
+  })
+}
+
+// Evaluates an aggregation expression against doc. vars holds $$ variables.
+function evaluate(expr, vars, doc) {
+  if (typeof expr === 'string' && expr.startsWith('$$')) {
+    const [name, ...path] = expr.slice(2).split('.')
+    const value = vars[`$$${name}`]
+    return path.length === 0 ? value : fieldPath(value, path)
+  }
+  if (typeof expr === 'string' && expr.startsWith('$')) {
+    return fieldPath(doc, expr.slice(1).split('.'))
+  }
+  if (Array.isArray(expr)) {
+    return expr.map(e => evaluate(e, vars, doc))
+  }
+  if (!isPlainObject(expr)) {
+    return expr
+  }
+  const keys = Object.keys(expr)
+  if (keys.length !== 1 || !keys[0].startsWith('$')) {
+    return Object.fromEntries(keys.map(k => [k, evaluate(expr[k], vars, doc)]))
+  }
+  const [op] = keys
+  const operand = expr[op]
+  const args = () => (Array.isArray(operand) ? operand : [operand]).map(e => evaluate(e, vars, doc))
+  switch (op) {
+    case '$literal':
+      return operand
+    case '$cond': {
+      const [test, then, otherwise] = Array.isArray(operand) ? operand : [operand.if, operand.then, operand.else]
+      return evaluate(evaluate(test, vars, doc) ? then : otherwise, vars, doc)
+    }
+    case '$ifNull': {
+      const values = args()
+      return values.find(v => v !== undefined && v !== null) ?? values.at(-1)
+    }
+    case '$in': {
+      const [value, array] = args()
+      return array.some(v => equal(v, value))
+    }
+    case '$eq': {
+      const [a, b] = args()
+      return equal(a, b)
+    }
+    case '$ne': {
+      const [a, b] = args()
+      return !equal(a, b)
+    }
+    case '$lt':
+      return compare(...args()) < 0
+    case '$lte':
+      return compare(...args()) <= 0
+    case '$gt':
+      return compare(...args()) > 0
+    case '$gte':
+      return compare(...args()) >= 0
+    case '$and':
+      return args().every(Boolean)
+    case '$or':
+      return args().some(Boolean)
+    case '$not':
+      return !args()[0]
+    case '$anyElementTrue':
+      return args()[0].some(Boolean)
+    case '$allElementsTrue':
+      return args()[0].every(Boolean)
+    case '$add':
+      return args().reduce((sum, v) => sum + v, 0)
+    case '$size':
+      return args()[0].length
+    case '$concatArrays':
+      return args().flat(1)
+    case '$setUnion':
+      return args().flat(1).filter((v, i, all) => all.findIndex(w => equal(v, w)) === i)
+    case '$setDifference': {
+      const [a, b] = args()
+      return a.filter(v => !b.some(w => equal(v, w)))
+    }
+    case '$mergeObjects':
+      return Object.assign({}, ...args().filter(Boolean))
+    case '$objectToArray':
+      return Object.entries(args()[0] ?? {}).map(([k, v]) => ({ k, v }))
+    case '$arrayToObject':
+      return Object.fromEntries(args()[0].map(entry => Array.isArray(entry) ? entry : [entry.k, entry.v]))
+    case '$map': {
+      const as = `$$${operand.as ?? 'this'}`
+      return (evaluate(operand.input, vars, doc) ?? []).map(v => evaluate(operand.in, { ...vars, [as]: v }, doc))
+    }
+    case '$filter': {
+      const as = `$$${operand.as ?? 'this'}`
+      return (evaluate(operand.input, vars, doc) ?? []).filter(v => evaluate(operand.cond, { ...vars, [as]: v }, doc))
+    }
+    default:
+      throw new Error(`fakeMongo does not support the expression operator ${op}`)
+  }
+}
+
+// an expression's field path, mapping over arrays as aggregation does
+function fieldPath(value, path) {
+  return path.reduce((current, key) => Array.isArray(current)
+    ? current.map(element => element?.[key])
+    : current?.[key], value)
+}
+
+// The index in array of the first element that satisfies the filter's
+// conditions on prefix, for the positional $ operator.
+function positionalIndex(array, prefix, filter) {
+  const conditions = Object.entries(filter)
+    .filter(([key]) => key === prefix || key.startsWith(`${prefix}.`))
+  return array.findIndex(element => conditions.every(([key, condition]) => key === prefix
+    ? matchesCondition([element], condition)
+    : matchesCondition(valuesAt(element, key.slice(prefix.length + 1)), condition)))
+}
+
+// Calls apply(parent, key) for each place a dotted update path names,
+// creating objects along the way. $ is the element the filter matched, and
+// $[] every element.
+function forEachTarget(doc, path, filter, apply) {
+  const keys = path.split('.')
+  let parents = [doc]
+  keys.slice(0, -1).forEach((key, i) => {
+    parents = parents.flatMap(parent => {
+      if (key === '$[]') {
+        return parent
+      }
+      if (key === '$') {
+        const prefix = keys.slice(0, i).join('.')
+        return [parent[positionalIndex(parent, prefix, filter)]]
+      }
+      parent[key] ??= {}
+      return [parent[key]]
+    })
+  })
+  const last = keys.at(-1)
+  parents.forEach(parent => {
+    if (last === '$[]') {
+      parent.forEach((_element, i) => apply(parent, i))
+    } else if (last === '$') {
+      apply(parent, positionalIndex(parent, keys.slice(0, -1).join('.'), filter))
+    } else {
+      apply(parent, last)
+    }
+  })
+}
+
+function applyOperators(doc, update, filter) {
+  for (const [op, fields] of Object.entries(update)) {
+    for (const [path, value] of Object.entries(fields)) {
+      forEachTarget(doc, path, filter, (parent, key) => {
+        switch (op) {
+          case '$set':
+            parent[key] = copy(value)
+            break
+          case '$unset':
+            delete parent[key]
+            break
+          case '$inc':
+            parent[key] = (parent[key] ?? 0) + value
+            break
+          case '$push':
+            parent[key] = [...parent[key] ?? [], ...copy(value?.$each ?? [value])]
+            break
+          case '$addToSet':
+            parent[key] ??= []
+            for (const v of value?.$each ?? [value]) {
+              if (!parent[key].some(existing => equal(existing, v))) {
+                parent[key].push(copy(v))
+              }
+            }
+            break
+          case '$pull':
+            parent[key] = (parent[key] ?? []).filter(element => isPlainObject(value) && !isOperatorObject(value)
+              ? !matches(element, value)
+              : !matchesCondition([element], value))
+            break
+          default:
+            throw new Error(`fakeMongo does not support the update operator ${op}`)
+        }
+      })
+    }
+  }
+}
+
+function applyPipeline(doc, pipeline) {
+  for (const stage of pipeline) {
+    const [[name, spec]] = Object.entries(stage)
+    if (name === '$set' || name === '$addFields') {
+      const values = Object.entries(spec).map(([field, expr]) => [field, evaluate(expr, { $$ROOT: doc }, doc)])
+      values.forEach(([field, value]) => forEachTarget(doc, field, {}, (parent, key) => {
+        parent[key] = value
+      }))
+    } else if (name === '$unset') {
+      (Array.isArray(spec) ? spec : [spec]).forEach(field => delete doc[field])
+    } else {
+      throw new Error(`fakeMongo does not support the pipeline stage ${name}`)
+    }
+  }
+}
+
+function sortDocuments(documents, sort) {
+  const keys = Object.entries(sort ?? {})
+  return [...documents].sort((a, b) => {
+    for (const [key, direction] of keys) {
+      const order = compare(valuesAt(a, key)[0], valuesAt(b, key)[0]) * direction
+      if (order !== 0) {
+        return order
+      }
+    }
+    return 0
+  })
+}
+
+class Cursor {
+  constructor(documents) {
+    this.documents = documents
+    this.skipped = 0
+    this.limited = Infinity
+  }
+  sort(sort) {
+    this.documents = sortDocuments(this.documents, sort)
+    return this
+  }
+  skip(n) {
+    this.skipped = n
+    return this
+  }
+  limit(n) {
+    this.limited = n || Infinity
+    return this
+  }
+  async toArray() {
+    return this.documents.slice(this.skipped, this.skipped + this.limited).map(copy)
+  }
+}
+
+class Collection {
+  constructor(name) {
+    this.collectionName = name
+    this.documents = []
+    this.indexes = []
+  }
+
+  async indexExists() {
+    return false
+  }
+
+  async createIndex(keys, options = {}) {
+    const name = Object.entries(keys).map(([field, direction]) => `${field}_${direction}`).join('_')
+    this.indexes.push({ name, keys, ...options })
+    return name
+  }
+
+  // throws as the server would if doc, about to replace the document at
+  // index (or be added), breaks a unique index
+  checkUnique(doc, index = -1) {
+    for (const { name, keys, unique, partialFilterExpression, collation } of this.indexes) {
+      if (!unique || (partialFilterExpression && !matches(doc, partialFilterExpression))) {
+        continue
+      }
+      const clash = this.documents.some((other, i) => i !== index &&
+        (!partialFilterExpression || matches(other, partialFilterExpression)) &&
+        Object.keys(keys).every(field => equal(valuesAt(other, field)[0], valuesAt(doc, field)[0], collation)))
+      if (clash) {
+        throw new MongoServerError(`E11000 duplicate key error collection: ${this.collectionName} index: ${name}`, 11000)
+      }
+    }
+  }
+
+  find(filter, { collation, sort } = {}) {
+    const found = this.documents.filter(doc => matches(doc, filter, collation))
+    return new Cursor(sortDocuments(found, sort))
+  }
+
+  async findOne(filter, options) {
+    const [doc] = await this.find(filter, options).limit(1).toArray()
+    return doc ?? null
+  }
+
+  async countDocuments(filter) {
+    return this.documents.filter(doc => matches(doc, filter)).length
+  }
+
+  async insertOne(doc) {
+    doc._id ??= new ObjectId()
+    this.checkUnique(doc)
+    this.documents.push(copy(doc))
+    return { acknowledged: true, insertedId: doc._id }
+  }
+
+  // Applies update to the first match and returns its index and the
+  // document as it was, or undefined if nothing matched.
+  updateFirst(filter, update, { collation, sort } = {}) {
+    const [target] = sortDocuments(this.documents.filter(doc => matches(doc, filter, collation)), sort)
+    if (!target) {
+      return undefined
+    }
+    const index = this.documents.indexOf(target)
+    const updated = copy(target)
+    if (Array.isArray(update)) {
+      applyPipeline(updated, update)
+    } else {
+      applyOperators(updated, update, filter)
+    }
+    this.checkUnique(updated, index)
+    this.documents[index] = updated
+    return { before: target, after: updated }
+  }
+
+  async updateOne(filter, update, options) {
+    const changed = this.updateFirst(filter, update, options)
+    return { acknowledged: true, matchedCount: changed ? 1 : 0, modifiedCount: changed ? 1 : 0 }
+  }
+
+  async findOneAndUpdate(filter, update, options = {}) {
+    const changed = this.updateFirst(filter, update, options)
+    const value = changed && (options.returnDocument === 'after' ? changed.after : changed.before)
+    return { ok: 1, value: value ? copy(value) : null }
+  }
+
+  async deleteOne(filter) {
+    const index = this.documents.findIndex(doc => matches(doc, filter))
+    if (index !== -1) {
+      this.documents.splice(index, 1)
+    }
+    return { acknowledged: true, deletedCount: index === -1 ? 0 : 1 }
+  }
+}
+
+// A fresh in-memory database for stubModules({ mongodb }). Its collections,
+// by name, are on collections for tests to look inside.
+function fakeMongo() {
+  const collections = {}
+  const db = {
+    collection: name => collections[name] ??= new Collection(name),
+    async command() {
+      return { ok: 1 }
+    }
+  }
+  class MongoClient {
+    async connect() {}
+    db() {
+      return db
+    }
+    async close() {}
+  }
+  return { mongodb: { MongoClient, ObjectId, MongoServerError }, collections }
+}
+
+module.exports = { fakeMongo };
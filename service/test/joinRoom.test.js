@@ -0,0 +1,83 @@
+const test = require('node:test');
+const assert = require('node:assert');
+const crypto = require('node:crypto');
+const { stubModules } = require('./stubs.js')
+const { fakeMongo } = require('./fakeMongo.js')
+
+const { mongodb } = fakeMongo()
+stubModules({
+  mongodb,
+  uuid: { v4: () => crypto.randomUUID() },
+  bcrypt: { hash: async password => `hashed:${password}` }
+})
+
+const DB = require('../database.js')
+
+test.before(async () => {
+  const log = console.log
+  console.log = () => {}
+  await DB.connect({ url: 'mongodb://fake', timeoutMs: 1000, operationTimeouts: new Map() })
+  console.log = log
+  await DB.createUser('Bob', 'secret')
+})
+
+async function openRoom() {
+  const room = await DB.createRoom('alice')
+  const id = String(room.id)
+  await DB.addOptionsToRoom(id, ['Pizza', 'Tacos'], 'alice')
+  return { id, code: room.code }
+}
+
+test('a username finds its user whatever the case or surrounding spaces', async () => {
+  const { token } = await DB.getUser('Bob')
+
+  for (const name of ['bob', 'BOB', ' bob ', '\tBob\n']) {
+    assert.strictEqual((await DB.getUser(name))?.token, token, JSON.stringify(name))
+  }
+})
+
+test('a name can\'t be registered again in another case or with spaces', async () => {
+  for (const name of ['bob', ' BOB ']) {
+    assert.strictEqual(await DB.createUser(name, 'other'), null, JSON.stringify(name))
+  }
+  assert.strictEqual((await DB.getUser('bob')).username, 'Bob')
+})
+
+test('a new name is stored without surrounding spaces', async () => {
+  const user = await DB.createUser('  Carol ', 'secret')
+
+  assert.strictEqual(user.username, 'Carol')
+  assert.strictEqual((await DB.getUser('carol')).token, user.token)
+})
+
+test('joining as Bob, bob and " bob " leaves one participant entry and one ballot', async () => {
+  const { id, code } = await openRoom()
+
+  for (const name of ['Bob', 'bob', ' bob ']) {
+    assert.ok(await DB.addParticipantToRoom(code, name), JSON.stringify(name))
+  }
+
+  const room = await DB.getRoomById(id)
+  assert.deepStrictEqual(room.participants, ['alice', 'Bob'])
+  assert.deepStrictEqual(room.votes.map(v => v.username), ['alice', 'Bob'])
+})
+
+test('joining again keeps the votes already cast', async () => {
+  const { id, code } = await openRoom()
+  await DB.addParticipantToRoom(code, 'Bob')
+  const { version } = await DB.getRoomById(id)
+  assert.ok(await DB.updateUserVotes(id, 'Bob', { Pizza: 4, Tacos: 1 }, version))
+
+  assert.ok(await DB.addParticipantToRoom(code, 'bob'))
+
+  const room = await DB.getRoomById(id)
+  assert.deepStrictEqual(room.votes.find(v => v.username === 'Bob').votes, { Pizza: 4, Tacos: 1 })
+})
+
+test('the owner joining their own room is not added again', async () => {
+  const { id, code } = await openRoom()
+
+  assert.ok(await DB.addParticipantToRoom(code, 'alice'))
+
+  assert.deepStrictEqual((await DB.getRoomById(id)).participants, ['alice'])
+})
@@ -0,0 +1,114 @@
+const test = require('node:test');
+const assert = require('node:assert');
+const crypto = require('node:crypto');
+const { stubModules, WebSocketServer, connectSocket, deliver } = require('./stubs.js')
+const { fakeMongo } = require('./fakeMongo.js')
+
+const { mongodb } = fakeMongo()
+stubModules({
+  mongodb,
+  ws: { WebSocketServer },
+  uuid: { v4: () => crypto.randomUUID() },
+  bcrypt: { hash: async password => `hashed:${password}` }
+})
+
+const DB = require('../database.js')
+const { peerProxy } = require('../peerProxy.js')
+
+test.before(async () => {
+  const log = console.log
+  console.log = () => {}
+  await DB.connect({ url: 'mongodb://fake', timeoutMs: 1000, operationTimeouts: new Map() })
+  console.log = log
+})
+
+// the user, registering them the first time
+async function signIn(username) {
+  return await DB.getUser(username) ?? await DB.createUser(username, 'secret')
+}
+
+// A room of alice's with two options that bob has just joined.
+async function roomWithGuest() {
+  const room = await DB.createRoom('alice')
+  const id = String(room.id)
+  await DB.addOptionsToRoom(id, ['Pizza', 'Tacos'], 'alice')
+  assert.ok(await DB.addParticipantToRoom(room.code, 'bob'))
+  return id
+}
+
+async function saveVotes(id, username, votes) {
+  const { version } = await DB.getRoomById(id)
+  assert.ok(await DB.updateUserVotes(id, username, votes, version))
+}
+
+test('the ballot a user starts with on joining can\'t be locked in', async () => {
+  const id = await roomWithGuest()
+
+  assert.strictEqual(await DB.lockInUser(id, 'bob'), false)
+  assert.deepStrictEqual((await DB.getRoomById(id)).lockedIn, [])
+})
+
+test('a ballot the user has saved can be locked in', async () => {
+  const id = await roomWithGuest()
+  await saveVotes(id, 'bob', { Pizza: 4, Tacos: 1 })
+
+  assert.strictEqual(await DB.lockInUser(id, 'bob'), true)
+  assert.deepStrictEqual((await DB.getRoomById(id)).lockedIn, ['bob'])
+})
+
+test('saving a ballot of all zeros still counts as voting', async () => {
+  const id = await roomWithGuest()
+  await saveVotes(id, 'bob', { Pizza: 0, Tacos: 0 })
+
+  assert.strictEqual(await DB.lockInUser(id, 'bob'), true)
+})
+
+test('locking in over the websocket right after joining is refused with NO_VOTES', async t => {
+  t.mock.method(console, 'log', () => {})
+  const { token } = await signIn('bob')
+  const id = await roomWithGuest()
+  const ws = await connectSocket(t, peerProxy, token)
+
+  await deliver(ws, { type: 'lock_in', room: id })
+
+  assert.deepStrictEqual(ws.sent.filter(m => m.type.startsWith('lock-in')), [{
+    type: 'lock-in-failed',
+    room: id,
+    code: 'NO_VOTES',
+    message: 'user bob has no recorded votes to lock in'
+  }])
+})
+
+// Sends a lock-in for bob and resolves with whatever the server answered.
+async function lockInOverSocket(t, id, votes) {
+  t.mock.method(console, 'log', () => {})
+  const { token } = await signIn('bob')
+  const ws = await connectSocket(t, peerProxy, token)
+  await deliver(ws, { type: 'lock_in', room: id, ...(votes && { votes }) })
+  return ws.sent.filter(m => m.type.startsWith('lock-in'))
+}
+
+test('a fresh, unedited ballot can\'t be locked in when every option must be scored', async t => {
+  const room = await DB.createRoom('alice', { requireComplete: true })
+  const id = String(room.id)
+  await DB.addOptionsToRoom(id, ['Pizza', 'Tacos'], 'alice')
+  await DB.addParticipantToRoom(room.code, 'bob')
+
+  const [answer] = await lockInOverSocket(t, id)
+
+  assert.strictEqual(answer.code, 'INCOMPLETE_BALLOT')
+  assert.match(answer.message, /unscored: Pizza, Tacos$/)
+  assert.deepStrictEqual((await DB.getRoomById(id)).lockedIn, [])
+})
+
+test('an option scored zero counts as unscored when every option must be scored', async t => {
+  const room = await DB.createRoom('alice', { requireComplete: true })
+  const id = String(room.id)
+  await DB.addOptionsToRoom(id, ['Pizza', 'Tacos'], 'alice')
+  await DB.addParticipantToRoom(room.code, 'bob')
+
+  const [answer] = await lockInOverSocket(t, id, { Pizza: 3, Tacos: 0 })
+
+  assert.strictEqual(answer.code, 'INCOMPLETE_BALLOT')
+  assert.match(answer.message, /unscored: Tacos$/)
+})
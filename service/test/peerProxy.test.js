@@ -0,0 +1,68 @@
+const test = require('node:test');
+const assert = require('node:assert');
+const crypto = require('node:crypto');
+const { stubModules, WebSocketServer, connectSocket, deliver } = require('./stubs.js')
+
+const DB = {
+  async getUserByToken(token) {
+    return token === 'good' ? { username: 'bob' } : null
+  },
+  // whatever the id, malformed or just unknown, there's no such room
+  async getRoomById() {
+    return null
+  }
+}
+
+stubModules({
+  './database.js': DB,
+  ws: { WebSocketServer },
+  uuid: { v4: () => crypto.randomUUID() }
+})
+
+const { peerProxy } = require('../peerProxy.js')
+
+// Connects as bob and resolves with the server's end of the socket.
+function connect(t) {
+  return connectSocket(t, peerProxy, 'good')
+}
+
+test('messages about a room that does not exist are turned away, not thrown', async t => {
+  t.mock.method(console, 'log', () => {})
+  t.mock.method(console, 'warn', () => {})
+  const errors = t.mock.method(console, 'error', () => {})
+  const ws = await connect(t)
+
+  for (const type of ['subscribe', 'new_option', 'close_room']) {
+    await deliver(ws, { type, room: 'bogus', option: 'pizza' })
+  }
+
+  assert.strictEqual(errors.mock.callCount(), 0)
+  assert.deepStrictEqual(ws.sent, [])
+})
+
+test('locking in to a room that does not exist tells the client why', async t => {
+  t.mock.method(console, 'log', () => {})
+  t.mock.method(console, 'warn', () => {})
+  const errors = t.mock.method(console, 'error', () => {})
+  const ws = await connect(t)
+
+  await deliver(ws, { type: 'lock_in', room: 'bogus', votes: { pizza: 3 } })
+
+  assert.strictEqual(errors.mock.callCount(), 0)
+  assert.deepStrictEqual(ws.sent, [{
+    type: 'lock-in-failed',
+    room: 'bogus',
+    code: 'ROOM_NOT_FOUND',
+    message: 'no room with id bogus'
+  }])
+})
+
+test('a message that is not JSON is logged rather than taking the server down', async t => {
+  t.mock.method(console, 'log', () => {})
+  const errors = t.mock.method(console, 'error', () => {})
+  const ws = await connect(t)
+
+  await Promise.all(ws.listeners('message').map(listener => listener.call(ws, '{not json')))
+
+  assert.strictEqual(errors.mock.callCount(), 1)
+})
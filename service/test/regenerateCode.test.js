@@ -0,0 +1,68 @@
+const test = require('node:test');
+const assert = require('node:assert');
+const crypto = require('node:crypto');
+const { stubModules } = require('./stubs.js')
+const { fakeMongo } = require('./fakeMongo.js')
+
+// the codes generateRoomCode hands out next, in order
+const nextCodes = []
+
+const { mongodb } = fakeMongo()
+stubModules({
+  mongodb,
+  uuid: { v4: () => crypto.randomUUID() },
+  bcrypt: {},
+  './roomCode.js': {
+    generateRoomCode: () => nextCodes.shift() ?? crypto.randomBytes(4).toString('hex').toUpperCase()
+  }
+})
+
+const DB = require('../database.js')
+
+test.before(async () => {
+  const log = console.log
+  console.log = () => {}
+  await DB.connect({ url: 'mongodb://fake', timeoutMs: 1000, operationTimeouts: new Map() })
+  console.log = log
+})
+
+async function closedRoomWithCode(code) {
+  const room = await DB.createRoom('carol', { code })
+  assert.ok(await DB.closeRoom(String(room.id)))
+  return room
+}
+
+test('a regenerated code skips one a closed room still holds', async () => {
+  await closedRoomWithCode('TAKEN1')
+  const room = await DB.createRoom('alice', { code: 'MINE01' })
+  nextCodes.push('TAKEN1', 'FRESH1')
+
+  const updated = await DB.regenerateRoomCode(String(room.id))
+
+  assert.strictEqual(updated.code, 'FRESH1')
+  assert.strictEqual(String((await DB.getRoomByCode('FRESH1'))._id), String(room.id))
+  assert.strictEqual((await DB.getRoomByCode('TAKEN1')).state, 'closed')
+})
+
+test('a regenerated code skips one a draft holds, and the room\'s own', async () => {
+  await DB.createRoom('carol', { code: 'DRAFT2', draft: true })
+  const room = await DB.createRoom('alice', { code: 'MINE02' })
+  nextCodes.push('MINE02', 'DRAFT2', 'FRESH2')
+
+  const updated = await DB.regenerateRoomCode(String(room.id))
+
+  assert.strictEqual(updated.code, 'FRESH2')
+})
+
+test('a draft whose code an open room took meanwhile is published with one no room holds', async () => {
+  await closedRoomWithCode('TAKEN3')
+  const draft = await DB.createRoom('alice', { code: 'CLASH3', draft: true })
+  await DB.createRoom('bob', { code: 'CLASH3' })
+  nextCodes.push('TAKEN3', 'FRESH3')
+
+  const published = await DB.publishRoom(String(draft.id))
+
+  assert.strictEqual(published.state, 'open')
+  assert.strictEqual(published.code, 'FRESH3')
+  assert.strictEqual(String((await DB.getRoomByCode('FRESH3'))._id), String(draft.id))
+})
@@ -0,0 +1,73 @@
+const test = require('node:test');
+const assert = require('node:assert');
+const crypto = require('node:crypto');
+const { stubModules } = require('./stubs.js')
+const { fakeMongo } = require('./fakeMongo.js')
+
+const { mongodb } = fakeMongo()
+stubModules({
+  mongodb,
+  uuid: { v4: () => crypto.randomUUID() },
+  bcrypt: {}
+})
+
+const DB = require('../database.js')
+
+test.before(async () => {
+  const log = console.log
+  console.log = () => {}
+  await DB.connect({ url: 'mongodb://fake', timeoutMs: 1000, operationTimeouts: new Map() })
+  console.log = log
+})
+
+// A room where bob has voted, left a note and locked in.
+async function votedRoom() {
+  const room = await DB.createRoom('alice')
+  const id = String(room.id)
+  await DB.addOptionsToRoom(id, ['Pizza', 'Tacos'], 'alice')
+  await DB.addParticipantToRoom(room.code, 'bob')
+  const { version } = await DB.getRoomById(id)
+  assert.ok(await DB.updateUserVotes(id, 'bob', { Pizza: 4, Tacos: 1 }, version, { Tacos: 'too messy' }))
+  assert.ok(await DB.lockInUser(id, 'bob'))
+  return id
+}
+
+async function reset(id) {
+  const { version } = await DB.getRoomById(id)
+  assert.ok(await DB.resetVotes(id, 'alice', version))
+  return await DB.getRoomById(id)
+}
+
+test('a reset zeroes every score and unlocks everyone', async () => {
+  const room = await reset(await votedRoom())
+  const bob = room.votes.find(v => v.username === 'bob')
+
+  assert.deepStrictEqual(bob.votes, { Pizza: 0, Tacos: 0 })
+  assert.deepStrictEqual(room.lockedIn, [])
+  assert.deepStrictEqual(room.lockIns, [])
+})
+
+test('a reset keeps the notes left on options', async () => {
+  const room = await reset(await votedRoom())
+
+  assert.deepStrictEqual(room.votes.find(v => v.username === 'bob').comments, { Tacos: 'too messy' })
+})
+
+test('after a reset a ballot counts as unsaved until its owner votes again', async () => {
+  const id = await votedRoom()
+  const room = await reset(id)
+
+  assert.strictEqual(room.votes.find(v => v.username === 'bob').updatedAt, undefined)
+  assert.strictEqual(await DB.lockInUser(id, 'bob'), false)
+
+  assert.ok(await DB.updateUserVotes(id, 'bob', { Pizza: 2, Tacos: 3 }, room.version))
+  assert.strictEqual(await DB.lockInUser(id, 'bob'), true)
+})
+
+test('a reset keeps the options and who\'s in the room', async () => {
+  const room = await reset(await votedRoom())
+
+  assert.deepStrictEqual(room.options, ['Pizza', 'Tacos'])
+  assert.deepStrictEqual(room.participants, ['alice', 'bob'])
+  assert.deepStrictEqual(room.votes.map(v => v.username), ['alice', 'bob'])
+})
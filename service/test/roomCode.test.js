@@ -0,0 +1,32 @@
+const test = require('node:test');
+const assert = require('node:assert');
+
+const { normalizeRoomCode, generateRoomCode, configureRoomCodes, defaultAlphabet } = require('../roomCode.js')
+
+test('codes typed in lower or mixed case match the stored upper case code', () => {
+  assert.strictEqual(normalizeRoomCode('abcd'), 'ABCD')
+  assert.strictEqual(normalizeRoomCode('aBc7'), 'ABC7')
+})
+
+test('spaces around a code are ignored', () => {
+  assert.strictEqual(normalizeRoomCode('  ABCD  '), 'ABCD')
+  assert.strictEqual(normalizeRoomCode('\tq7rx\n'), 'Q7RX')
+})
+
+test('a code already in canonical form is unchanged', () => {
+  assert.strictEqual(normalizeRoomCode('WXYZ23'), 'WXYZ23')
+})
+
+test('anything that could not be a code is turned away', () => {
+  for (const code of ['', '   ', 'ABC', 'A'.repeat(13), 'AB CD', 'ABCD!', 'ÄBCD', '../x']) {
+    assert.strictEqual(normalizeRoomCode(code), null, `${JSON.stringify(code)} was accepted`)
+  }
+})
+
+test('generated codes survive being normalized', () => {
+  configureRoomCodes({ length: 6, alphabet: defaultAlphabet })
+  for (let i = 0; i < 50; i++) {
+    const code = generateRoomCode()
+    assert.strictEqual(normalizeRoomCode(` ${code.toLowerCase()} `), code)
+  }
+})
@@ -0,0 +1,92 @@
+const test = require('node:test');
+const assert = require('node:assert');
+const { stubModules } = require('./stubs.js')
+
+// the room as the database has it after whatever join or leave the test makes
+const rooms = new Map()
+stubModules({
+  './database.js': {
+    async getRoomById(id) {
+      return rooms.get(String(id)) ?? null
+    }
+  }
+})
+
+const hub = require('../roomHub.js')
+
+function connection(user) {
+  return {
+    user,
+    received: [],
+    send(message) {
+      this.received.push(JSON.parse(message))
+    },
+    close() {}
+  }
+}
+
+// Subscribes the room's owner and a guest, and returns their connections with
+// the presence updates from subscribing already cleared.
+function openRoom(t, id, settings = {}) {
+  rooms.set(id, { _id: id, owner: 'alice', participants: ['alice', 'bob'], ...settings })
+  const owner = connection('alice')
+  const guest = connection('bob')
+  hub.subscribe(id, owner)
+  hub.subscribe(id, guest)
+  t.after(() => hub.endRoom(id))
+  owner.received.length = 0
+  guest.received.length = 0
+  return { owner, guest }
+}
+
+test('the owner hears when someone joins, with the new participant count', async t => {
+  const { owner, guest } = openRoom(t, 'join')
+
+  rooms.get('join').participants.push('carol')
+  await hub.broadcastParticipant('join', 'participant-joined', 'carol')
+
+  assert.deepStrictEqual(owner.received, [{ type: 'participant-joined', username: 'carol', participantCount: 3 }])
+  assert.deepStrictEqual(guest.received, [])
+})
+
+test('the owner hears when someone leaves, with the new participant count', async t => {
+  const { owner } = openRoom(t, 'leave')
+
+  rooms.get('leave').participants = ['alice']
+  hub.unsubscribeUser('leave', 'bob')
+  await hub.broadcastParticipant('leave', 'participant-left', 'bob')
+
+  assert.deepStrictEqual(owner.received, [
+    { type: 'presence', online: ['alice'] },
+    { type: 'participant-left', username: 'bob', participantCount: 1 }
+  ])
+})
+
+test('a kick is reported as a participant leaving', async t => {
+  const { owner } = openRoom(t, 'kick')
+
+  rooms.get('kick').participants = ['alice']
+  await hub.broadcastParticipant('kick', 'participant-left', 'bob', { kicked: true })
+
+  assert.deepStrictEqual(owner.received, [{ type: 'participant-left', username: 'bob', kicked: true, participantCount: 1 }])
+})
+
+test('rooms that announce participants tell everyone', async t => {
+  const { owner, guest } = openRoom(t, 'announce', { announceParticipants: true })
+
+  rooms.get('announce').participants.push('carol')
+  await hub.broadcastParticipant('announce', 'participant-joined', 'carol')
+
+  const event = { type: 'participant-joined', username: 'carol', participantCount: 3 }
+  assert.deepStrictEqual(owner.received, [event])
+  assert.deepStrictEqual(guest.received, [event])
+})
+
+test('nothing is sent for a room that no longer exists', async t => {
+  const { owner } = openRoom(t, 'gone')
+
+  rooms.delete('gone')
+  await hub.broadcastParticipant('gone', 'participant-joined', 'carol')
+
+  assert.deepStrictEqual(owner.received, [])
+})
@@ -0,0 +1,53 @@
+const test = require('node:test');
+const assert = require('node:assert');
+
+const { toRoomResponse } = require('../roomResponse.js')
+
+const options = ['Pizza', 'Tacos', 'Sushi', 'Curry', 'Burgers', 'Ramen', 'Salad', 'Pho']
+
+function room(settings = {}) {
+  return {
+    _id: 'room1',
+    owner: 'alice',
+    options: [...options],
+    participants: ['alice', 'bob', 'carol'],
+    votes: [],
+    shuffleOptions: true,
+    ...settings
+  }
+}
+
+test('the same user gets the same order every time', () => {
+  const first = toRoomResponse(room(), 'bob').options
+  const second = toRoomResponse(room(), 'bob').options
+
+  assert.deepStrictEqual(second, first)
+})
+
+test('the shuffled order holds every option exactly once', () => {
+  assert.deepStrictEqual(toRoomResponse(room(), 'bob').options.toSorted(), options.toSorted())
+})
+
+test('different users, or the same user in another room, see different orders', () => {
+  const bob = toRoomResponse(room(), 'bob').options
+
+  assert.notDeepStrictEqual(toRoomResponse(room(), 'carol').options, bob)
+  assert.notDeepStrictEqual(toRoomResponse(room({ _id: 'room2' }), 'bob').options, bob)
+})
+
+test('shuffling leaves the room\'s own order alone', () => {
+  const stored = room()
+  toRoomResponse(stored, 'bob')
+
+  assert.deepStrictEqual(stored.options, options)
+})
+
+test('pinned options stay at the top of a shuffled list', () => {
+  const { options: shown } = toRoomResponse(room({ pinnedOptions: ['Pho', 'Curry'] }), 'bob')
+
+  assert.deepStrictEqual(shown.slice(0, 2), ['Pho', 'Curry'])
+})
+
+test('rooms that don\'t shuffle show options as stored', () => {
+  assert.deepStrictEqual(toRoomResponse(room({ shuffleOptions: false }), 'bob').options, options)
+})
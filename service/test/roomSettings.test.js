@@ -0,0 +1,59 @@
+const test = require('node:test');
+const assert = require('node:assert');
+const crypto = require('node:crypto');
+const { stubModules } = require('./stubs.js')
+const { fakeMongo } = require('./fakeMongo.js')
+
+const { mongodb } = fakeMongo()
+stubModules({
+  mongodb,
+  uuid: { v4: () => crypto.randomUUID() },
+  bcrypt: {}
+})
+
+const DB = require('../database.js')
+const { frozenChanges, roomSettings } = require('../roomSettings.js')
+
+test.before(async () => {
+  const log = console.log
+  console.log = () => {}
+  await DB.connect({ url: 'mongodb://fake', timeoutMs: 1000, operationTimeouts: new Map() })
+  console.log = log
+})
+
+const current = roomSettings({ weights: { bob: 2 } })
+
+test('changing weights counts as changing a frozen setting', () => {
+  assert.deepStrictEqual(frozenChanges({ weights: { bob: 3 } }, current), ['weights'])
+  assert.deepStrictEqual(frozenChanges({ weights: {} }, current), ['weights'])
+})
+
+test('sending the current weights again changes nothing frozen', () => {
+  assert.deepStrictEqual(frozenChanges({ weights: { bob: 2 } }, current), [])
+})
+
+test('settings that don\'t affect the outcome aren\'t frozen', () => {
+  assert.deepStrictEqual(frozenChanges({ shuffleOptions: true, tallyPreview: false }, current), [])
+  assert.deepStrictEqual(frozenChanges({ votingMethod: 'borda', tallyPreview: false }, current), ['votingMethod'])
+})
+
+test('weights can\'t be changed in the database once someone has voted', async () => {
+  const room = await DB.createRoom('alice', { weights: { bob: 2 } })
+  const id = String(room.id)
+  await DB.addOptionsToRoom(id, ['Pizza', 'Tacos'], 'alice')
+  await DB.addParticipantToRoom(room.code, 'bob')
+  const before = await DB.getRoomById(id)
+  assert.ok(await DB.updateUserVotes(id, 'bob', { Pizza: 4, Tacos: 1 }, before.version))
+
+  const { version } = await DB.getRoomById(id)
+  assert.strictEqual(await DB.updateRoomSettings(id, { weights: { bob: 5 } }, true, version), false)
+  assert.deepStrictEqual((await DB.getRoomById(id)).weights, { bob: 2 })
+})
+
+test('weights can change before anyone has voted', async () => {
+  const room = await DB.createRoom('alice', { weights: { bob: 2 } })
+  const id = String(room.id)
+
+  assert.strictEqual(await DB.updateRoomSettings(id, { weights: { bob: 5 } }, true, 0), true)
+  assert.deepStrictEqual((await DB.getRoomById(id)).weights, { bob: 5 })
+})
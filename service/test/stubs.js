@@ -0,0 +1,78 @@
+const Module = require('module');
+const { EventEmitter } = require('node:events');
+
+// Swaps the modules named in stubs, by the path they're required with, for
+// the given stand-ins, so the service's own modules can be tested without
+// mongo or a running server. Call it before requiring anything under test;
+// node --test runs each file in its own process, so stubs don't leak between
+// files.
+function stubModules(stubs) {
+  const load = Module._load
+  Module._load = function (request, parent, isMain) {
+    if (Object.hasOwn(stubs, request)) {
+      return stubs[request]
+    }
+    return load.call(this, request, parent, isMain)
+  }
+}
+
+// Resolves after anything already queued, so concurrent calls interleave the
+// way they would against a real database.
+function tick() {
+  return new Promise(resolve => setImmediate(resolve))
+}
+
+// The server's end of a websocket, keeping what it's sent for the test to
+// read back.
+class FakeSocket extends EventEmitter {
+  constructor() {
+    super()
+    this.sent = []
+  }
+  send(message) {
+    this.sent.push(JSON.parse(message))
+  }
+  ping() {}
+  terminate() {}
+  close() {}
+}
+
+// Stands in for ws's WebSocketServer, accepting every upgrade with a
+// FakeSocket the test can talk through.
+class WebSocketServer extends EventEmitter {
+  constructor() {
+    super()
+    this.sockets = []
+    WebSocketServer.last = this
+  }
+  handleUpgrade(_request, _socket, _head, done) {
+    const ws = new FakeSocket()
+    this.sockets.push(ws)
+    done(ws)
+  }
+  close() {}
+}
+
+// Opens a websocket to a peerProxy on a fake http server, signed in with
+// token, and resolves with the server's end of it. The proxy is closed when
+// the test ends.
+async function connectSocket(t, peerProxy, token) {
+  const httpServer = new EventEmitter()
+  const proxy = peerProxy(httpServer)
+  t.after(() => proxy.close())
+  const wss = WebSocketServer.last
+
+  const socket = Object.assign(new EventEmitter(), { write() {}, destroy() {} })
+  httpServer.emit('upgrade', { headers: {}, rawHeaders: ['Cookie', `token=${token}`] }, socket, Buffer.alloc(0))
+  while (wss.sockets.length === 0) {
+    await tick()
+  }
+  return wss.sockets[0]
+}
+
+// Sends a message and waits for the server to finish handling it.
+async function deliver(ws, message) {
+  await Promise.all(ws.listeners('message').map(listener => listener.call(ws, JSON.stringify(message))))
+}
+
+module.exports = { stubModules, tick, WebSocketServer, connectSocket, deliver };
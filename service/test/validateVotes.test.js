@@ -0,0 +1,23 @@
+const test = require('node:test');
+const assert = require('node:assert');
+
+const { unscoredOptions } = require('../validateVotes.js')
+
+const room = { votingMethod: 'score', options: ['Pizza', 'Tacos', 'Sushi'] }
+
+test('options left out of a ballot are unscored', () => {
+  assert.deepStrictEqual(unscoredOptions(room, { Pizza: 2 }), ['Tacos', 'Sushi'])
+  assert.deepStrictEqual(unscoredOptions(room, undefined), ['Pizza', 'Tacos', 'Sushi'])
+})
+
+test('options scored zero are unscored', () => {
+  assert.deepStrictEqual(unscoredOptions(room, { Pizza: 2, Tacos: 0, Sushi: 1 }), ['Tacos'])
+})
+
+test('a ballot scoring every option is complete', () => {
+  assert.deepStrictEqual(unscoredOptions(room, { Pizza: 2, Tacos: 5, Sushi: 1 }), [])
+})
+
+test('approval ballots are always complete', () => {
+  assert.deepStrictEqual(unscoredOptions({ ...room, votingMethod: 'approval' }, { Pizza: 1, Tacos: 0 }), [])
+})
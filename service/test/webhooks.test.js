@@ -0,0 +1,66 @@
+const test = require('node:test');
+const assert = require('node:assert');
+const { stubModules } = require('./stubs.js')
+
+// what each host resolves to, as dns.lookup(host, { all: true }) would say
+const records = {
+  'hooks.example.com': [{ address: '93.184.216.34', family: 4 }],
+  'mixed.example.com': [{ address: '93.184.216.34', family: 4 }, { address: '10.0.0.5', family: 4 }],
+  'metadata.example.com': [{ address: '169.254.169.254', family: 4 }],
+  'mapped.example.com': [{ address: '::ffff:7f00:1', family: 6 }],
+  'multicast.example.com': [{ address: 'ff02::1', family: 6 }]
+}
+
+stubModules({
+  dns: {
+    lookup(hostname, options, callback) {
+      const addresses = records[hostname]
+      if (!addresses) {
+        callback(Object.assign(new Error(`getaddrinfo ENOTFOUND ${hostname}`), { code: 'ENOTFOUND' }))
+        return
+      }
+      callback(null, options.all ? addresses : addresses[0].address, addresses[0].family)
+    }
+  }
+})
+
+const { checkWebhookUrl, publicLookup } = require('../webhooks.js')
+
+function lookup(hostname, options = {}) {
+  return new Promise((resolve, reject) => publicLookup(hostname, options, (err, ...result) => {
+    if (err) {
+      reject(err)
+    } else {
+      resolve(result)
+    }
+  }))
+}
+
+test('a public host resolves as usual, for single and all-address lookups', async () => {
+  assert.deepStrictEqual(await lookup('hooks.example.com'), ['93.184.216.34', 4])
+  assert.deepStrictEqual(await lookup('hooks.example.com', { all: true }), [records['hooks.example.com']])
+})
+
+test('a host with any internal address is refused at connect time', async () => {
+  for (const host of ['mixed.example.com', 'metadata.example.com', 'mapped.example.com', 'multicast.example.com']) {
+    await assert.rejects(lookup(host), { name: 'InternalAddressError' }, host)
+  }
+})
+
+test('lookup failures are passed on unchanged', async () => {
+  await assert.rejects(lookup('nowhere.example.com'), { code: 'ENOTFOUND' })
+})
+
+test('URLs naming an internal address are rejected when saved', () => {
+  for (const url of [
+    'https://127.0.0.1/hook',
+    'https://[::ffff:127.0.0.1]/hook',
+    'https://[::ffff:a9fe:a9fe]/hook',
+    'https://224.0.0.1/hook',
+    'https://[ff02::1]/hook',
+    'https://localhost/hook'
+  ]) {
+    assert.notStrictEqual(checkWebhookUrl(url), null, url)
+  }
+  assert.strictEqual(checkWebhookUrl('https://hooks.example.com/hook'), null)
+})
@@ -0,0 +1,44 @@
+const tieBreaks = ['earliest-added', 'alphabetical', 'random-seeded']
+
+// mulberry32, a small seeded PRNG so random tie breaks can be replayed
+function seededRandom(seed) {
+  let state = seed >>> 0
+  return () => {
+    state = (state + 0x6D2B79F5) >>> 0
+    let t = state
+    t = Math.imul(t ^ (t >>> 15), t | 1)
+    t ^= t + Math.imul(t ^ (t >>> 7), t | 61)
+    return ((t ^ (t >>> 14)) >>> 0) / 4294967296
+  }
+}
+
+function randomSeed() {
+  return Math.floor(Math.random() * 4294967296)
+}
+
+// Returns a comparator that orders tied options according to the room's
+// tie break setting. Options that compare lower place higher.
+function tieBreakComparator(room, seed) {
+  const options = room.options ?? []
+  if (room.tieBreak === 'alphabetical') {
+    return (a, b) => a.localeCompare(b)
+  }
+  if (room.tieBreak === 'random-seeded') {
+    const random = seededRandom(seed)
+    const keys = new Map(options.map(opt => [opt, random()]))
+    return (a, b) => (keys.get(a) ?? 1) - (keys.get(b) ?? 1)
+  }
+  const position = new Map(options.map((opt, i) => [opt, i]))
+  return (a, b) => (position.get(a) ?? options.length) - (position.get(b) ?? options.length)
+}
+
+// Groups of two or more options that share the same score.
+function findTies(scores) {
+  const byScore = new Map()
+  scores.forEach((score, option) => {
+    byScore.set(score, [...(byScore.get(score) ?? []), option])
+  })
+  return Array.from(byScore.values()).filter(group => group.length > 1)
+}
+
+module.exports = { tieBreaks, tieBreakComparator, seededRandom, randomSeed, findTies };
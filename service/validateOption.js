@@ -0,0 +1,105 @@
+const DEFAULT_MAX_OPTION_LENGTH = 100
+const MAX_OPTION_LENGTH_LIMIT = 500
+// how many options a new room takes unless its owner says otherwise
+const DEFAULT_MAX_OPTIONS = 50
+
+// Collapses runs of whitespace, newlines and tabs included, into single
+// spaces and trims the ends. Anything that isn't a string is left for
+// validateOptionName to reject.
+function normalizeOptionName(name) {
+  return typeof name === 'string' ? name.replace(/\s+/g, ' ').trim() : name
+}
+
+// Options that differ only in case are the same option, so "Pizza" and
+// "pizza" can't split the vote. The original casing is kept for display.
+function sameOption(a, b) {
+  return a.toLowerCase() === b.toLowerCase()
+}
+
+// Checks a normalized option name against the room's length limit.
+function validateOptionName(room, name) {
+  if (typeof name !== 'string' || name === '') {
+    return { status: 400, code: 'INVALID_OPTION', msg: 'Option must be a non-empty string' }
+  }
+  if (/\p{Cc}/u.test(name)) {
+    return { status: 400, code: 'INVALID_OPTION', msg: 'Option must not contain control characters' }
+  }
+  // option names become keys in mongo update paths such as
+  // optionAuthors.<option>, where a dot would nest and a leading $ is an operator
+  if (name.includes('.') || name.startsWith('$')) {
+    return { status: 400, code: 'INVALID_OPTION', msg: 'Option must not contain "." or start with "$"' }
+  }
+  const maxLength = room.maxOptionLength ?? DEFAULT_MAX_OPTION_LENGTH
+  if (name.length > maxLength) {
+    return { status: 400, code: 'INVALID_OPTION', msg: `Option must be at most ${maxLength} characters` }
+  }
+  return null
+}
+
+// Checks whether a user may add a new option to a room. Returns the status,
+// error code and message to reject with, or null if the option can be added.
+// The option should already be normalized.
+function validateNewOption(room, username, option) {
+  const invalidName = validateOptionName(room, option)
+  if (invalidName) {
+    return invalidName
+  }
+  // owners can add options to a draft room before publishing it
+  if (room.state !== 'open' && room.state !== 'draft') {
+    return { status: 409, code: 'ROOM_CLOSED', msg: 'Room is not open' }
+  }
+  if (!room.participants.includes(username)) {
+    return { status: 403, code: 'NOT_PARTICIPANT', msg: 'User is not allowed to add options to room' }
+  }
+  if (room.options.some(opt => sameOption(opt, option))) {
+    return { status: 409, code: 'OPTION_EXISTS', msg: 'Option already exists' }
+  }
+
+  if (room.maxOptions > 0 && room.options.length >= room.maxOptions) {
+    return { status: 409, code: 'OPTION_LIMIT_REACHED', msg: `Room has reached its limit of ${room.maxOptions} options` }
+  }
+
+  // a limit of 0 (or unset) means unlimited, and the owner is never limited
+  if (room.maxOptionsPerUser > 0 && room.owner !== username) {
+    const added = Object.values(room.optionAuthors ?? {}).filter(author => author === username).length
+    if (added >= room.maxOptionsPerUser) {
+      return { status: 409, code: 'OPTION_QUOTA_REACHED', msg: `User may only add ${room.maxOptionsPerUser} options` }
+    }
+  }
+  return null
+}
+
+const maxDescriptionLength = 500
+const maxImageUrlLength = 2048
+
+// Checks the optional description and image that can accompany an option.
+// Returns the same shape as validateNewOption.
+function validateOptionDetails({ description, imageUrl }) {
+  if (description !== undefined &&
+    (typeof description !== 'string' || description.length > maxDescriptionLength)) {
+    return { status: 400, code: 'INVALID_FIELD', msg: `description must be at most ${maxDescriptionLength} characters` }
+  }
+  if (imageUrl !== undefined) {
+    let url
+    try {
+      url = new URL(imageUrl)
+    } catch {
+      url = null
+    }
+    if (!url || !['http:', 'https:'].includes(url.protocol) || imageUrl.length > maxImageUrlLength) {
+      return { status: 400, code: 'INVALID_FIELD', msg: 'imageUrl must be an http or https URL' }
+    }
+  }
+  return null
+}
+
+module.exports = {
+  normalizeOptionName,
+  sameOption,
+  validateOptionName,
+  validateNewOption,
+  validateOptionDetails,
+  DEFAULT_MAX_OPTION_LENGTH,
+  MAX_OPTION_LENGTH_LIMIT,
+  DEFAULT_MAX_OPTIONS
+};
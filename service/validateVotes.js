@@ -0,0 +1,86 @@
+const DEFAULT_MIN_SCORE = 0
+const DEFAULT_MAX_SCORE = 5
+
+// Returns a message describing the first problem with a submitted ballot,
+// or null if the ballot is acceptable for the room.
+function validateVotes(room, votes) {
+  if (typeof votes !== 'object' || votes === null || Array.isArray(votes)) {
+    return 'Votes must be an object mapping options to scores'
+  }
+  for (const [option, score] of Object.entries(votes)) {
+    if (!room.options.includes(option)) {
+      return `Option ${option} does not exist`
+    }
+    if (!Number.isInteger(score)) {
+      return `Score for ${option} must be an integer`
+    }
+    if (room.votingMethod === 'approval') {
+      if (score !== 0 && score !== 1) {
+        return `Score for ${option} must be 0 or 1 in an approval vote`
+      }
+      continue
+    }
+    const minScore = room.minScore ?? DEFAULT_MIN_SCORE
+    const maxScore = room.maxScore ?? DEFAULT_MAX_SCORE
+    if (score < minScore || score > maxScore) {
+      return `Score for ${option} must be between ${minScore} and ${maxScore}`
+    }
+  }
+  // a budget of 0 (or unset) means unlimited
+  if (room.totalBudget > 0) {
+    const spent = Object.values(votes).reduce((sum, score) => sum + score, 0)
+    if (spent > room.totalBudget) {
+      return `Votes exceed budget of ${room.totalBudget} by ${spent - room.totalBudget}`
+    }
+  }
+  return null
+}
+
+const MAX_COMMENT_LENGTH = 280
+
+// control characters other than newlines, which a note can keep
+const controlCharacters = /[\u0000-\u0009\u000B-\u001F\u007F-\u009F]/g
+
+// Checks the notes a voter left on options ({ option: note }) and tidies
+// them up. Returns { comments } with empty notes dropped, or { error }.
+function cleanComments(room, comments) {
+  if (typeof comments !== 'object' || comments === null || Array.isArray(comments)) {
+    return { error: 'Comments must be an object mapping options to notes' }
+  }
+  const cleaned = {}
+  for (const [option, note] of Object.entries(comments)) {
+    if (!room.options.includes(option)) {
+      return { error: `Option ${option} does not exist` }
+    }
+    if (typeof note !== 'string') {
+      return { error: `Comment on ${option} must be a string` }
+    }
+    const text = note.replace(controlCharacters, '').trim()
+    if (text.length > MAX_COMMENT_LENGTH) {
+      return { error: `Comment on ${option} must be at most ${MAX_COMMENT_LENGTH} characters` }
+    }
+    if (text !== '') {
+      cleaned[option] = text
+    }
+  }
+  return { comments: cleaned }
+}
+
+// The options a ballot leaves out or leaves at zero, for rooms that want
+// every option scored. Ballots start out all zeros, so a zero can't be told
+// apart from an option nobody touched. Approval rooms are never incomplete,
+// as leaving an option unapproved is an answer.
+function unscoredOptions(room, votes) {
+  if (room.votingMethod === 'approval') {
+    return []
+  }
+  return room.options.filter(option => !votes?.[option])
+}
+
+// Ballots are seeded with zeros, so voting has only started once someone
+// gives an option a non-zero score.
+function hasVotesCast(room) {
+  return room.votes.some(v => Object.values(v.votes).some(score => score !== 0))
+}
+
+module.exports = { validateVotes, cleanComments, unscoredOptions, hasVotesCast, DEFAULT_MIN_SCORE, DEFAULT_MAX_SCORE };
@@ -0,0 +1,187 @@
+const crypto = require('crypto');
+const dns = require('dns');
+const https = require('https');
+const net = require('net');
+
+// Addresses a webhook must never reach: loopback, private networks,
+// link-local (which includes cloud metadata services), multicast and the
+// like. IPv4-mapped IPv6 addresses are checked as the IPv4 they stand for.
+const internalAddresses = new net.BlockList()
+internalAddresses.addSubnet('0.0.0.0', 8)
+internalAddresses.addSubnet('10.0.0.0', 8)
+internalAddresses.addSubnet('100.64.0.0', 10)
+internalAddresses.addSubnet('127.0.0.0', 8)
+internalAddresses.addSubnet('169.254.0.0', 16)
+internalAddresses.addSubnet('172.16.0.0', 12)
+internalAddresses.addSubnet('192.168.0.0', 16)
+internalAddresses.addSubnet('224.0.0.0', 4)
+internalAddresses.addSubnet('240.0.0.0', 4)
+internalAddresses.addSubnet('::', 128, 'ipv6')
+internalAddresses.addSubnet('::1', 128, 'ipv6')
+internalAddresses.addSubnet('fc00::', 7, 'ipv6')
+internalAddresses.addSubnet('fe80::', 10, 'ipv6')
+internalAddresses.addSubnet('ff00::', 8, 'ipv6')
+
+const internalHostSuffixes = ['localhost', '.local', '.internal']
+
+// delays before each retry of a failed delivery
+const retryDelaysMs = [1000, 5000, 30000, 120000]
+const deliveryTimeoutMs = 5000
+
+// signs every delivery; webhooks are off without it
+let signingSecret = null
+
+function configureWebhooks({ secret }) {
+  signingSecret = secret ?? null
+}
+
+function webhooksEnabled() {
+  return signingSecret !== null
+}
+
+// The IPv4 address an IPv4-mapped IPv6 address stands for, e.g.
+// ::ffff:127.0.0.1 or ::ffff:7f00:1 for 127.0.0.1, or undefined for any other.
+function mappedIpv4(address) {
+  const match = /^(?:0*:)*:?ffff:(.+)$/i.exec(address)
+  if (!match) {
+    return undefined
+  }
+  if (net.isIPv4(match[1])) {
+    return match[1]
+  }
+  const hex = /^([0-9a-f]{1,4}):([0-9a-f]{1,4})$/i.exec(match[1])
+  if (!hex) {
+    return undefined
+  }
+  const [high, low] = [parseInt(hex[1], 16), parseInt(hex[2], 16)]
+  return [high >> 8, high & 0xff, low >> 8, low & 0xff].join('.')
+}
+
+function isInternalAddress(address) {
+  const ipv4 = net.isIPv4(address) ? address : mappedIpv4(address)
+  return ipv4
+    ? internalAddresses.check(ipv4, 'ipv4')
+    : internalAddresses.check(address, 'ipv6')
+}
+
+// Returns a message for a URL webhooks can't be sent to, or null. Only the
+// URL itself is checked here; where its host resolves to is checked on each
+// delivery, since that can change.
+function checkWebhookUrl(value) {
+  let url
+  try {
+    url = new URL(value)
+  } catch {
+    return 'webhookUrl must be a URL'
+  }
+  if (url.protocol !== 'https:') {
+    return 'webhookUrl must use https'
+  }
+  if (url.username || url.password) {
+    return 'webhookUrl must not contain credentials'
+  }
+  const host = url.hostname.replace(/^\[|\]$/g, '').toLowerCase()
+  if (internalHostSuffixes.some(suffix => host === suffix.replace(/^\./, '') || host.endsWith(suffix))) {
+    return 'webhookUrl must not point at an internal host'
+  }
+  if (net.isIP(host) && isInternalAddress(host)) {
+    return 'webhookUrl must not point at an internal address'
+  }
+  return null
+}
+
+class InternalAddressError extends Error {
+  constructor(hostname) {
+    super(`${hostname} resolves to an internal address`)
+    this.name = 'InternalAddressError'
+  }
+}
+
+// dns.lookup for webhook connections, failing with an InternalAddressError
+// unless every address the host resolves to is public. The connection is
+// made to the address checked here, so a host can't pass the check and then
+// resolve somewhere internal for the request itself.
+function publicLookup(hostname, options, callback) {
+  dns.lookup(hostname, { ...options, all: true }, (err, addresses) => {
+    if (err) {
+      callback(err)
+      return
+    }
+    if (addresses.length === 0 || addresses.some(({ address }) => isInternalAddress(address))) {
+      callback(new InternalAddressError(hostname))
+      return
+    }
+    if (options.all) {
+      callback(null, addresses)
+    } else {
+      callback(null, addresses[0].address, addresses[0].family)
+    }
+  })
+}
+
+// The signature a receiver recomputes to check a delivery came from us:
+// an HMAC-SHA256 of the timestamp and body, so an old delivery can't be
+// replayed as a new one.
+function sign(timestamp, body) {
+  return crypto.createHmac('sha256', signingSecret).update(`${timestamp}.${body}`).digest('hex')
+}
+
+function attemptDelivery(url, body) {
+  // an address in the URL is connected to without a lookup
+  const host = new URL(url).hostname.replace(/^\[|\]$/g, '')
+  if (net.isIP(host) && isInternalAddress(host)) {
+    return Promise.resolve('refused')
+  }
+  const timestamp = String(Date.now())
+  return new Promise(resolve => {
+    const request = https.request(url, {
+      method: 'POST',
+      headers: {
+        'Content-Type': 'application/json',
+        'Content-Length': Buffer.byteLength(body),
+        'X-QuikVote-Timestamp': timestamp,
+        'X-QuikVote-Signature': `sha256=${sign(timestamp, body)}`
+      },
+      lookup: publicLookup,
+      signal: AbortSignal.timeout(deliveryTimeoutMs)
+    }, response => {
+      response.resume()
+      const status = response.statusCode
+      if (status >= 200 && status < 300) {
+        resolve('delivered')
+      } else if (status >= 300 && status < 400) {
+        // redirects aren't followed, since one could lead anywhere,
+        // including somewhere internal
+        resolve('refused')
+      } else {
+        resolve('failed')
+      }
+    })
+    // not worth retrying an internal address; the host would have to move
+    request.on('error', err => resolve(err instanceof InternalAddressError ? 'refused' : 'failed'))
+    request.end(body)
+  })
+}
+
+// Posts payload to url in the background, retrying with growing delays until
+// it's accepted or the retries run out. Returns straight away.
+function sendWebhook(url, payload) {
+  if (!webhooksEnabled()) {
+    return
+  }
+  const body = JSON.stringify(payload)
+  let attempt = 0
+  async function deliver() {
+    const outcome = await attemptDelivery(url, body).catch(() => 'failed')
+    if (outcome === 'failed' && attempt < retryDelaysMs.length) {
+      setTimeout(deliver, retryDelaysMs[attempt++]).unref()
+      return
+    }
+    if (outcome !== 'delivered') {
+      console.warn(`webhook to ${new URL(url).host} ${outcome === 'refused' ? 'refused' : 'gave up'} after ${attempt + 1} attempt(s)`)
+    }
+  }
+  deliver()
+}
+
+module.exports = { configureWebhooks, webhooksEnabled, checkWebhookUrl, sendWebhook, publicLookup };
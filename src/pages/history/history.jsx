@@ -1,6 +1,6 @@
 import React, { useContext, useEffect, useState } from 'react';
 import './history.css';
-import { NavLink } from 'react-router-dom';
+import { NavLink, useNavigate } from 'react-router-dom';
 import dayjs from 'dayjs'
 import { UserContext } from '../../context/userContext';
 
@@ -24,7 +24,8 @@ export default function History() {
         setDataArray(body.history.map(h => ({
           winner: h.sortedOptions[0],
           runnersUp: h.sortedOptions.slice(1),
-          date: h.timestamp
+          date: h.timestamp,
+          roomId: h.roomId
         })))
       }
     }
@@ -64,10 +65,28 @@ export default function History() {
     winner: string
     runnersUp: string[]
     date: datetime
+    roomId: string
   }
 */
 function HistoryItem(props) {
-  const { winner, runnersUp, date } = props.data
+  const { winner, runnersUp, date, roomId } = props.data
+  const navigate = useNavigate()
+  const [cloneFailed, setCloneFailed] = useState(false)
+  // starts a new room with the same options; fails once the old room has expired
+  async function runAgain() {
+    const response = await fetch(`/api/room/${roomId}/clone`, {
+      method: 'POST',
+      headers: {
+        'Content-type': 'application/json; charset=UTF-8'
+      }
+    })
+    if (response.status == 201) {
+      const body = await response.json()
+      navigate(`/vote/${body.id}`)
+    } else {
+      setCloneFailed(true)
+    }
+  }
   function getRunnersUp() {
     const MAX_LENGTH = 3
     if (runnersUp.length <= MAX_LENGTH) {
@@ -85,6 +104,11 @@ function HistoryItem(props) {
       <h3 className="history-item__header">Winner: {winner}</h3>
       <p className="history-item__content">Runner up(s): {getRunnersUp()}</p>
       <p className="history-item__content">{getFormattedDate()}</p>
+      {roomId && (
+        <button className="history-item__button" onClick={runAgain} disabled={cloneFailed}>
+          {cloneFailed ? 'Room no longer available' : 'Run again'}
+        </button>
+      )}
     </li>
   )
 }
@@ -1,41 +1,70 @@
 import React, { useEffect, useState } from 'react';
 import './join.css';
-import { NavLink, useNavigate } from 'react-router-dom';
+import { NavLink, useNavigate, useSearchParams } from 'react-router-dom';
 import { getIconUrlFromSeed } from '../../utils';
 
 export default function Join() {
   useEffect(() => {
     document.title = 'Join QuikVote'
   }, [])
+  const [searchParams] = useSearchParams()
   const [roomCode, setRoomCode] = useState('')
   const [btnEnabled, setBtnEnabled] = useState(false)
+  // only shown once the room turns out to need a password
+  const [needsPassword, setNeedsPassword] = useState(false)
+  const [password, setPassword] = useState('')
+  const [error, setError] = useState('')
   const iconUrl = getIconUrlFromSeed(roomCode)
   const navigate = useNavigate()
-  const MAX_LENGTH = 4
+  // the server's limits replace these once they've loaded
+  const [codeLimits, setCodeLimits] = useState({ minLength: 4, maxLength: 12 })
+  useEffect(() => {
+    const fetchLimits = async () => {
+      const response = await fetch('/api/config')
+      if (response.status == 200) {
+        const body = await response.json()
+        setCodeLimits(body.roomCode)
+      }
+    }
+    fetchLimits().catch(console.error)
+
+    // links from a room's QR code carry the code along
+    const code = searchParams.get('code')
+    if (code) {
+      onCodeChange(code.toUpperCase().slice(0, codeLimits.maxLength))
+    }
+  }, [])
   async function onCodeChange(newVal) {
     setRoomCode(newVal)
-    if (newVal.length == 4) {
+    if (newVal.length >= codeLimits.minLength) {
       setBtnEnabled(true)
     } else {
       setBtnEnabled(false)
     }
   }
 
-  async function onBtnClick(event) {
+  async function onBtnClick(event, action = 'join') {
     event.preventDefault()
     setBtnEnabled(false)
-    const response = await fetch(`/api/room/${roomCode}/join`, {
+    const response = await fetch(`/api/room/${roomCode}/${action}`, {
       method: 'POST',
       headers: {
         'Content-type': 'application/json; charset=UTF-8'
-      }
+      },
+      body: JSON.stringify(needsPassword ? { password } : {})
     })
+    const body = await response.json()
     if (response.status == 200) {
-      const body = await response.json()
       navigate(`/vote/${body.id}`)
+      return
+    }
+    if (body.error?.code === 'WRONG_PASSWORD') {
+      setError(needsPassword ? 'Incorrect password' : '')
+      setNeedsPassword(true)
     } else {
-      setBtnEnabled(true)
+      setError(body.error?.message ?? '')
     }
+    setBtnEnabled(true)
   }
 
   return (
@@ -62,11 +91,25 @@ export default function Join() {
             type="text"
             value={roomCode}
             onChange={(event) => onCodeChange(event.target.value.toUpperCase())}
-            maxLength={MAX_LENGTH}
+            maxLength={codeLimits.maxLength}
             required />
+          {needsPassword && (
+            <>
+              <label className="join-form__label" htmlFor="password">This QuikVote needs a password:</label>
+              <input
+                className="join-form__input"
+                id="password"
+                name="password"
+                type="password"
+                value={password}
+                onChange={(event) => setPassword(event.target.value)} />
+            </>
+          )}
+          {error && <p className="join-form__error">{error}</p>}
           <img className="room-code__img join-form__img" src={iconUrl} alt="icon" />
           <p>Make sure this icon matches the QuikVote that you want to join</p>
           <button onClick={onBtnClick} className={`main__button ${btnEnabled ? '' : 'main__button--disabled'}`} >Join QuikVote</button>
+          <button onClick={event => onBtnClick(event, 'spectate')} className={`main__button ${btnEnabled ? '' : 'main__button--disabled'}`} >Just watch</button>
         </form>
       </main>
     </>
@@ -30,7 +30,7 @@ export default function Login() {
       setCurrentUser({ username })
       navigate('/')
     } else {
-      setDisplayError(`⚠ Error: ${body.msg}`);
+      setDisplayError(`⚠ Error: ${body.error.message}`);
     }
   }
 
@@ -48,7 +48,7 @@ export default function Login() {
       setCurrentUser({ username })
       navigate('/')
     } else {
-      setDisplayError(`⚠ Error: ${body.msg}`);
+      setDisplayError(`⚠ Error: ${body.error.message}`);
     }
   }
 
@@ -64,7 +64,7 @@ export default function Login() {
       setCurrentUser(null)
       // navigate('/')
     } else {
-      setDisplayError(`⚠ Error: ${body.msg}`);
+      setDisplayError(`⚠ Error: ${body.error.message}`);
     }
   }
 
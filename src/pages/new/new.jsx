@@ -3,6 +3,19 @@ import './new.css';
 import { NavLink } from 'react-router-dom';
 import { getIconUrlFromSeed } from '../../utils'
 
+// Kept for the browser tab's session so reloading this page shows the same
+// room instead of creating another. Cleared once the room is started.
+const ROOM_KEY_STORAGE = 'newRoomKey'
+
+function newRoomKey() {
+  let key = sessionStorage.getItem(ROOM_KEY_STORAGE)
+  if (!key) {
+    key = crypto.randomUUID()
+    sessionStorage.setItem(ROOM_KEY_STORAGE, key)
+  }
+  return key
+}
+
 export default function New() {
   useEffect(() => {
     document.title = 'New QuikVote'
@@ -10,7 +23,9 @@ export default function New() {
   const [copied, setCopied] = useState(false)
   const [roomCode, setRoomCode] = useState('')
   const [roomId, setRoomId] = useState('')
-  const iconUrl = getIconUrlFromSeed(roomCode)
+  const [joinUrl, setJoinUrl] = useState('')
+  const [avatarStyle, setAvatarStyle] = useState('icon')
+  const iconUrl = getIconUrlFromSeed(roomCode, avatarStyle)
   const navUrl = `/vote/${roomId}`
 
   useEffect(() => {
@@ -18,7 +33,8 @@ export default function New() {
       const response = await fetch('/api/room', {
         method: 'POST',
         headers: {
-          'Content-type': 'application/json; charset=UTF-8'
+          'Content-type': 'application/json; charset=UTF-8',
+          'Idempotency-Key': newRoomKey()
         }
       })
 
@@ -26,12 +42,42 @@ export default function New() {
       if (response.status == 201) {
         setRoomCode(body.code)
         setRoomId(body.id)
+        setJoinUrl(body.joinUrl ?? '')
+        setAvatarStyle(body.avatarStyle ?? 'icon')
       }
     }
 
     fetchData().catch(console.error)
   }, [])
 
+  async function toggleIdenticon(useIdenticon) {
+    const style = useIdenticon ? 'identicon' : 'icon'
+    const response = await fetch(`/api/room/${roomId}/settings`, {
+      method: 'PATCH',
+      headers: {
+        'Content-type': 'application/json; charset=UTF-8'
+      },
+      body: JSON.stringify({ avatarStyle: style })
+    })
+    if (response.status == 200) {
+      setAvatarStyle(style)
+    }
+  }
+
+  async function newCode() {
+    const response = await fetch(`/api/room/${roomId}/code`, {
+      method: 'POST',
+      headers: {
+        'Content-type': 'application/json; charset=UTF-8'
+      }
+    })
+    if (response.status == 200) {
+      const body = await response.json()
+      setRoomCode(body.code)
+      setJoinUrl(body.joinUrl ?? '')
+    }
+  }
+
   function copyToClipboard() {
     navigator.clipboard.writeText(roomCode)
     setCopied(true)
@@ -56,7 +102,10 @@ export default function New() {
       <main className="main">
         <div>
           {roomCode !== '' && (
-            <img src={iconUrl} alt="icon" className="room-code__img" />
+            <div className="room-code__images">
+              <img src={iconUrl} alt="icon" className="room-code__img" />
+              <img src={`/api/room/${roomId}/qr?code=${roomCode}`} alt="QR code to join" className="room-code__qr" />
+            </div>
           )}
           <button className="room-code" onClick={copyToClipboard}>
             <b>{roomCode}</b>
@@ -64,8 +113,26 @@ export default function New() {
             <span className={`room-code__toast ${copied ? 'room-code__toast--visible' : ''}`}>Copied</span>
           </button>
           <p className="room-code__note">Share your unique QuikVote with others!</p>
+          {joinUrl && <a className="room-code__link" href={joinUrl}>{joinUrl}</a>}
+          {roomCode !== '' && (
+            <label className="room-code__identicon">
+              <input
+                type="checkbox"
+                checked={avatarStyle === 'identicon'}
+                onChange={event => toggleIdenticon(event.target.checked).catch(console.error)}
+              />
+              Use a generated pattern as the icon
+            </label>
+          )}
+          {roomCode !== '' && (
+            <button className="room-code__regenerate" onClick={() => newCode().catch(console.error)}>Get a new code</button>
+          )}
         </div>
-        <NavLink className="main__button" to={navUrl}>Begin QuikVote</NavLink>
+        <NavLink
+          className="main__button"
+          to={navUrl}
+          onClick={() => sessionStorage.removeItem(ROOM_KEY_STORAGE)}
+        >Begin QuikVote</NavLink>
       </main>
     </>
   )
@@ -1,14 +1,38 @@
 import React, { useEffect, useState } from 'react';
 import './results.css';
-import { NavLink, useParams } from 'react-router-dom';
+import { NavLink, useLocation, useParams } from 'react-router-dom';
 
 export default function Results() {
   useEffect(() => {
     document.title = 'Results'
   }, [])
   const [items, setItems] = useState([])
+  const [totals, setTotals] = useState(new Map())
+  const [breakdowns, setBreakdowns] = useState(new Map())
+  // option -> the notes voters left on it, when we're allowed to see them
+  const [comments, setComments] = useState(new Map())
+  const [winners, setWinners] = useState(new Set())
+  const [winnerOverflow, setWinnerOverflow] = useState(0)
+  // hidden results are only shown to the owner, who can reveal them
+  const [visible, setVisible] = useState(true)
+  const [hiddenMessage, setHiddenMessage] = useState('')
   const { id: resultsId } = useParams()
+  const location = useLocation()
+  function showResult(body) {
+    setItems(body.results)
+    setTotals(new Map(body.totals.map(t => [t.option, t.total])))
+    setBreakdowns(new Map((body.breakdown ?? []).map(b => [b.option, b])))
+    setComments(new Map((body.comments ?? []).map(c => [c.option, c.comments])))
+    setWinners(new Set(body.winners ?? []))
+    setWinnerOverflow(body.winnerOverflow ?? 0)
+    setVisible(body.visible ?? true)
+  }
   useEffect(() => {
+    // the room's closer already has the result from closing it
+    if (location.state?.result) {
+      showResult(location.state.result)
+      return
+    }
     const fetchItems = async () => {
       const response = await fetch(`/api/results/${resultsId}`, {
         method: 'GET',
@@ -16,15 +40,44 @@ export default function Results() {
           'Content-type': 'application/json; charset=UTF-8'
         }
       })
-      const body = await response.json()
-      setItems(body.results)
+      if (response.status == 200) {
+        showResult(await response.json())
+      } else if (response.status == 403) {
+        const body = await response.json()
+        if (body.error?.code === 'RESULTS_HIDDEN') {
+          setHiddenMessage(body.error.message)
+        }
+      }
     }
 
     fetchItems().catch(console.error)
   }, [])
+  async function reveal() {
+    const response = await fetch(`/api/results/${resultsId}/reveal`, { method: 'POST' })
+    if (response.status == 200) {
+      setVisible(true)
+    }
+  }
   function renderItems() {
     return items.map((item, i) => (
-      <li className="results-list__item" key={i}>{item}</li>
+      <li className={`results-list__item${winners.has(item) ? ' results-list__item--winner' : ''}`} key={i}>
+        {item}
+        {totals.has(item) && (
+          <span className="results-list__total">{totals.get(item)}</span>
+        )}
+        {breakdowns.get(item)?.voters > 0 && (
+          <span className="results-list__breakdown">
+            avg {breakdowns.get(item).mean.toFixed(1)} ± {breakdowns.get(item).stdDev.toFixed(1)} from {breakdowns.get(item).voters}
+          </span>
+        )}
+        {comments.has(item) && (
+          <ul className="results-comments">
+            {comments.get(item).map((c, j) => (
+              <li key={j}>{c.username && <b>{c.username}: </b>}{c.text}</li>
+            ))}
+          </ul>
+        )}
+      </li>
     ))
   }
   return (
@@ -33,6 +86,15 @@ export default function Results() {
         <h1 className="header__title header__title--center">Results</h1>
       </header>
       <main className="main">
+        {hiddenMessage && <p className="results-note">{hiddenMessage}</p>}
+        {!visible && (
+          <button className="main__button" onClick={reveal}>Reveal results to everyone</button>
+        )}
+        {winnerOverflow > 0 && (
+          <p className="results-note">
+            A tie for the last winning place added {winnerOverflow} extra {winnerOverflow === 1 ? 'winner' : 'winners'}.
+          </p>
+        )}
         <ol className="results-list">
           {renderItems()}
         </ol>
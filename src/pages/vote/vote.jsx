@@ -1,26 +1,115 @@
-import React, { useEffect, useState } from 'react';
+import React, { useContext, useEffect, useState } from 'react';
 import './vote.css';
-import { NavLink, useParams } from 'react-router-dom';
+import { NavLink, useNavigate, useParams } from 'react-router-dom';
 import { WSHandler } from './websocket_handler'
+import { UserContext } from '../../context/userContext';
 
-const MIN_VALUE = 0
-const MAX_VALUE = 10
+const DEFAULT_MIN_VALUE = 0
+const DEFAULT_MAX_VALUE = 5
+const DEFAULT_START_VALUE = 3
+const REACTION_EMOJI = ['👍', '👎', '🤔', '❤️']
+
+function OptionDetails(props) {
+  if (!props.description && !props.imageUrl) {
+    return null
+  }
+  return (
+    <div className="option-details">
+      {props.imageUrl && <img className="option-details__image" src={props.imageUrl} alt="" />}
+      {props.description && <p className="option-details__description">{props.description}</p>}
+    </div>
+  )
+}
+
+function Reactions(props) {
+  return (
+    <span className="reactions">
+      {REACTION_EMOJI.map(emoji => (
+        <button
+          key={emoji}
+          className={`reactions__button ${props.mine === emoji ? 'reactions__button--mine' : ''}`}
+          onClick={() => props.onReact(emoji)}
+          disabled={props.disabled}
+        >
+          {emoji}{props.counts?.[emoji] > 0 && <span className="reactions__count">{props.counts[emoji]}</span>}
+        </button>
+      ))}
+    </span>
+  )
+}
+
+// Owners can pin an option to the top of the list; everyone else just sees
+// that it's pinned.
+function PinToggle(props) {
+  if (!props.canPin) {
+    return props.pinned ? <span className="pin-toggle pin-toggle--pinned" title="Pinned">📌</span> : null
+  }
+  return (
+    <button
+      className={`pin-toggle ${props.pinned ? 'pin-toggle--pinned' : ''}`}
+      onClick={props.onToggle}
+      title={props.pinned ? 'Unpin' : 'Pin to top'}
+    >
+      📌
+    </button>
+  )
+}
+
+const MAX_COMMENT_LENGTH = 280
+
+// An optional note explaining the voter's score for an option.
+function OptionComment(props) {
+  return (
+    <input
+      className="option-comment"
+      type="text"
+      placeholder="Why? (optional)"
+      maxLength={MAX_COMMENT_LENGTH}
+      value={props.value ?? ''}
+      onChange={(event) => props.setValue(event.target.value)}
+      disabled={props.disabled}
+    />
+  )
+}
+
+function ApprovalOption(props) {
+  const canApprove = props.value == 1 || props.max >= 1
+  return (
+    <li className="vote-options__item">{props.name}
+      {props.pin}
+      {props.details}
+      {props.reactions}
+      {props.comment}
+      <input
+        className="vote-checkbox"
+        type="checkbox"
+        checked={props.value == 1}
+        onChange={(event) => props.setValue(event.target.checked ? 1 : 0)}
+        disabled={props.disabled || !canApprove}
+      />
+    </li>
+  )
+}
 
 function VoteOption(props) {
   function increaseValue() {
-    if (props.value == MAX_VALUE) {
+    if (props.value >= props.max) {
       return
     }
     props.setValue(props.value + 1)
   }
   function decreaseValue() {
-    if (props.value == MIN_VALUE) {
+    if (props.value <= props.min) {
       return
     }
     props.setValue(props.value - 1)
   }
   return (
     <li className="vote-options__item">{props.name}
+      {props.pin}
+      {props.details}
+      {props.reactions}
+      {props.comment}
       <div className="vote-buttons">
         <button
           className={`vote-buttons__button ${props.disabled ? 'vote-buttons__button--disabled' : ''}`}
@@ -80,81 +169,431 @@ function AddOption(props) {
   )
 }
 
+function Chat(props) {
+  const [text, setText] = useState('')
+  function send(event) {
+    event.preventDefault()
+    props.onSend(text)
+    setText('')
+  }
+  return (
+    <section className="chat">
+      <ul className="chat__messages">
+        {props.messages.map(m => (
+          <li className="chat__message" key={m._id}>
+            <span className="chat__author">{m.username}</span> {m.text}
+          </li>
+        ))}
+      </ul>
+      <form className="add-option" onSubmit={send}>
+        <input
+          className="add-option__input"
+          type="text"
+          value={text}
+          maxLength={500}
+          onChange={(event) => setText(event.target.value)}
+          placeholder="Say something" />
+        <button
+          className={`add-option__button ${text.trim() == '' ? 'add-option__button--disabled' : ''}`}
+          type="submit"
+          disabled={text.trim() == ''}>
+          <span className="material-symbols-outlined">send</span>
+        </button>
+      </form>
+    </section>
+  )
+}
+
+// Owner-only bar chart of the standings so far.
+function LiveTally(props) {
+  const max = Math.max(1, ...props.tally.totals.map(t => Math.abs(t.total)))
+  return (
+    <ul className="live-tally">
+      {props.tally.totals.map(t => (
+        <li className="live-tally__row" key={t.option}>
+          <span className="live-tally__label">{t.option}</span>
+          <span className="live-tally__bar" style={{ width: `${Math.abs(t.total) / max * 100}%` }} />
+          <span className="live-tally__total">{t.total}</span>
+        </li>
+      ))}
+    </ul>
+  )
+}
+
+// Time left until the room's deadline, ticking down each second.
+function Countdown(props) {
+  const [now, setNow] = useState(Date.now())
+  useEffect(() => {
+    const timer = setInterval(() => setNow(Date.now()), 1000)
+    return () => clearInterval(timer)
+  }, [])
+  const seconds = Math.max(0, Math.ceil((props.deadline - now) / 1000))
+  const hours = Math.floor(seconds / 3600)
+  const minutes = Math.floor(seconds / 60) % 60
+  const pad = n => String(n).padStart(2, '0')
+  return (
+    <p className="vote-countdown">
+      Closes in {hours > 0 ? `${hours}:${pad(minutes)}` : minutes}:{pad(seconds % 60)}
+    </p>
+  )
+}
+
+function startValue(range) {
+  // budgeted and approval rooms start everyone at the minimum so no points
+  // (or approvals) are pre-spent
+  if (range.budget > 0 || range.approval) {
+    return range.min
+  }
+  return Math.min(Math.max(DEFAULT_START_VALUE, range.min), range.max)
+}
+
 export default function Vote() {
   useEffect(() => {
     document.title = 'QuikVote'
   }, [])
   const [options, setOptions] = useState([])
   const [values, setValues] = useState(new Map())
+  // the options the voter has actually scored, as opposed to left at their
+  // starting value, for rooms that want every option scored
+  const [scored, setScored] = useState(new Set())
   const [lockedIn, setLockedIn] = useState(false)
+  // waiting to hear whether a lock in sent over the socket went through
+  const [lockingIn, setLockingIn] = useState(false)
   const [isRoomOwner, setIsRoomOwner] = useState(false)
+  const [isSpectator, setIsSpectator] = useState(false)
+  const [shuffled, setShuffled] = useState(false)
+  const [requireComplete, setRequireComplete] = useState(false)
+  const [quorum, setQuorum] = useState(0)
   const [resultsId, setResultsId] = useState('')
+  // set when this client closed the room, so the results page needn't refetch
+  const [closedResult, setClosedResult] = useState(null)
   const [copied, setCopied] = useState(false)
   const [code, setCode] = useState('')
+  const [progress, setProgress] = useState({ lockedIn: 0, total: 0 })
+  // who has locked in, in the order they finished
+  const [finished, setFinished] = useState([])
+  const [messages, setMessages] = useState([])
+  const [reactions, setReactions] = useState({})
+  const [optionDetails, setOptionDetails] = useState({})
+  const [pinned, setPinned] = useState([])
+  // everyone with the room open right now, joined or just watching
+  const [online, setOnline] = useState([])
+  const [tally, setTally] = useState(null)
+  // local time the room closes at, or null if it has no deadline
+  const [deadline, setDeadline] = useState(null)
+  const [myReactions, setMyReactions] = useState({})
+  // option -> this user's note on it
+  const [comments, setComments] = useState({})
+  const [scoreRange, setScoreRange] = useState({ min: DEFAULT_MIN_VALUE, max: DEFAULT_MAX_VALUE, budget: 0, approval: false })
 
   const { id } = useParams()
+  const { currentUser } = useContext(UserContext)
+  const navigate = useNavigate()
 
-  useEffect(() => {
-    WSHandler.connect()
-    const fetchRoom = async () => {
-      const response = await fetch(`/api/room/${id}`, {
-        method: 'GET',
-        headers: {
-          'Content-type': 'application/json; charset=UTF-8'
+  // resetValues starts every option over, for when the scoring rules change
+  async function fetchRoom(resetValues) {
+    const response = await fetch(`/api/room/${id}`, {
+      method: 'GET',
+      headers: {
+        'Content-type': 'application/json; charset=UTF-8'
+      }
+    })
+    if (response.status == 200) {
+      const body = await response.json()
+      setCode(body.code)
+      const approval = body.votingMethod === 'approval'
+      const range = {
+        min: approval ? 0 : body.minScore ?? DEFAULT_MIN_VALUE,
+        max: approval ? 1 : body.maxScore ?? DEFAULT_MAX_VALUE,
+        budget: body.totalBudget ?? 0,
+        approval
+      }
+      setScoreRange(range)
+      if (resetValues) {
+        values.clear()
+        setScored(new Set())
+      }
+      body.options.forEach(opt => {
+        if (!values.has(opt)) {
+          values.set(opt, startValue(range))
         }
       })
-      if (response.status == 200) {
-        const body = await response.json()
-        setCode(body.code)
-        body.options.forEach(opt => {
-          if (!values.has(opt)) {
-            values.set(opt, 5)
-          }
-        })
-        setValues(new Map(values))
-        setOptions(body.options)
-        setIsRoomOwner(body.isOwner)
+      setValues(new Map(values))
+      setOptions(body.options)
+      setIsRoomOwner(body.isOwner)
+      setIsSpectator(body.isSpectator ?? false)
+      setShuffled(body.shuffleOptions ?? false)
+      setRequireComplete(body.requireComplete ?? false)
+      setQuorum(body.quorum ?? 0)
+      setDeadline(body.closesInMs == null ? null : Date.now() + body.closesInMs)
+      if (body.isOwner) {
+        fetchTally().catch(console.error)
       }
+      setProgress({ lockedIn: body.lockedInCount, total: body.participantCount })
+      setFinished(body.lockIns ?? [])
+      setReactions(body.reactions ?? {})
+      setOptionDetails(body.optionDetails ?? {})
+      setPinned(body.pinnedOptions ?? [])
+      setMyReactions(body.myReactions ?? {})
+      setComments(body.votes?.find(v => v.username === currentUser?.username)?.comments ?? {})
     }
-    fetchRoom().catch(console.error)
+  }
+
+  useEffect(() => {
+    WSHandler.connect()
+    WSHandler.subscribe(id)
+    fetchRoom(false).catch(console.error)
+    fetchMessages().catch(console.error)
   }, [])
 
+  async function fetchTally() {
+    const response = await fetch(`/api/room/${id}/tally`)
+    if (response.status == 200) {
+      setTally(await response.json())
+    }
+  }
+
+  async function fetchMessages() {
+    const response = await fetch(`/api/room/${id}/messages`)
+    if (response.status == 200) {
+      const body = await response.json()
+      setMessages(body.messages)
+    }
+  }
+
+  async function react(option, emoji) {
+    const response = await fetch(`/api/room/${id}/react`, {
+      method: 'POST',
+      headers: {
+        'Content-type': 'application/json; charset=UTF-8'
+      },
+      body: JSON.stringify({ option, emoji })
+    })
+    if (response.status == 200) {
+      setMyReactions(prev => ({ ...prev, [option]: emoji }))
+    }
+  }
+
+  async function togglePin(option) {
+    await fetch(`/api/room/${id}/pins`, {
+      method: pinned.includes(option) ? 'DELETE' : 'POST',
+      headers: {
+        'Content-type': 'application/json; charset=UTF-8'
+      },
+      body: JSON.stringify({ option })
+    })
+  }
+
+  async function sendMessage(text) {
+    await fetch(`/api/room/${id}/messages`, {
+      method: 'POST',
+      headers: {
+        'Content-type': 'application/json; charset=UTF-8'
+      },
+      body: JSON.stringify({ text })
+    })
+  }
+
   useEffect(() => {
     WSHandler.addHandler(receiveEvent)
 
     return () => WSHandler.removeHandler(receiveEvent)
   })
 
+  function updateOptions(new_options, renamed) {
+    if (renamed && values.has(renamed.from)) {
+      values.set(renamed.to, values.get(renamed.from))
+    }
+    if (renamed && scored.has(renamed.from)) {
+      setScored(new Set([...scored].filter(opt => opt !== renamed.from)).add(renamed.to))
+    }
+    // forget scores for options that were renamed or removed
+    Array.from(values.keys())
+      .filter(opt => !new_options.includes(opt))
+      .forEach(opt => values.delete(opt))
+    new_options.forEach(opt => {
+      if (!values.has(opt)) {
+        values.set(opt, startValue(scoreRange))
+      }
+    })
+    setValues(new Map(values))
+    if (!shuffled) {
+      setOptions(new_options)
+      return
+    }
+    // keep this user's shuffled order, adding new options at the end
+    setOptions(prev => {
+      const kept = prev
+        .map(opt => renamed && opt === renamed.from ? renamed.to : opt)
+        .filter(opt => new_options.includes(opt))
+      return [...kept, ...new_options.filter(opt => !kept.includes(opt))]
+    })
+  }
+
   function receiveEvent(event) {
     if (event.type == 'options') {
-      const new_options = event.options
-      new_options.forEach(opt => {
-        if (!values.has(opt)) {
-          values.set(opt, 5)
+      updateOptions(event.options, event.renamed)
+      setOptionDetails(prev => {
+        const next = { ...prev, ...event.details }
+        if (event.renamed) {
+          next[event.renamed.to] = next[event.renamed.from]
+          delete next[event.renamed.from]
         }
+        return next
       })
+      if (event.renamed) {
+        setPinned(prev => prev.map(opt => opt === event.renamed.from ? event.renamed.to : opt))
+      }
+    } else if (event.type == 'pins') {
+      setPinned(event.pinnedOptions)
+    } else if (event.type == 'code') {
+      setCode(event.code)
+    } else if (event.type == 'presence') {
+      setOnline(event.online)
+    } else if (event.type == 'room') {
+      updateOptions(event.room.options)
+      if (event.online) {
+        setOnline(event.online)
+      }
+      setProgress({ lockedIn: event.room.lockedInCount, total: event.room.participantCount })
+      setFinished(event.room.lockIns ?? [])
+      setDeadline(event.room.closesInMs == null ? null : Date.now() + event.room.closesInMs)
+    } else if (event.type == 'deadline') {
+      setDeadline(event.closesInMs == null ? null : Date.now() + event.closesInMs)
+    } else if (event.type == 'voting-method') {
+      fetchRoom(true).catch(console.error)
+    } else if (event.type == 'owner-changed') {
+      setIsRoomOwner(event.owner === currentUser?.username)
+    } else if (event.type == 'kicked') {
+      if (event.username === currentUser?.username) {
+        navigate('/')
+      }
+    } else if (event.type == 'participant-joined' || event.type == 'participant-left') {
+      setProgress(prev => ({ ...prev, total: event.participantCount }))
+    } else if (event.type == 'quorum-reached') {
+      setProgress({ lockedIn: event.lockedInCount, total: event.participantCount })
+      if (isRoomOwner) {
+        fetchTally().catch(console.error)
+      }
+    } else if (event.type == 'tally') {
+      setTally(event.tally)
+    } else if (event.type == 'locked-in') {
+      setProgress({ lockedIn: event.lockedInCount, total: event.participantCount })
+      if (event.username) {
+        setFinished(prev => [...prev, { username: event.username, at: event.at }])
+      }
+    } else if (event.type == 'reactions') {
+      setReactions(event.reactions)
+    } else if (event.type == 'message') {
+      setMessages(prev => [...prev, event.message])
+    } else if (event.type == 'unlocked') {
+      setProgress({ lockedIn: event.lockedInCount, total: event.participantCount })
+      setFinished(prev => prev.filter(f => f.username !== event.username))
+    } else if (event.type == 'lock-in-accepted' && event.room === id) {
+      setLockingIn(false)
+      setLockedIn(true)
+    } else if (event.type == 'lock-in-failed' && event.room === id) {
+      setLockingIn(false)
+      window.alert(`Your vote wasn't locked in: ${event.message}`)
+    } else if (event.type == 'unlocked-by-owner') {
+      setLockedIn(false)
+    } else if (event.type == 'reset') {
+      options.forEach(opt => values.set(opt, startValue(scoreRange)))
       setValues(new Map(values))
-      setOptions(new_options)
+      setScored(new Set())
+      setLockedIn(false)
+      setProgress({ lockedIn: event.lockedInCount, total: event.participantCount })
+      setFinished([])
     } else if (event.type == 'results-available') {
       setLockedIn(true)
       setResultsId(event.id)
     }
   }
 
+  async function unlock() {
+    const response = await fetch(`/api/room/${id}/unlock`, {
+      method: 'POST',
+      headers: {
+        'Content-type': 'application/json; charset=UTF-8'
+      }
+    })
+    if (response.status == 204) {
+      setLockedIn(false)
+    }
+  }
+
+  async function unlockFor(username) {
+    await fetch(`/api/room/${id}/unlock/${encodeURIComponent(username)}`, {
+      method: 'POST',
+      headers: {
+        'Content-type': 'application/json; charset=UTF-8'
+      }
+    })
+  }
+
+  async function resetVotes() {
+    if (!window.confirm('Clear everyone\'s votes and start over?')) {
+      return
+    }
+    await fetch(`/api/room/${id}/reset`, {
+      method: 'POST',
+      headers: {
+        'Content-type': 'application/json; charset=UTF-8'
+      }
+    })
+  }
+
   async function addOption(opt) {
     WSHandler.addOption(id, opt)
   }
+  function remainingBudget() {
+    const spent = options.reduce((sum, opt) => sum + (values.get(opt) ?? 0), 0)
+    return scoreRange.budget - spent
+  }
+  function maxValueFor(opt) {
+    if (scoreRange.budget > 0) {
+      return Math.min(scoreRange.max, values.get(opt) + remainingBudget())
+    }
+    return scoreRange.max
+  }
   function renderOptions() {
     if (options.length == 0) {
       return (<p>Add an option...</p>)
     }
-    return options.map((opt, i) => (
-      <VoteOption
+    const Option = scoreRange.approval ? ApprovalOption : VoteOption
+    const pinnedFirst = [
+      ...pinned.filter(opt => options.includes(opt)),
+      ...options.filter(opt => !pinned.includes(opt))
+    ]
+    return pinnedFirst.map((opt, i) => (
+      <Option
         name={opt}
         key={i}
         value={values.get(opt)}
-        setValue={(val) => setValues(new Map(values.set(opt, val)))}
-        disabled={lockedIn}
+        min={scoreRange.min}
+        max={maxValueFor(opt)}
+        setValue={(val) => {
+          setValues(new Map(values.set(opt, val)))
+          setScored(new Set(scored).add(opt))
+        }}
+        disabled={lockedIn || isSpectator}
+        pin={<PinToggle
+          pinned={pinned.includes(opt)}
+          canPin={isRoomOwner && resultsId === ''}
+          onToggle={() => togglePin(opt).catch(console.error)}
+        />}
+        details={<OptionDetails {...optionDetails[opt]} />}
+        comment={!isSpectator && <OptionComment
+          value={comments[opt]}
+          setValue={(text) => setComments(prev => ({ ...prev, [opt]: text }))}
+          disabled={lockedIn}
+        />}
+        reactions={<Reactions
+          counts={reactions[opt]}
+          mine={myReactions[opt]}
+          onReact={emoji => react(opt, emoji).catch(console.error)}
+          disabled={resultsId !== ''}
+        />}
       />
     ))
   }
@@ -165,15 +604,30 @@ export default function Vote() {
       setCopied(false)
     }, 500);
   }
+  // approval rooms are exempt, since leaving an option unapproved is an answer
+  function mustScoreAll() {
+    return requireComplete && !scoreRange.approval
+  }
+
+  // Rooms that want every option scored only get the ones the voter set, so
+  // the server can tell an option left alone from one deliberately scored.
+  function ballot() {
+    const entries = Array.from(values)
+    return Object.fromEntries(mustScoreAll() ? entries.filter(([opt]) => scored.has(opt)) : entries)
+  }
+
   function renderButton() {
     const lockInButton = (<button
       className="main__button"
+      disabled={lockingIn}
       onClick={() => {
-        setLockedIn(true)
-        WSHandler.lockIn(id, Object.fromEntries(values))
+        setLockingIn(true)
+        WSHandler.lockIn(id, ballot(), comments)
       }}
-    >Lock in vote</button>)
+    >{lockingIn ? 'Locking in...' : 'Lock in vote'}</button>)
+    const incompleteButton = (<button className="main__button main__button--disabled" disabled>Score every option to lock in</button>)
     const lockedInButton = (<button className="main__button main__button--disabled" disabled>Locked in</button>)
+    const unlockButton = (<button className="main__button" onClick={unlock}>Change my vote</button>)
     const closeVoteButton = (<button
       className="main__button"
       onClick={() => fetch(`/api/room/${id}/close`, {
@@ -183,20 +637,31 @@ export default function Vote() {
         }
       })
         .then(res => res.json())
-        .then(j => setResultsId(j.resultsId))
+        .then(j => {
+          if (j.warning) {
+            window.alert(j.warning)
+          }
+          setClosedResult(j.result ?? null)
+          setResultsId(j.resultsId)
+        })
       }
     >Close vote</button>)
     const viewResultsButton = (<NavLink
       className="main__button"
       to={`/results/${resultsId}`}
+      state={closedResult && { result: closedResult }}
     >View Results</NavLink>)
 
+    if (isSpectator) {
+      return resultsId === '' ? null : viewResultsButton
+    }
     if (!lockedIn) {
-      return lockInButton
+      const incomplete = mustScoreAll() && options.some(opt => !scored.has(opt) || values.get(opt) === 0)
+      return incomplete ? incompleteButton : lockInButton
     }
     if (resultsId === '') {
-      if (isRoomOwner) { return closeVoteButton }
-      return lockedInButton
+      if (isRoomOwner) { return (<>{closeVoteButton}{unlockButton}</>) }
+      return (<>{lockedInButton}{unlockButton}</>)
     }
     return viewResultsButton
   }
@@ -208,11 +673,52 @@ export default function Vote() {
         <span className={`header-room-code__toast ${copied ? 'header-room-code__toast--visible' : ''}`}>Copied</span>
       </header>
       <main className="main">
+        {deadline !== null && resultsId === '' && <Countdown deadline={deadline} />}
+        {scoreRange.budget > 0 && (
+          <p className="vote-budget">Points left: {remainingBudget()}</p>
+        )}
         <ul className="vote-options">
           {renderOptions()}
         </ul>
-        <AddOption onSubmit={addOption} disabled={lockedIn} />
+        {isSpectator
+          ? <p className="vote-spectating">You're watching this QuikVote</p>
+          : <AddOption onSubmit={addOption} disabled={lockedIn} />}
+        {isRoomOwner && (
+          <p className="vote-progress">
+            {progress.lockedIn} of {progress.total} locked in
+            {quorum > 0 && (
+              <span className={`vote-progress__quorum ${progress.lockedIn >= quorum ? 'vote-progress__quorum--reached' : ''}`}>
+                {progress.lockedIn >= quorum ? 'Quorum reached' : `Quorum: ${quorum}`}
+              </span>
+            )}
+          </p>
+        )}
+        {isRoomOwner && online.length > 0 && (
+          <p className="vote-presence">Online now: {online.join(', ')}</p>
+        )}
+        {isRoomOwner && tally && tally.totals.length > 0 && (
+          <LiveTally tally={tally} />
+        )}
+        {isRoomOwner && finished.length > 0 && (
+          <ol className="vote-finished">
+            {finished.map(f => (
+              <li key={f.username}>
+                {f.username}
+                {f.at && <span className="vote-finished__time">{new Date(f.at).toLocaleTimeString()}</span>}
+                {f.username && f.username !== currentUser?.username && resultsId === '' && (
+                  <button className="vote-finished__unlock" onClick={() => unlockFor(f.username).catch(console.error)}>
+                    Let them revote
+                  </button>
+                )}
+              </li>
+            ))}
+          </ol>
+        )}
         {renderButton()}
+        {isRoomOwner && resultsId === '' && (
+          <button className="vote-reset" onClick={() => resetVotes().catch(console.error)}>Reset votes</button>
+        )}
+        <Chat messages={messages} onSend={text => sendMessage(text).catch(console.error)} />
       </main>
     </>
   )
@@ -1,5 +1,10 @@
+// how long to wait before reconnecting after the server restarts
+const RECONNECT_DELAY_MS = 2000
+
 class WebSocketHandler {
   handlers = [];
+  pending = [];
+  rooms = new Set();
   connected = false
 
   connect() {
@@ -12,10 +17,16 @@ class WebSocketHandler {
     this.socket.onopen = (event) => {
       this.connected = true
       console.log('web socket connected!')
+      this.pending.forEach((msg) => this.socket.send(msg))
+      this.pending = []
     };
     this.socket.onclose = (event) => {
       this.connected = false
       console.log('web socket disconnected')
+      // 1001 means the server is going away, e.g. during a deploy
+      if (event.code === 1001) {
+        setTimeout(() => this.reconnect(), RECONNECT_DELAY_MS)
+      }
     };
     this.socket.onmessage = (msg) => {
       try {
@@ -27,16 +38,35 @@ class WebSocketHandler {
     };
   }
 
+  send(event) {
+    const msg = JSON.stringify(event)
+    if (this.connected) {
+      this.socket.send(msg)
+    } else {
+      this.pending.push(msg)
+    }
+  }
+
+  subscribe(room) {
+    this.rooms.add(room)
+    this.send({ type: 'subscribe', room })
+  }
+
+  reconnect() {
+    this.connect()
+    this.rooms.forEach((room) => this.send({ type: 'subscribe', room }))
+  }
+
   addOption(room, option) {
-    this.socket.send(JSON.stringify({ type: 'new_option', room, option }));
+    this.send({ type: 'new_option', room, option });
   }
 
-  lockIn(room, votes) {
-    this.socket.send(JSON.stringify({ type: 'lock_in', room, votes }))
+  lockIn(room, votes, comments) {
+    this.send({ type: 'lock_in', room, votes, comments })
   }
 
   closeRoom(room) {
-    this.socket.send(JSON.stringify({ type: 'close_room', room }))
+    this.send({ type: 'close_room', room })
   }
 
   addHandler(handler) {
@@ -44,7 +74,7 @@ class WebSocketHandler {
   }
 
   removeHandler(handler) {
-    this.handlers.filter((h) => h !== handler);
+    this.handlers = this.handlers.filter((h) => h !== handler);
   }
 
   receiveEvent(event) {
@@ -1,3 +1,7 @@
-export function getIconUrlFromSeed(seed) {
-  return `https://api.dicebear.com/9.x/icons/svg?seed=${seed}`
+// Room icons are served by the API, which either draws them or fetches them
+// from the avatar service, so the browser never hands room codes to anyone
+// else. version busts the browser's cache when a room's icon changes.
+export function getIconUrlFromSeed(seed, version) {
+  const url = `/api/avatar/${encodeURIComponent(seed)}`
+  return version ? `${url}?v=${encodeURIComponent(version)}` : url
 }